@@ -2,8 +2,9 @@ package main
 
 import (
 	"embed"
+	"flag"
+	"log"
 	"os"
-	"strconv"
 
 	server "github.com/kristofferahl/aeto-web/server"
 )
@@ -12,23 +13,18 @@ import (
 var staticFiles embed.FS
 
 func main() {
-	inClusterConfig, err := strconv.ParseBool(environmentOrDefault("K8S_INCLUSTERCONFIG", "false"))
+	configLoader, err := server.NewConfigLoader(os.Args[1:], os.Stderr)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
 	if err != nil {
-		panic(err)
+		log.Fatal(err)
 	}
 
 	server := &server.Server{
 		EmbeddedFiles:     staticFiles,
 		EmbeddedFilesPath: "ui/dist",
-		ClusterConfig:     inClusterConfig,
+		ConfigLoader:      configLoader,
 	}
 	server.Run()
 }
-
-func environmentOrDefault(key string, defaultValue string) string {
-	value := os.Getenv(key)
-	if value == "" {
-		value = defaultValue
-	}
-	return value
-}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	accessReviewTTL = 1 * time.Minute
+)
+
+// allowFunc decides if the identity of a request may see a resource with the given namespace and name.
+type allowFunc func(namespace, name string) bool
+
+func allowAll(namespace, name string) bool {
+	return true
+}
+
+type accessDecision struct {
+	allowed bool
+	expires time.Time
+}
+
+// AccessReviewer checks the permissions of an identity using SubjectAccessReviews. Decisions are cached briefly as the
+// same checks are repeated for every list of cached resources.
+type AccessReviewer struct {
+	client    kubernetes.Interface
+	mu        sync.Mutex
+	decisions map[string]accessDecision
+}
+
+func NewAccessReviewer(client kubernetes.Interface) *AccessReviewer {
+	return &AccessReviewer{
+		client:    client,
+		decisions: make(map[string]accessDecision),
+	}
+}
+
+// Allowed returns true when the identity may perform the verb on the resource. Errors are logged and treated as denied.
+func (r *AccessReviewer) Allowed(ctx context.Context, identity *Identity, verb string, gvr schema.GroupVersionResource, namespace, name string) bool {
+	key := strings.Join([]string{identity.Username, strings.Join(identity.Groups, ","), verb, gvr.String(), namespace, name}, "|")
+
+	r.mu.Lock()
+	if d, ok := r.decisions[key]; ok && time.Now().Before(d.expires) {
+		r.mu.Unlock()
+		return d.allowed
+	}
+	r.mu.Unlock()
+
+	review, err := r.client.AuthorizationV1().SubjectAccessReviews().Create(ctx, &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:   identity.Username,
+			Groups: identity.Groups,
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace: namespace,
+				Verb:      verb,
+				Group:     gvr.Group,
+				Version:   gvr.Version,
+				Resource:  gvr.Resource,
+				Name:      name,
+			},
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		log.Println("failed to review access for", identity.Username, fmt.Sprintf("%s %s %s/%s,", verb, gvr.Resource, namespace, name), err)
+		return false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	for k, d := range r.decisions {
+		if now.After(d.expires) {
+			delete(r.decisions, k)
+		}
+	}
+	r.decisions[key] = accessDecision{
+		allowed: review.Status.Allowed,
+		expires: now.Add(accessReviewTTL),
+	}
+	return review.Status.Allowed
+}
+
+// AllowFunc returns a func deciding if the identity may get a resource. Permission to list the resource in a namespace
+// allows every resource in that namespace, otherwise permission to get each resource by name is required.
+func (r *AccessReviewer) AllowFunc(ctx context.Context, identity *Identity, gvr schema.GroupVersionResource) allowFunc {
+	return func(namespace, name string) bool {
+		if r.Allowed(ctx, identity, "list", gvr, namespace, "") {
+			return true
+		}
+		return r.Allowed(ctx, identity, "get", gvr, namespace, name)
+	}
+}
@@ -2,51 +2,238 @@ package server
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
+	"sort"
 	"time"
 
 	"github.com/go-chi/chi/middleware"
 	"github.com/go-chi/chi/v5"
+	acmawsv1alpha1 "github.com/kristofferahl/aeto/apis/acm.aws/v1alpha1"
+	corev1alpha1 "github.com/kristofferahl/aeto/apis/core/v1alpha1"
+	eventv1alpha1 "github.com/kristofferahl/aeto/apis/event/v1alpha1"
+	route53awsv1alpha1 "github.com/kristofferahl/aeto/apis/route53.aws/v1alpha1"
+	sustainabilityv1alpha1 "github.com/kristofferahl/aeto/apis/sustainability/v1alpha1"
 	"github.com/teacat/jsonfilter"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 )
 
-func addApiRoutes(s *Server, router *chi.Mux) {
-	restConfig, err := getRestConfig(s.ClusterConfig)
-	if err != nil {
-		panic(err)
-	}
+const (
+	maxRequestBodySize = 1 << 20
+	listFilter         = "items(metadata(annotations,creationTimestamp,finalizers,generation,name,namespace,resourceVersion,uid),spec,status)"
+)
 
-	client, err := NewForConfig(restConfig)
-	if err != nil {
-		panic(err)
+// apiResource describes a resource exposed by the api for every cluster.
+// Cached resources are served from the informer cache of the cluster while other resources are fetched from the api
+// server on every request.
+type apiResource struct {
+	Name         string
+	GroupVersion schema.GroupVersion
+	Cached       bool
+	List         func(client *AetoClient, namespace string, allowed allowFunc) (interface{}, error)
+	Get          func(client *AetoClient, namespace, name string) (interface{}, error)
+}
+
+var apiResources = []apiResource{
+	{
+		Name:         "tenants",
+		GroupVersion: corev1alpha1.GroupVersion,
+		Cached:       true,
+		List: func(client *AetoClient, namespace string, allowed allowFunc) (interface{}, error) {
+			return client.CoreV1Alpha1(namespace).ListTenants(func(i corev1alpha1.Tenant) bool {
+				return allowed(i.Namespace, i.Name)
+			})
+		},
+		Get: func(client *AetoClient, namespace, name string) (interface{}, error) {
+			return client.CoreV1Alpha1(namespace).GetTenant(name)
+		},
+	},
+	{
+		Name:         "blueprints",
+		GroupVersion: corev1alpha1.GroupVersion,
+		Cached:       true,
+		List: func(client *AetoClient, namespace string, allowed allowFunc) (interface{}, error) {
+			return client.CoreV1Alpha1(namespace).ListBlueprints(func(i corev1alpha1.Blueprint) bool {
+				return allowed(i.Namespace, i.Name)
+			})
+		},
+		Get: func(client *AetoClient, namespace, name string) (interface{}, error) {
+			return client.CoreV1Alpha1(namespace).GetBlueprint(name)
+		},
+	},
+	{
+		Name:         "resourcesets",
+		GroupVersion: corev1alpha1.GroupVersion,
+		Cached:       true,
+		List: func(client *AetoClient, namespace string, allowed allowFunc) (interface{}, error) {
+			return client.CoreV1Alpha1(namespace).ListResourceSets(func(i corev1alpha1.ResourceSet) bool {
+				return allowed(i.Namespace, i.Name)
+			})
+		},
+		Get: func(client *AetoClient, namespace, name string) (interface{}, error) {
+			return client.CoreV1Alpha1(namespace).GetResourceSet(name)
+		},
+	},
+	{
+		Name:         "resourcetemplates",
+		GroupVersion: corev1alpha1.GroupVersion,
+		Cached:       true,
+		List: func(client *AetoClient, namespace string, allowed allowFunc) (interface{}, error) {
+			return client.CoreV1Alpha1(namespace).ListResourceTemplates(func(i corev1alpha1.ResourceTemplate) bool {
+				return allowed(i.Namespace, i.Name)
+			})
+		},
+		Get: func(client *AetoClient, namespace, name string) (interface{}, error) {
+			return client.CoreV1Alpha1(namespace).GetResourceTemplate(name)
+		},
+	},
+	{
+		Name:         "eventstreamchunks",
+		GroupVersion: eventv1alpha1.GroupVersion,
+		List: func(client *AetoClient, namespace string, allowed allowFunc) (interface{}, error) {
+			l, err := client.EventV1Alpha1(namespace).ListEventStreamChunks()
+			if err != nil {
+				return nil, err
+			}
+			l.Items = filter(l.Items, func(i eventv1alpha1.EventStreamChunk) bool {
+				return allowed(i.Namespace, i.Name)
+			})
+			return l, nil
+		},
+		Get: func(client *AetoClient, namespace, name string) (interface{}, error) {
+			return client.EventV1Alpha1(namespace).GetEventStreamChunk(name)
+		},
+	},
+	{
+		Name:         "savingspolicies",
+		GroupVersion: sustainabilityv1alpha1.GroupVersion,
+		List: func(client *AetoClient, namespace string, allowed allowFunc) (interface{}, error) {
+			l, err := client.SustainabilityV1Alpha1(namespace).ListSavingsPolicies()
+			if err != nil {
+				return nil, err
+			}
+			l.Items = filter(l.Items, func(i sustainabilityv1alpha1.SavingsPolicy) bool {
+				return allowed(i.Namespace, i.Name)
+			})
+			return l, nil
+		},
+		Get: func(client *AetoClient, namespace, name string) (interface{}, error) {
+			return client.SustainabilityV1Alpha1(namespace).GetSavingsPolicy(name)
+		},
+	},
+	{
+		Name:         "certificates",
+		GroupVersion: acmawsv1alpha1.GroupVersion,
+		List: func(client *AetoClient, namespace string, allowed allowFunc) (interface{}, error) {
+			l, err := client.AcmAwsV1Alpha1(namespace).ListCertificates()
+			if err != nil {
+				return nil, err
+			}
+			l.Items = filter(l.Items, func(i acmawsv1alpha1.Certificate) bool {
+				return allowed(i.Namespace, i.Name)
+			})
+			return l, nil
+		},
+		Get: func(client *AetoClient, namespace, name string) (interface{}, error) {
+			return client.AcmAwsV1Alpha1(namespace).GetCertificate(name)
+		},
+	},
+	{
+		Name:         "certificateconnectors",
+		GroupVersion: acmawsv1alpha1.GroupVersion,
+		List: func(client *AetoClient, namespace string, allowed allowFunc) (interface{}, error) {
+			l, err := client.AcmAwsV1Alpha1(namespace).ListCertificateConnectors()
+			if err != nil {
+				return nil, err
+			}
+			l.Items = filter(l.Items, func(i acmawsv1alpha1.CertificateConnector) bool {
+				return allowed(i.Namespace, i.Name)
+			})
+			return l, nil
+		},
+		Get: func(client *AetoClient, namespace, name string) (interface{}, error) {
+			return client.AcmAwsV1Alpha1(namespace).GetCertificateConnector(name)
+		},
+	},
+	{
+		Name:         "hostedzones",
+		GroupVersion: route53awsv1alpha1.GroupVersion,
+		List: func(client *AetoClient, namespace string, allowed allowFunc) (interface{}, error) {
+			l, err := client.Route53AwsV1Alpha1(namespace).ListHostedZones()
+			if err != nil {
+				return nil, err
+			}
+			l.Items = filter(l.Items, func(i route53awsv1alpha1.HostedZone) bool {
+				return allowed(i.Namespace, i.Name)
+			})
+			return l, nil
+		},
+		Get: func(client *AetoClient, namespace, name string) (interface{}, error) {
+			return client.Route53AwsV1Alpha1(namespace).GetHostedZone(name)
+		},
+	},
+}
+
+func findResource(name string) (apiResource, bool) {
+	for _, r := range apiResources {
+		if r.Name == name {
+			return r, true
+		}
 	}
+	return apiResource{}, false
+}
+
+type Dashboard struct {
+	Tenants  int            `json:"tenants"`
+	Changes  []CacheEvent   `json:"changes"`
+	Clusters map[string]int `json:"clusters,omitempty"`
+}
+
+func addApiRoutes(s *Server, router chi.Router) {
+	config := s.Config()
 
-	// TODO: Make this configurable
-	operatorNamespace := "aeto"
+	s.clusters = newClusters(config)
+	for _, c := range s.clusters {
+		go c.connectWithRetry(config)
+	}
 
-	client.CoreV1Alpha1(operatorNamespace).Watch()
+	operatorNamespace := config.Namespaces.Operator
 
 	router.Route("/api", func(r chi.Router) {
 		r.Use(middleware.Timeout(60 * time.Second))
+		r.Use(audit(s))
+		r.Use(throttle(s, RateLimitBucketAPI))
+		r.Use(enforceReadOnly)
+		if config.Redaction.Enabled {
+			r.Use(redactResponses(s))
+		}
+
+		addMeRoutes(s, r)
+		addAPIKeyRoutes(s, r)
+		addAuditRoutes(s, r)
 
-		r.Get("/dashboard", func(w http.ResponseWriter, req *http.Request) {
+		r.With(authorize(s, PermissionReadConfig)).Get("/config", func(w http.ResponseWriter, req *http.Request) {
 			w.Header().Set("Content-Type", "application/json")
 
-			tenants, err := client.CoreV1Alpha1(operatorNamespace).ListTenants()
+			data, err := json.Marshal(s.Config().Redacted())
 			if hasErr(w, err) {
 				return
 			}
 
-			dashboard := struct {
-				Tenants int          `json:"tenants"`
-				Changes []CacheEvent `json:"changes"`
-			}{
-				Tenants: len(tenants.Items),
-				Changes: cache.changestream.TakeLast(15),
+			w.Write(data)
+		})
+
+		r.With(authorize(s, PermissionReadResources)).Get("/clusters", func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+
+			clusters := make([]ClusterStatus, 0)
+			for _, c := range s.clusters {
+				clusters = append(clusters, c.Status())
 			}
 
-			data, err := json.Marshal(dashboard)
+			data, err := json.Marshal(clusters)
 			if hasErr(w, err) {
 				return
 			}
@@ -54,72 +241,124 @@ func addApiRoutes(s *Server, router *chi.Mux) {
 			w.Write(data)
 		})
 
-		r.Get("/tenants", listResource(client, func() (interface{}, error) {
-			return client.CoreV1Alpha1(operatorNamespace).ListTenants()
-		}))
-		r.Get("/tenants/{namespace}/{name}", getResource(client, func(namespace, name string) (interface{}, error) {
-			return client.CoreV1Alpha1(namespace).GetTenant(name)
-		}))
+		r.Route("/aggregate", func(r chi.Router) {
+			r.With(authorize(s, PermissionReadResources)).Get("/dashboard", func(w http.ResponseWriter, req *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
 
-		r.Get("/blueprints", listResource(client, func() (interface{}, error) {
-			return client.CoreV1Alpha1(operatorNamespace).ListBlueprints()
-		}))
-		r.Get("/blueprints/{namespace}/{name}", getResource(client, func(namespace, name string) (interface{}, error) {
-			return client.CoreV1Alpha1(namespace).GetBlueprint(name)
-		}))
+				dashboard := Dashboard{
+					Changes:  make([]CacheEvent, 0),
+					Clusters: make(map[string]int),
+				}
+				for _, c := range s.clusters {
+					client := c.Client()
+					if client == nil {
+						continue
+					}
+					allowed := s.allowFunc(req, client, corev1alpha1.GroupVersion.WithResource("tenants"))
+					tenants, err := client.CoreV1Alpha1(operatorNamespace).ListTenants(func(i corev1alpha1.Tenant) bool {
+						return allowed(i.Namespace, i.Name)
+					})
+					if hasErr(w, err) {
+						return
+					}
+					dashboard.Tenants += len(tenants.Items)
+					dashboard.Clusters[c.Name] = len(tenants.Items)
+					dashboard.Changes = append(dashboard.Changes, client.Changes().TakeLast(15)...)
+				}
+				sort.Slice(dashboard.Changes, func(i, j int) bool {
+					return dashboard.Changes[i].time.Before(dashboard.Changes[j].time)
+				})
+				if n := len(dashboard.Changes); n > 15 {
+					dashboard.Changes = dashboard.Changes[n-15:]
+				}
 
-		r.Get("/resourcesets", listResource(client, func() (interface{}, error) {
-			return client.CoreV1Alpha1(operatorNamespace).ListResourceSets()
-		}))
-		r.Get("/resourcesets/{namespace}/{name}", getResource(client, func(namespace, name string) (interface{}, error) {
-			return client.CoreV1Alpha1(namespace).GetResourceSet(name)
-		}))
+				data, err := json.Marshal(dashboard)
+				if hasErr(w, err) {
+					return
+				}
 
-		r.Get("/resourcetemplates", listResource(client, func() (interface{}, error) {
-			return client.CoreV1Alpha1(operatorNamespace).ListResourceTemplates()
-		}))
-		r.Get("/resourcetemplates/{namespace}/{name}", getResource(client, func(namespace, name string) (interface{}, error) {
-			return client.CoreV1Alpha1(namespace).GetResourceTemplate(name)
-		}))
+				w.Write(data)
+			})
 
-		r.Get("/eventstreamchunks", listResource(client, func() (interface{}, error) {
-			return client.EventV1Alpha1(operatorNamespace).ListEventStreamChunks()
-		}))
-		r.Get("/eventstreamchunks/{namespace}/{name}", getResource(client, func(namespace, name string) (interface{}, error) {
-			return client.EventV1Alpha1(namespace).GetEventStreamChunk(name)
-		}))
+			for _, resource := range apiResources {
+				r.With(authorize(s, PermissionReadResources), throttleResource(s, resource)).Get("/"+resource.Name, aggregateResource(s, resource, operatorNamespace))
+			}
+		})
 
-		r.Get("/savingspolicies", listResource(client, func() (interface{}, error) {
-			return client.SustainabilityV1Alpha1(operatorNamespace).ListSavingsPolicies()
-		}))
-		r.Get("/savingspolicies/{namespace}/{name}", getResource(client, func(namespace, name string) (interface{}, error) {
-			return client.SustainabilityV1Alpha1(namespace).GetSavingsPolicy(name)
-		}))
+		r.Route("/clusters/{cluster}", func(r chi.Router) {
+			r.Use(withCluster(s))
+			addClusterRoutes(s, r, operatorNamespace)
+		})
 
-		r.Get("/certificates", listResource(client, func() (interface{}, error) {
-			return client.AcmAwsV1Alpha1(operatorNamespace).ListCertificates()
-		}))
-		r.Get("/certificates/{namespace}/{name}", getResource(client, func(namespace, name string) (interface{}, error) {
-			return client.AcmAwsV1Alpha1(namespace).GetCertificate(name)
-		}))
-		r.Get("/certificateconnectors", listResource(client, func() (interface{}, error) {
-			return client.AcmAwsV1Alpha1(operatorNamespace).ListCertificateConnectors()
-		}))
-		r.Get("/certificateconnectors/{namespace}/{name}", getResource(client, func(namespace, name string) (interface{}, error) {
-			return client.AcmAwsV1Alpha1(namespace).GetCertificateConnector(name)
-		}))
+		// Routes without a cluster prefix are served by the first configured cluster
+		r.Group(func(r chi.Router) {
+			r.Use(withCluster(s))
+			addClusterRoutes(s, r, operatorNamespace)
+		})
+	})
+}
 
-		r.Get("/hostedzones", listResource(client, func() (interface{}, error) {
-			return client.Route53AwsV1Alpha1(operatorNamespace).ListHostedZones()
-		}))
-		r.Get("/hostedzones/{namespace}/{name}", getResource(client, func(namespace, name string) (interface{}, error) {
-			return client.Route53AwsV1Alpha1(namespace).GetHostedZone(name)
-		}))
+func addClusterRoutes(s *Server, r chi.Router, operatorNamespace string) {
+	r.With(authorize(s, PermissionReadResources)).Get("/dashboard", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		client := clusterFrom(req).Client()
+		allowed := s.allowFunc(req, client, corev1alpha1.GroupVersion.WithResource("tenants"))
+
+		tenants, err := client.CoreV1Alpha1(operatorNamespace).ListTenants(func(i corev1alpha1.Tenant) bool {
+			return allowed(i.Namespace, i.Name)
+		})
+		if hasErr(w, err) {
+			return
+		}
+
+		dashboard := Dashboard{
+			Tenants: len(tenants.Items),
+			Changes: client.Changes().TakeLast(15),
+		}
+
+		data, err := json.Marshal(dashboard)
+		if hasErr(w, err) {
+			return
+		}
+
+		w.Write(data)
+	})
+
+	r.With(authorize(s, PermissionReadResources)).Get("/capabilities", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		data, err := json.Marshal(clusterFrom(req).Client().Capabilities())
+		if hasErr(w, err) {
+			return
+		}
+
+		w.Write(data)
 	})
+
+	addTenantRoutes(s, r, operatorNamespace)
+	addReconcileRoutes(s, r)
+	addMigrationRoutes(s, r, operatorNamespace)
+	addBundleRoutes(s, r, operatorNamespace)
+	addExpiryRoutes(s, r, operatorNamespace)
+	addScheduleRoutes(s, r, operatorNamespace)
+	addSavingsRoutes(s, r, operatorNamespace)
+	addCalendarRoutes(s, r, operatorNamespace)
+
+	for _, resource := range apiResources {
+		r.With(authorize(s, PermissionReadResources), throttleResource(s, resource)).Get("/"+resource.Name, listResource(s, resource, operatorNamespace))
+		r.With(authorize(s, PermissionReadResources), throttleResource(s, resource)).Get("/"+resource.Name+"/{namespace}/{name}", getResource(s, resource))
+		r.With(authorize(s, PermissionPatchResources), throttle(s, RateLimitBucketDirect)).Patch("/"+resource.Name+"/{namespace}/{name}", patchResource(s, resource))
+	}
 }
 
+// hasErr writes an error response when err is not nil. Client errors returned by the api server, ie 403 and 404, are
+// passed on while any other error results in a 500.
 func hasErr(w http.ResponseWriter, err error) bool {
 	if err != nil {
+		if status, ok := err.(apierrors.APIStatus); ok && status.Status().Code >= 400 && status.Status().Code < 500 {
+			writeError(w, int(status.Status().Code), status.Status().Message)
+			return true
+		}
 		log.Println("an unhandled error occured,", err)
 		w.WriteHeader(500)
 		return true
@@ -127,21 +366,154 @@ func hasErr(w http.ResponseWriter, err error) bool {
 	return false
 }
 
-func listResource(client *AetoClient, list func() (interface{}, error)) func(w http.ResponseWriter, req *http.Request) {
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	data, _ := json.Marshal(struct {
+		Error string `json:"error"`
+	}{
+		Error: message,
+	})
+	w.Write(data)
+}
+
+// decodeJSON decodes the json body of a request into v, answering with 400 and returning false when it is invalid.
+func decodeJSON(w http.ResponseWriter, req *http.Request, v interface{}) bool {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, req.Body, maxRequestBodySize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		writeError(w, 400, fmt.Sprintf("invalid request body, %s", err))
+		return false
+	}
+	return true
+}
+
+// notServed writes a 404 response when the cluster does not serve the api group of the resource.
+func notServed(w http.ResponseWriter, client *AetoClient, resource apiResource) bool {
+	if !client.Serves(resource.GroupVersion) {
+		writeError(w, 404, fmt.Sprintf("%s is not served by this cluster, api group %s is not installed", resource.Name, resource.GroupVersion))
+		return true
+	}
+	return false
+}
+
+// allowFunc returns a func authorizing the identity of the request to see cached resources when impersonation is enabled
+// or when the request is made with an api key.
+func (s *Server) allowFunc(req *http.Request, client *AetoClient, gvr schema.GroupVersionResource) allowFunc {
+	identity := identityFrom(req)
+	if identity.Scopes != nil {
+		if !identity.Scopes.AllowsResource(gvr.Resource) {
+			return func(namespace, name string) bool { return false }
+		}
+		return identity.Scopes.Allow
+	}
+	if !s.Config().Auth.Impersonate || identity.Method == AuthMethodAnonymous {
+		return allowAll
+	}
+	return client.AllowFunc(req.Context(), identity, gvr)
+}
+
+// access returns the client to use for a resource and a func authorizing access to it. When impersonation is enabled
+// direct api calls are made as the identity of the request while cached resources are checked with access reviews.
+// Api keys are never impersonated, their scopes decide which resources and namespaces they may access.
+func (s *Server) access(req *http.Request, client *AetoClient, resource apiResource) (*AetoClient, allowFunc, error) {
+	identity := identityFrom(req)
+	if identity.Scopes != nil {
+		gr := resource.GroupVersion.WithResource(resource.Name).GroupResource()
+		if !identity.Scopes.AllowsResource(resource.Name) {
+			return nil, nil, apierrors.NewForbidden(gr, "", fmt.Errorf("api key is not scoped to %s", resource.Name))
+		}
+		return client, identity.Scopes.Allow, nil
+	}
+	if !s.Config().Auth.Impersonate || identity.Method == AuthMethodAnonymous {
+		return client, allowAll, nil
+	}
+	if resource.Cached {
+		return client, client.AllowFunc(req.Context(), identity, resource.GroupVersion.WithResource(resource.Name)), nil
+	}
+	impersonated, err := client.Impersonate(identity)
+	return impersonated, allowAll, err
+}
+
+// writer returns the client to change a resource in the namespace with. When impersonation is enabled changes are made
+// as the identity of the request while api keys are checked against their scopes.
+func (s *Server) writer(req *http.Request, client *AetoClient, resource apiResource, namespace string) (*AetoClient, error) {
+	identity := identityFrom(req)
+	gr := resource.GroupVersion.WithResource(resource.Name).GroupResource()
+	if identity.Scopes != nil {
+		if !identity.Scopes.AllowsResource(resource.Name) || !identity.Scopes.Allow(namespace, "") {
+			return nil, apierrors.NewForbidden(gr, "", fmt.Errorf("api key is not scoped to %s in %s", resource.Name, namespace))
+		}
+		return client, nil
+	}
+	if !s.Config().Auth.Impersonate || identity.Method == AuthMethodAnonymous {
+		return client, nil
+	}
+	return client.Impersonate(identity)
+}
+
+// creator returns the client to create a resource in the namespace with, like writer. When impersonation is enabled
+// the identity of the request must be allowed to create the resource, checked up front so that validating the resource
+// never tells an identity that may not create it which resources exist.
+func (s *Server) creator(req *http.Request, client *AetoClient, resource apiResource, namespace string) (*AetoClient, error) {
+	writer, err := s.writer(req, client, resource, namespace)
+	if err != nil || s.runAs(req) == nil {
+		return writer, err
+	}
+	identity := identityFrom(req)
+	gvr := resource.GroupVersion.WithResource(resource.Name)
+	if !client.reviewer.Allowed(req.Context(), identity, "create", gvr, namespace, "") {
+		return nil, apierrors.NewForbidden(gvr.GroupResource(), "", fmt.Errorf("%s may not create %s in %s", identity.Username, resource.Name, namespace))
+	}
+	return writer, nil
+}
+
+// RunAs is the identity that changes made later on behalf of a user, ie by migrations and scheduled actions, are made
+// as.
+type RunAs struct {
+	Username string   `json:"username"`
+	Groups   []string `json:"groups,omitempty"`
+}
+
+// runAs returns the identity to make changes on behalf of the request later, or nil when its writer does not
+// impersonate it and changes are made as aeto-web.
+func (s *Server) runAs(req *http.Request) *RunAs {
+	identity := identityFrom(req)
+	if identity.Scopes != nil || !s.Config().Auth.Impersonate || identity.Method == AuthMethodAnonymous {
+		return nil
+	}
+	return &RunAs{Username: identity.Username, Groups: identity.Groups}
+}
+
+func filterList(rl interface{}) ([]byte, error) {
+	data, err := json.Marshal(rl)
+	if err != nil {
+		return nil, err
+	}
+
+	return jsonfilter.Filter(data, listFilter)
+}
+
+func listResource(s *Server, resource apiResource, namespace string) func(w http.ResponseWriter, req *http.Request) {
 	return func(w http.ResponseWriter, req *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 
-		rl, err := list()
+		client := clusterFrom(req).Client()
+		if notServed(w, client, resource) {
+			return
+		}
+
+		client, allowed, err := s.access(req, client, resource)
 		if hasErr(w, err) {
 			return
 		}
 
-		data, err := json.Marshal(rl)
+		rl, err := resource.List(client, namespace, allowed)
 		if hasErr(w, err) {
 			return
 		}
 
-		res, err := jsonfilter.Filter(data, "items(metadata(annotations,creationTimestamp,finalizers,generation,name,namespace,resourceVersion,uid),spec,status)")
+		res, err := filterList(rl)
 		if hasErr(w, err) {
 			return
 		}
@@ -150,14 +522,29 @@ func listResource(client *AetoClient, list func() (interface{}, error)) func(w h
 	}
 }
 
-func getResource(client *AetoClient, get func(namespace, name string) (interface{}, error)) func(w http.ResponseWriter, req *http.Request) {
+func getResource(s *Server, resource apiResource) func(w http.ResponseWriter, req *http.Request) {
 	return func(w http.ResponseWriter, req *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		namespace := chi.URLParam(req, "namespace")
 		name := chi.URLParam(req, "name")
 
+		client := clusterFrom(req).Client()
+		if notServed(w, client, resource) {
+			return
+		}
+
+		client, allowed, err := s.access(req, client, resource)
+		if hasErr(w, err) {
+			return
+		}
+
 		if namespace != "" && name != "" {
-			rs, err := get(namespace, name)
+			if !allowed(namespace, name) {
+				writeError(w, 403, fmt.Sprintf("%s is not allowed to get %s %s/%s", identityFrom(req).Username, resource.Name, namespace, name))
+				return
+			}
+
+			rs, err := resource.Get(client, namespace, name)
 			if hasErr(w, err) {
 				// TODO: Handle 404
 				return
@@ -175,3 +562,71 @@ func getResource(client *AetoClient, get func(namespace, name string) (interface
 		}
 	}
 }
+
+// aggregateResource lists a resource in all clusters. Every item is given a cluster field and clusters that fail are
+// reported in errors rather than failing the request.
+func aggregateResource(s *Server, resource apiResource, namespace string) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		result := struct {
+			Items  []map[string]interface{} `json:"items"`
+			Errors map[string]string        `json:"errors,omitempty"`
+		}{
+			Items:  make([]map[string]interface{}, 0),
+			Errors: make(map[string]string),
+		}
+
+		for _, c := range s.clusters {
+			client := c.Client()
+			if client == nil {
+				result.Errors[c.Name] = "not yet connected"
+				continue
+			}
+			if !client.Serves(resource.GroupVersion) {
+				continue
+			}
+
+			items, err := listClusterResource(s, req, client, resource, namespace)
+			if err != nil {
+				log.Println("failed to list", resource.Name, "in cluster", c.Name, err)
+				result.Errors[c.Name] = err.Error()
+				continue
+			}
+			for _, item := range items {
+				item["cluster"] = c.Name
+				result.Items = append(result.Items, item)
+			}
+		}
+
+		data, err := json.Marshal(result)
+		if hasErr(w, err) {
+			return
+		}
+
+		w.Write(data)
+	}
+}
+
+func listClusterResource(s *Server, req *http.Request, client *AetoClient, resource apiResource, namespace string) ([]map[string]interface{}, error) {
+	client, allowed, err := s.access(req, client, resource)
+	if err != nil {
+		return nil, err
+	}
+
+	rl, err := resource.List(client, namespace, allowed)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := filterList(rl)
+	if err != nil {
+		return nil, err
+	}
+
+	list := struct {
+		Items []map[string]interface{} `json:"items"`
+	}{}
+	err = json.Unmarshal(data, &list)
+	return list.Items, err
+}
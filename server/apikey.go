@@ -0,0 +1,525 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	apiKeyPrefix          = "aeto_"
+	apiKeyReloadInterval  = 30 * time.Second
+	apiKeyUsageInterval   = 1 * time.Minute
+	apiKeyUsernamePrefix  = "apikey:"
+	apiKeySecretManagedBy = "aeto-web"
+)
+
+// APIKey is an api key minted for a headless client. Only a hash of the key is stored.
+type APIKey struct {
+	ID         string       `json:"id"`
+	Name       string       `json:"name"`
+	Hash       string       `json:"hash,omitempty"`
+	Role       string       `json:"role,omitempty"`
+	Scopes     APIKeyScopes `json:"scopes"`
+	CreatedBy  string       `json:"createdBy"`
+	CreatedAt  time.Time    `json:"createdAt"`
+	ExpiresAt  *time.Time   `json:"expiresAt,omitempty"`
+	LastUsedAt *time.Time   `json:"lastUsedAt,omitempty"`
+}
+
+// APIKeyScopes limits what an api key may do. Empty resources or namespaces allow every resource or namespace.
+type APIKeyScopes struct {
+	ReadOnly   bool     `json:"readOnly"`
+	Resources  []string `json:"resources,omitempty"`
+	Namespaces []string `json:"namespaces,omitempty"`
+}
+
+func (s APIKeyScopes) AllowsResource(resource string) bool {
+	return containsAny([]string{resource}, s.Resources)
+}
+
+func (s APIKeyScopes) Allow(namespace, name string) bool {
+	return containsAny([]string{namespace}, s.Namespaces)
+}
+
+func (k APIKey) Expired() bool {
+	return k.ExpiresAt != nil && time.Now().After(*k.ExpiresAt)
+}
+
+// role returns the role of the key. Keys minted without a role are viewers when read-only and operators otherwise.
+func (k APIKey) role() string {
+	if k.Role != "" {
+		return k.Role
+	}
+	if k.Scopes.ReadOnly {
+		return RoleViewer
+	}
+	return RoleOperator
+}
+
+// APIKeyStore keeps api keys in a secret of the first cluster, one key per data entry. Keys are reloaded from the
+// secret periodically so that keys minted or revoked by other replicas are picked up. Usage is tracked in memory and
+// written to the secret in the background.
+type APIKeyStore struct {
+	namespace string
+	name      string
+	mu        sync.Mutex
+	keys      map[string]APIKey
+	loadedAt  time.Time
+	used      map[string]time.Time
+}
+
+func NewAPIKeyStore(namespace, name string) *APIKeyStore {
+	return &APIKeyStore{
+		namespace: namespace,
+		name:      name,
+		keys:      make(map[string]APIKey),
+		used:      make(map[string]time.Time),
+	}
+}
+
+// secret returns the secret storing the keys, or a new secret along with false when it does not yet exist.
+func (s *APIKeyStore) secret(ctx context.Context, client *AetoClient) (*corev1.Secret, bool, error) {
+	secret, err := client.kubernetes.CoreV1().Secrets(s.namespace).Get(ctx, s.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: s.namespace,
+				Name:      s.name,
+				Labels: map[string]string{
+					"app.kubernetes.io/managed-by": apiKeySecretManagedBy,
+				},
+			},
+			Data: make(map[string][]byte),
+		}, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if secret.Data == nil {
+		secret.Data = make(map[string][]byte)
+	}
+	return secret, true, nil
+}
+
+func (s *APIKeyStore) save(ctx context.Context, client *AetoClient, secret *corev1.Secret, exists bool) error {
+	var err error
+	if !exists {
+		_, err = client.kubernetes.CoreV1().Secrets(s.namespace).Create(ctx, secret, metav1.CreateOptions{})
+	} else {
+		_, err = client.kubernetes.CoreV1().Secrets(s.namespace).Update(ctx, secret, metav1.UpdateOptions{})
+	}
+	if apierrors.IsAlreadyExists(err) {
+		// Created by another replica, retry as a conflict
+		return apierrors.NewConflict(corev1.Resource("secrets"), s.name, err)
+	}
+	return err
+}
+
+func decodeAPIKeys(secret *corev1.Secret) map[string]APIKey {
+	keys := make(map[string]APIKey)
+	for id, data := range secret.Data {
+		key := APIKey{}
+		if err := json.Unmarshal(data, &key); err != nil {
+			log.Println("ignoring invalid api key", id, "in secret", secret.Namespace+"/"+secret.Name, err)
+			continue
+		}
+		keys[id] = key
+	}
+	return keys
+}
+
+// load reloads the keys from the secret unless they were loaded recently.
+func (s *APIKeyStore) load(ctx context.Context, client *AetoClient, force bool) error {
+	s.mu.Lock()
+	fresh := time.Since(s.loadedAt) < apiKeyReloadInterval
+	s.mu.Unlock()
+	if fresh && !force {
+		return nil
+	}
+
+	secret, _, err := s.secret(ctx, client)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = decodeAPIKeys(secret)
+	s.loadedAt = time.Now()
+	return nil
+}
+
+// update applies fn to the keys stored in the secret, retrying on conflicts, and reloads the keys afterwards.
+func (s *APIKeyStore) update(ctx context.Context, client *AetoClient, fn func(keys map[string]APIKey) error) error {
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		secret, exists, err := s.secret(ctx, client)
+		if err != nil {
+			return err
+		}
+
+		keys := decodeAPIKeys(secret)
+		if err := fn(keys); err != nil {
+			return err
+		}
+
+		secret.Data = make(map[string][]byte)
+		for id, key := range keys {
+			data, err := json.Marshal(key)
+			if err != nil {
+				return err
+			}
+			secret.Data[id] = data
+		}
+		return s.save(ctx, client, secret, exists)
+	})
+	if err != nil {
+		return err
+	}
+	return s.load(ctx, client, true)
+}
+
+// Authenticate returns the identity of an api key, or an error when the key is unknown, revoked or expired.
+func (s *APIKeyStore) Authenticate(ctx context.Context, client *AetoClient, token string) (*Identity, error) {
+	parts := strings.SplitN(strings.TrimPrefix(token, apiKeyPrefix), "_", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid api key")
+	}
+
+	if err := s.load(ctx, client, false); err != nil {
+		log.Println("failed to load api keys,", err)
+		return nil, fmt.Errorf("unable to verify api key")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, ok := s.keys[parts[0]]
+	if !ok || subtle.ConstantTimeCompare([]byte(hashAPIKey(token)), []byte(key.Hash)) != 1 {
+		return nil, fmt.Errorf("invalid api key")
+	}
+	if key.Expired() {
+		return nil, fmt.Errorf("api key %s has expired", key.Name)
+	}
+	s.used[key.ID] = time.Now().UTC()
+
+	scopes := key.Scopes
+	return &Identity{
+		Username: apiKeyUsernamePrefix + key.Name,
+		Groups:   []string{},
+		Method:   AuthMethodAPIKey,
+		Scopes:   &scopes,
+		Role:     key.role(),
+	}, nil
+}
+
+// Create mints a new api key and returns it together with the only copy of the secret token.
+func (s *APIKeyStore) Create(ctx context.Context, client *AetoClient, key APIKey) (APIKey, string, error) {
+	id, err := randomHex(8)
+	if err != nil {
+		return key, "", err
+	}
+	secret, err := randomString(32)
+	if err != nil {
+		return key, "", err
+	}
+	token := apiKeyPrefix + id + "_" + secret
+
+	key.ID = id
+	key.Hash = hashAPIKey(token)
+	key.CreatedAt = time.Now().UTC()
+
+	err = s.update(ctx, client, func(keys map[string]APIKey) error {
+		for _, k := range keys {
+			if k.Name == key.Name {
+				return apierrors.NewAlreadyExists(corev1.Resource("apikeys"), key.Name)
+			}
+		}
+		keys[id] = key
+		return nil
+	})
+	key.Hash = ""
+	return key, token, err
+}
+
+func (s *APIKeyStore) Revoke(ctx context.Context, client *AetoClient, id string) error {
+	return s.update(ctx, client, func(keys map[string]APIKey) error {
+		if _, ok := keys[id]; !ok {
+			return apierrors.NewNotFound(corev1.Resource("apikeys"), id)
+		}
+		delete(keys, id)
+		return nil
+	})
+}
+
+// List returns all keys, without hashes, including usage not yet written to the secret.
+func (s *APIKeyStore) List(ctx context.Context, client *AetoClient) ([]APIKey, error) {
+	if err := s.load(ctx, client, true); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]APIKey, 0, len(s.keys))
+	for _, key := range s.keys {
+		key.Hash = ""
+		if used, ok := s.used[key.ID]; ok && (key.LastUsedAt == nil || used.After(*key.LastUsedAt)) {
+			key.LastUsedAt = &used
+		}
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Name < keys[j].Name
+	})
+	return keys, nil
+}
+
+// flushUsage writes the last used time of keys used since the previous flush to the secret.
+func (s *APIKeyStore) flushUsage(ctx context.Context, client *AetoClient) error {
+	s.mu.Lock()
+	used := s.used
+	s.used = make(map[string]time.Time)
+	s.mu.Unlock()
+
+	if len(used) == 0 {
+		return nil
+	}
+
+	return s.update(ctx, client, func(keys map[string]APIKey) error {
+		for id, t := range used {
+			key, ok := keys[id]
+			if !ok {
+				continue
+			}
+			t := t
+			if key.LastUsedAt == nil || t.After(*key.LastUsedAt) {
+				key.LastUsedAt = &t
+				keys[id] = key
+			}
+		}
+		return nil
+	})
+}
+
+func hashAPIKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// apiKeyClient returns the client of the cluster storing api keys.
+func (s *Server) apiKeyClient() (*AetoClient, error) {
+	client := s.clusters[0].Client()
+	if client == nil {
+		return nil, fmt.Errorf("not yet connected to cluster %s", s.clusters[0].Name)
+	}
+	return client, nil
+}
+
+// apiKeyAuthenticator authenticates requests carrying an api key as a bearer token, or as the password of basic auth
+// for clients such as calendar apps that can not send bearer tokens.
+func apiKeyAuthenticator(s *Server) authenticator {
+	return func(req *http.Request) (*Identity, error) {
+		key := ""
+		if header := req.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer "+apiKeyPrefix) {
+			key = strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+		} else if _, password, ok := req.BasicAuth(); ok && strings.HasPrefix(password, apiKeyPrefix) {
+			key = password
+		}
+		if key == "" {
+			return nil, nil
+		}
+
+		client, err := s.apiKeyClient()
+		if err != nil {
+			return nil, fmt.Errorf("unable to verify api key, %s", err)
+		}
+		return s.apiKeys.Authenticate(req.Context(), client, key)
+	}
+}
+
+// watchAPIKeyUsage periodically records when api keys were last used.
+func (s *Server) watchAPIKeyUsage() {
+	for range time.Tick(apiKeyUsageInterval) {
+		client, err := s.apiKeyClient()
+		if err != nil {
+			continue
+		}
+		if err := s.apiKeys.flushUsage(context.Background(), client); err != nil {
+			log.Println("failed to record api key usage,", err)
+		}
+	}
+}
+
+// enforceReadOnly rejects requests modifying anything when made with a read-only api key. Resource and namespace
+// scopes are enforced where resources are accessed, see Server.access.
+func enforceReadOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		identity := identityFrom(req)
+		readOnly := req.Method == http.MethodGet || req.Method == http.MethodHead || req.Method == http.MethodOptions
+		if identity.Scopes != nil && identity.Scopes.ReadOnly && !readOnly {
+			writeError(w, 403, fmt.Sprintf("%s is a read-only api key", identity.Username))
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// apiKeyRequest mints an api key. The role defaults to viewer for read-only keys and operator otherwise, and may not be
+// above the role of the admin minting the key.
+type apiKeyRequest struct {
+	Name      string       `json:"name"`
+	Role      string       `json:"role,omitempty"`
+	ExpiresAt *time.Time   `json:"expiresAt,omitempty"`
+	Scopes    APIKeyScopes `json:"scopes"`
+}
+
+func addAPIKeyRoutes(s *Server, router chi.Router) {
+	if !s.Config().Auth.APIKeys.Enabled {
+		return
+	}
+
+	router.Route("/apikeys", func(r chi.Router) {
+		r.Use(authorize(s, PermissionManageAPIKeys))
+
+		r.Get("/", func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+
+			client, err := s.apiKeyClient()
+			if err != nil {
+				writeError(w, 503, err.Error())
+				return
+			}
+
+			keys, err := s.apiKeys.List(req.Context(), client)
+			if hasErr(w, err) {
+				return
+			}
+
+			data, err := json.Marshal(keys)
+			if hasErr(w, err) {
+				return
+			}
+
+			w.Write(data)
+		})
+
+		r.Post("/", func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+
+			body := apiKeyRequest{}
+			if !decodeJSON(w, req, &body) {
+				return
+			}
+			if problem := validateAPIKeyRequest(&body, s.roleOf(identityFrom(req))); problem != "" {
+				writeError(w, 400, problem)
+				return
+			}
+
+			client, err := s.apiKeyClient()
+			if err != nil {
+				writeError(w, 503, err.Error())
+				return
+			}
+
+			key, token, err := s.apiKeys.Create(req.Context(), client, APIKey{
+				Name:      body.Name,
+				Role:      body.Role,
+				Scopes:    body.Scopes,
+				CreatedBy: identityFrom(req).Username,
+				ExpiresAt: body.ExpiresAt,
+			})
+			if hasErr(w, err) {
+				return
+			}
+			auditRecordFrom(req).Target.Name = key.Name
+			auditDetail(req, "id", key.ID)
+			auditDetail(req, "role", key.Role)
+			log.Println("api key", key.Name, "minted by", key.CreatedBy)
+
+			data, err := json.Marshal(struct {
+				APIKey
+				Token string `json:"token"`
+			}{
+				APIKey: key,
+				Token:  token,
+			})
+			if hasErr(w, err) {
+				return
+			}
+
+			w.WriteHeader(201)
+			w.Write(data)
+		})
+
+		r.Delete("/{id}", func(w http.ResponseWriter, req *http.Request) {
+			client, err := s.apiKeyClient()
+			if err != nil {
+				writeError(w, 503, err.Error())
+				return
+			}
+
+			id := chi.URLParam(req, "id")
+			auditRecordFrom(req).Target.Name = id
+			if hasErr(w, s.apiKeys.Revoke(req.Context(), client, id)) {
+				return
+			}
+			log.Println("api key", id, "revoked by", identityFrom(req).Username)
+
+			w.WriteHeader(204)
+		})
+	})
+}
+
+// validateAPIKeyRequest checks the request, defaulting its role, and returns the first problem found.
+func validateAPIKeyRequest(body *apiKeyRequest, minterRole string) string {
+	if !clusterNameExpr.MatchString(body.Name) {
+		return fmt.Sprintf("name: %q must consist of lower case alphanumeric characters or '-'", body.Name)
+	}
+	if body.Role == "" {
+		body.Role = APIKey{Scopes: body.Scopes}.role()
+	}
+	if roleRank(body.Role) == 0 {
+		return fmt.Sprintf("role: unknown role %q, must be one of [%s]", body.Role, strings.Join(roles, ", "))
+	}
+	if roleRank(body.Role) > roleRank(minterRole) {
+		return fmt.Sprintf("role: %s is above the role of the minting user, %s", body.Role, minterRole)
+	}
+	if body.ExpiresAt != nil && body.ExpiresAt.Before(time.Now()) {
+		return "expiresAt: must be in the future"
+	}
+	for _, resource := range body.Scopes.Resources {
+		known := false
+		for _, r := range apiResources {
+			known = known || r.Name == resource
+		}
+		if !known {
+			return fmt.Sprintf("scopes.resources: unknown resource %q", resource)
+		}
+	}
+	return ""
+}
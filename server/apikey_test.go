@@ -0,0 +1,70 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateAPIKeyRequest(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   apiKeyRequest
+		minter string
+		role   string
+		err    string
+	}{
+		{name: "read-only default", body: apiKeyRequest{Name: "ci", Scopes: APIKeyScopes{ReadOnly: true}}, minter: RoleAdmin, role: RoleViewer},
+		{name: "default", body: apiKeyRequest{Name: "ci"}, minter: RoleAdmin, role: RoleOperator},
+		{name: "explicit role", body: apiKeyRequest{Name: "ci", Role: RoleAdmin}, minter: RoleAdmin, role: RoleAdmin},
+		{name: "read-only with a role", body: apiKeyRequest{Name: "ci", Role: RoleAdmin, Scopes: APIKeyScopes{ReadOnly: true}}, minter: RoleAdmin, role: RoleAdmin},
+		{name: "above the minter", body: apiKeyRequest{Name: "ci", Role: RoleAdmin}, minter: RoleOperator, err: "above the role of the minting user"},
+		{name: "default above the minter", body: apiKeyRequest{Name: "ci"}, minter: RoleViewer, err: "above the role of the minting user"},
+		{name: "unknown role", body: apiKeyRequest{Name: "ci", Role: "owner"}, minter: RoleAdmin, err: "unknown role"},
+		{name: "invalid name", body: apiKeyRequest{Name: "CI"}, minter: RoleAdmin, err: "name:"},
+		{name: "unknown resource", body: apiKeyRequest{Name: "ci", Scopes: APIKeyScopes{Resources: []string{"pods"}}}, minter: RoleAdmin, err: "unknown resource"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := tt.body
+			problem := validateAPIKeyRequest(&body, tt.minter)
+			if tt.err != "" {
+				if !strings.Contains(problem, tt.err) {
+					t.Errorf("got problem %q, expected it to contain %q", problem, tt.err)
+				}
+				return
+			}
+			if problem != "" {
+				t.Fatalf("unexpected problem %s", problem)
+			}
+			if body.Role != tt.role {
+				t.Errorf("got role %s, expected %s", body.Role, tt.role)
+			}
+		})
+	}
+}
+
+func TestAPIKeyRole(t *testing.T) {
+	config := DefaultConfig()
+	s := &Server{}
+	s.config.Store(&config)
+
+	tests := []struct {
+		name string
+		key  APIKey
+		want string
+	}{
+		{name: "minted with a role", key: APIKey{Role: RoleAdmin}, want: RoleAdmin},
+		{name: "read-only, minted without a role", key: APIKey{Scopes: APIKeyScopes{ReadOnly: true}}, want: RoleViewer},
+		{name: "minted without a role", key: APIKey{}, want: RoleOperator},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			identity := &Identity{Method: AuthMethodAPIKey, Scopes: &tt.key.Scopes, Role: tt.key.role()}
+			if got := s.roleOf(identity); got != tt.want {
+				t.Errorf("got role %s, expected %s", got, tt.want)
+			}
+		})
+	}
+}
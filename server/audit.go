@@ -0,0 +1,362 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/middleware"
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	auditContextKey contextKey = "audit"
+
+	AuditOutputStdout = "stdout"
+	AuditOutputFile   = "file"
+
+	AuditOutcomeSuccess = "success"
+	AuditOutcomeDenied  = "denied"
+	AuditOutcomeFailure = "failure"
+)
+
+// AuditRecord describes who did what, when, to which resource and with what outcome.
+type AuditRecord struct {
+	Time       time.Time         `json:"time"`
+	RequestID  string            `json:"requestID,omitempty"`
+	User       string            `json:"user"`
+	Groups     []string          `json:"groups,omitempty"`
+	AuthMethod string            `json:"authMethod"`
+	RemoteAddr string            `json:"remoteAddr,omitempty"`
+	Action     string            `json:"action"`
+	Mutation   bool              `json:"mutation"`
+	Target     AuditTarget       `json:"target"`
+	Status     int               `json:"status,omitempty"`
+	Outcome    string            `json:"outcome"`
+	Details    map[string]string `json:"details,omitempty"`
+}
+
+type AuditTarget struct {
+	Cluster   string `json:"cluster,omitempty"`
+	Resource  string `json:"resource,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name,omitempty"`
+}
+
+// AuditLog writes audit records as JSON lines and keeps the most recent records in memory to answer queries.
+type AuditLog struct {
+	mu      sync.Mutex
+	out     io.Writer
+	retain  int
+	records []AuditRecord
+}
+
+func NewAuditLog(config AuditConfig) (*AuditLog, error) {
+	a := &AuditLog{
+		retain:  config.Retain,
+		records: make([]AuditRecord, 0),
+	}
+	if !config.Enabled {
+		return a, nil
+	}
+
+	switch config.Output {
+	case AuditOutputStdout:
+		a.out = os.Stdout
+	case AuditOutputFile:
+		f, err := newRotatingFile(config.File.Path, int64(config.File.MaxSize)*1024*1024, config.File.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		a.out = f
+	}
+	return a, nil
+}
+
+func (a *AuditLog) Record(record AuditRecord) {
+	if a.out == nil {
+		return
+	}
+	if record.Time.IsZero() {
+		record.Time = time.Now().UTC()
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		log.Println("failed to marshal audit record,", err)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, err := a.out.Write(append(data, '\n')); err != nil {
+		log.Println("failed to write audit record,", err)
+	}
+
+	a.records = append(a.records, record)
+	if n := len(a.records); n > a.retain {
+		a.records = a.records[n-a.retain:]
+	}
+}
+
+// AuditQuery selects records kept in memory. Empty fields match every record.
+type AuditQuery struct {
+	User      string
+	Action    string
+	Resource  string
+	Namespace string
+	Name      string
+	Outcome   string
+	Mutation  *bool
+	Since     time.Time
+	Limit     int
+}
+
+// Query returns the most recent records matching the query, newest first.
+func (a *AuditLog) Query(q AuditQuery) []AuditRecord {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	result := make([]AuditRecord, 0)
+	for i := len(a.records) - 1; i >= 0 && (q.Limit <= 0 || len(result) < q.Limit); i-- {
+		r := a.records[i]
+		if (q.User != "" && r.User != q.User) ||
+			(q.Action != "" && !strings.Contains(r.Action, q.Action)) ||
+			(q.Resource != "" && r.Target.Resource != q.Resource) ||
+			(q.Namespace != "" && r.Target.Namespace != q.Namespace) ||
+			(q.Name != "" && r.Target.Name != q.Name) ||
+			(q.Outcome != "" && r.Outcome != q.Outcome) ||
+			(q.Mutation != nil && r.Mutation != *q.Mutation) ||
+			r.Time.Before(q.Since) {
+			continue
+		}
+		result = append(result, r)
+	}
+	return result
+}
+
+// auditRecordFrom returns the audit record of a request so that handlers may add to its target and details. A
+// detached record is returned for requests that are not audited.
+func auditRecordFrom(req *http.Request) *AuditRecord {
+	if record, ok := req.Context().Value(auditContextKey).(*AuditRecord); ok {
+		return record
+	}
+	return &AuditRecord{}
+}
+
+// auditDetail adds a detail to the audit record of a request.
+func auditDetail(req *http.Request, key, value string) {
+	record := auditRecordFrom(req)
+	if record.Details == nil {
+		record.Details = make(map[string]string)
+	}
+	record.Details[key] = value
+}
+
+// audit records every request after it has been served. The target is taken from the url parameters of the matched
+// route unless set by the handler.
+func audit(s *Server) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			identity := identityFrom(req)
+			record := &AuditRecord{
+				Time:       time.Now().UTC(),
+				RequestID:  middleware.GetReqID(req.Context()),
+				User:       identity.Username,
+				Groups:     identity.Groups,
+				AuthMethod: identity.Method,
+				RemoteAddr: req.RemoteAddr,
+				Mutation:   req.Method != http.MethodGet && req.Method != http.MethodHead && req.Method != http.MethodOptions,
+			}
+
+			ww := middleware.NewWrapResponseWriter(w, req.ProtoMajor)
+			next.ServeHTTP(ww, req.WithContext(context.WithValue(req.Context(), auditContextKey, record)))
+
+			pattern := req.URL.Path
+			if rctx := chi.RouteContext(req.Context()); rctx != nil {
+				// Routes rejected by middleware before routing completed only have a partial pattern ending with *
+				if p := rctx.RoutePattern(); p != "" && !strings.HasSuffix(p, "*") {
+					pattern = p
+				}
+				setDefault(&record.Target.Cluster, rctx.URLParam("cluster"))
+				setDefault(&record.Target.Namespace, rctx.URLParam("namespace"))
+				setDefault(&record.Target.Name, rctx.URLParam("name"))
+			}
+			setDefault(&record.Target.Resource, auditResource(pattern))
+			record.Action = req.Method + " " + pattern
+
+			record.Status = ww.Status()
+			if record.Status == 0 {
+				record.Status = 200
+			}
+			record.Outcome = auditOutcome(record.Status)
+
+			s.audit.Record(*record)
+		})
+	}
+}
+
+func loginAuditRecord(req *http.Request, identity *Identity, outcome string) AuditRecord {
+	return AuditRecord{
+		RequestID:  middleware.GetReqID(req.Context()),
+		User:       identity.Username,
+		Groups:     identity.Groups,
+		AuthMethod: AuthMethodSession,
+		RemoteAddr: req.RemoteAddr,
+		Action:     "login",
+		Outcome:    outcome,
+	}
+}
+
+func setDefault(field *string, value string) {
+	if *field == "" {
+		*field = value
+	}
+}
+
+// auditResource returns the resource of an api route pattern, ie tenants for /api/clusters/{cluster}/tenants/{namespace}/{name}.
+func auditResource(pattern string) string {
+	segments := strings.Split(strings.Trim(strings.TrimPrefix(pattern, "/api"), "/"), "/")
+	if len(segments) >= 3 && segments[0] == "clusters" {
+		segments = segments[2:]
+	}
+	if len(segments) >= 2 && segments[0] == "aggregate" {
+		segments = segments[1:]
+	}
+	if len(segments) == 0 {
+		return ""
+	}
+	return segments[0]
+}
+
+func auditOutcome(status int) string {
+	switch {
+	case status == 401 || status == 403:
+		return AuditOutcomeDenied
+	case status >= 400:
+		return AuditOutcomeFailure
+	}
+	return AuditOutcomeSuccess
+}
+
+func addAuditRoutes(s *Server, router chi.Router) {
+	router.With(authorize(s, PermissionReadAudit)).Get("/audit", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		query := req.URL.Query()
+
+		q := AuditQuery{
+			User:      query.Get("user"),
+			Action:    query.Get("action"),
+			Resource:  query.Get("resource"),
+			Namespace: query.Get("namespace"),
+			Name:      query.Get("name"),
+			Outcome:   query.Get("outcome"),
+			Limit:     100,
+		}
+		if v := query.Get("mutation"); v != "" {
+			mutation, err := strconv.ParseBool(v)
+			if err != nil {
+				writeError(w, 400, fmt.Sprintf("mutation: %q is not a boolean", v))
+				return
+			}
+			q.Mutation = &mutation
+		}
+		if v := query.Get("since"); v != "" {
+			since, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				writeError(w, 400, fmt.Sprintf("since: %q is not an RFC3339 timestamp", v))
+				return
+			}
+			q.Since = since
+		}
+		if v := query.Get("limit"); v != "" {
+			limit, err := strconv.Atoi(v)
+			if err != nil || limit < 1 {
+				writeError(w, 400, fmt.Sprintf("limit: %q is not a positive number", v))
+				return
+			}
+			q.Limit = limit
+		}
+
+		data, err := json.Marshal(s.audit.Query(q))
+		if hasErr(w, err) {
+			return
+		}
+
+		w.Write(data)
+	})
+}
+
+// rotatingFile is a file that is rotated when it grows beyond maxSize bytes, keeping at most maxBackups rotated files
+// named <path>.1 (the most recent) to <path>.<maxBackups>.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func newRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	f := &rotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	return f, f.open()
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	if f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+
+	os.Remove(fmt.Sprintf("%s.%d", f.path, f.maxBackups))
+	for i := f.maxBackups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+	}
+	if f.maxBackups > 0 {
+		if err := os.Rename(f.path, f.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(f.path); err != nil {
+		return err
+	}
+
+	return f.open()
+}
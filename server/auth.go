@@ -0,0 +1,110 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	identityContextKey contextKey = "identity"
+)
+
+// Identity is the authenticated user, or service, making a request.
+type Identity struct {
+	Username string   `json:"username"`
+	Groups   []string `json:"groups"`
+	Method   string   `json:"method"`
+	// Scopes limits what an identity authenticated with an api key may do
+	Scopes *APIKeyScopes `json:"scopes,omitempty"`
+	// Role is the role of an api key, given when the key was minted
+	Role string `json:"role,omitempty"`
+}
+
+const (
+	AuthMethodAnonymous = "anonymous"
+	AuthMethodSession   = "session"
+	AuthMethodToken     = "token"
+	AuthMethodAPIKey    = "apikey"
+)
+
+var anonymous = &Identity{
+	Username: "anonymous",
+	Groups:   []string{},
+	Method:   AuthMethodAnonymous,
+}
+
+func identityFrom(req *http.Request) *Identity {
+	if identity, ok := req.Context().Value(identityContextKey).(*Identity); ok {
+		return identity
+	}
+	return anonymous
+}
+
+func withIdentity(req *http.Request, identity *Identity) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), identityContextKey, identity))
+}
+
+// authenticator returns the identity of a request, or nil when the request does not carry any credentials it knows
+// about. An error is returned when credentials are present but invalid.
+type authenticator func(req *http.Request) (*Identity, error)
+
+// authenticate requires every request to be authenticated by one of the authenticators of the server. Unauthenticated
+// api requests are answered with 401 while other requests are redirected to the login page, unless auth mode is none
+// in which case they are anonymous.
+func authenticate(s *Server) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			for _, authenticate := range s.authenticators {
+				identity, err := authenticate(req)
+				if err != nil {
+					unauthorized(w, req, err.Error())
+					return
+				}
+				if identity != nil {
+					logIdentity(req, identity)
+					next.ServeHTTP(w, withIdentity(req, identity))
+					return
+				}
+			}
+
+			// Without a login every request not carrying credentials is anonymous
+			if s.Config().Auth.Mode == AuthModeNone {
+				next.ServeHTTP(w, req)
+				return
+			}
+
+			// Api clients and metric scrapers can not follow a login
+			if strings.HasPrefix(req.URL.Path, "/api/") || req.URL.Path == metricsPath {
+				unauthorized(w, req, "authentication required")
+				return
+			}
+			http.Redirect(w, req, oidcLoginPath+"?redirect="+url.QueryEscape(req.URL.RequestURI()), http.StatusFound)
+		})
+	}
+}
+
+// unauthorized answers with 401. Calendar apps only prompt for credentials when challenged for basic auth, with an api
+// key as the password.
+func unauthorized(w http.ResponseWriter, req *http.Request, message string) {
+	if strings.HasSuffix(req.URL.Path, ".ics") {
+		w.Header().Set("WWW-Authenticate", `Basic realm="aeto-web"`)
+	}
+	writeError(w, 401, message)
+}
+
+// containsAny returns true when wanted is empty or when values contain any of the wanted values.
+func containsAny(values []string, wanted []string) bool {
+	if len(wanted) == 0 {
+		return true
+	}
+	for _, w := range wanted {
+		for _, v := range values {
+			if v == w {
+				return true
+			}
+		}
+	}
+	return false
+}
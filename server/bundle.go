@@ -0,0 +1,502 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/go-chi/chi/v5"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	k8syaml "k8s.io/apimachinery/pkg/util/yaml"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	maxBundleSize = 10 << 20
+
+	BundleFormatYAML = "yaml"
+	BundleFormatTar  = "tar"
+
+	ImportCreate    = "create"
+	ImportUpdate    = "update"
+	ImportUnchanged = "unchanged"
+	ImportFailed    = "failed"
+)
+
+// bundleKind is a resource included in bundles. Bundles are exported and imported in this order so that resource
+// templates and blueprints exist before the tenants using them.
+type bundleKind struct {
+	Resource string
+	Kind     string
+}
+
+var bundleKinds = []bundleKind{
+	{Resource: "resourcetemplates", Kind: "ResourceTemplate"},
+	{Resource: "blueprints", Kind: "Blueprint"},
+	{Resource: "tenants", Kind: "Tenant"},
+	{Resource: "savingspolicies", Kind: "SavingsPolicy"},
+	{Resource: "certificates", Kind: "Certificate"},
+	{Resource: "certificateconnectors", Kind: "CertificateConnector"},
+	{Resource: "hostedzones", Kind: "HostedZone"},
+}
+
+// serverMetadata lists the metadata fields populated by the api server, or by the operator, that are stripped from
+// exported resources.
+var serverMetadata = []string{
+	"uid",
+	"resourceVersion",
+	"generation",
+	"creationTimestamp",
+	"deletionTimestamp",
+	"deletionGracePeriodSeconds",
+	"managedFields",
+	"selfLink",
+	"ownerReferences",
+	"finalizers",
+}
+
+var serverAnnotations = []string{
+	"kubectl.kubernetes.io/last-applied-configuration",
+	reconcileAnnotation,
+}
+
+// cleanObject strips the status and server populated metadata of a resource, leaving what is needed to re-create it.
+func cleanObject(obj map[string]interface{}) {
+	delete(obj, "status")
+	metadata, ok := obj["metadata"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	for _, f := range serverMetadata {
+		delete(metadata, f)
+	}
+	if annotations, ok := metadata["annotations"].(map[string]interface{}); ok {
+		for _, a := range serverAnnotations {
+			delete(annotations, a)
+		}
+		if len(annotations) == 0 {
+			delete(metadata, "annotations")
+		}
+	}
+}
+
+// containsRedacted returns true when any value of the object has been redacted.
+func containsRedacted(v interface{}) bool {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for _, child := range value {
+			if containsRedacted(child) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, child := range value {
+			if containsRedacted(child) {
+				return true
+			}
+		}
+	case string:
+		return value == redactedValue || (secretDocumentExpr.MatchString(value) && strings.Contains(value, redactedValue))
+	}
+	return false
+}
+
+func objectMetadata(obj map[string]interface{}) (namespace, name string) {
+	metadata, _ := obj["metadata"].(map[string]interface{})
+	namespace, _ = metadata["namespace"].(string)
+	name, _ = metadata["name"].(string)
+	return namespace, name
+}
+
+// BundleObject is a resource read from a bundle, along with what importing it does.
+type BundleObject struct {
+	Resource  string          `json:"resource"`
+	Kind      string          `json:"kind"`
+	Namespace string          `json:"namespace"`
+	Name      string          `json:"name"`
+	Action    string          `json:"action"`
+	Diff      json.RawMessage `json:"diff,omitempty"`
+	Error     string          `json:"error,omitempty"`
+	object    map[string]interface{}
+	kind      bundleKind
+}
+
+type BundleImport struct {
+	DryRun  bool           `json:"dryRun"`
+	Applied bool           `json:"applied"`
+	Failed  int            `json:"failed"`
+	Objects []BundleObject `json:"objects"`
+}
+
+// readBundle reads the resources of a multi-document yaml or json bundle, or of a tar bundle of such files.
+func readBundle(body []byte, tarball bool) ([]map[string]interface{}, error) {
+	if !tarball {
+		return readDocuments(bytes.NewReader(body))
+	}
+
+	objects := make([]map[string]interface{}, 0)
+	tr := tar.NewReader(bytes.NewReader(body))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return objects, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		ext := path.Ext(header.Name)
+		if header.Typeflag != tar.TypeReg || (ext != ".yaml" && ext != ".yml" && ext != ".json") {
+			continue
+		}
+		docs, err := readDocuments(tr)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", header.Name, err)
+		}
+		objects = append(objects, docs...)
+	}
+}
+
+func readDocuments(r io.Reader) ([]map[string]interface{}, error) {
+	objects := make([]map[string]interface{}, 0)
+	decoder := k8syaml.NewYAMLOrJSONDecoder(r, 4096)
+	for {
+		obj := make(map[string]interface{})
+		if err := decoder.Decode(&obj); err == io.EOF {
+			return objects, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if len(obj) > 0 {
+			objects = append(objects, obj)
+		}
+	}
+}
+
+// importObject imports a single resource, creating it when missing and otherwise patching it to match the bundle. The
+// patch carries the resourceVersion the diff was made against so that concurrent changes are not overwritten.
+func (s *Server) importObject(req *http.Request, client *AetoClient, o *BundleObject, dryRun bool) error {
+	resource, _ := findResource(o.kind.Resource)
+	if !client.Serves(resource.GroupVersion) {
+		return fmt.Errorf("%s is not served by this cluster, api group %s is not installed", resource.Name, resource.GroupVersion)
+	}
+
+	reader, allowed, err := s.access(req, client, resource)
+	if err != nil {
+		return err
+	}
+	if !allowed(o.Namespace, o.Name) {
+		return fmt.Errorf("%s is not allowed to import %s %s/%s", identityFrom(req).Username, resource.Name, o.Namespace, o.Name)
+	}
+	writer, err := s.writer(req, client, resource, o.Namespace)
+	if err != nil {
+		return err
+	}
+
+	desired, err := json.Marshal(o.object)
+	if err != nil {
+		return err
+	}
+
+	gvr := resource.GroupVersion.WithResource(resource.Name)
+	current, err := resource.Get(reader, o.Namespace, o.Name)
+	if apierrors.IsNotFound(err) || errors.Is(err, errNotFound) {
+		o.Action = ImportCreate
+		o.Diff = desired
+		_, err = writer.CreateRaw(gvr, o.Namespace, desired, dryRun)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(current)
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]interface{})
+	if err := json.Unmarshal(data, &existing); err != nil {
+		return err
+	}
+	metadata := patchMetadata{}
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return err
+	}
+	cleanObject(existing)
+	// Cached resources do not carry their type
+	existing["apiVersion"], existing["kind"] = o.object["apiVersion"], o.object["kind"]
+	original, err := json.Marshal(existing)
+	if err != nil {
+		return err
+	}
+
+	diff, err := jsonpatch.CreateMergePatch(original, desired)
+	if err != nil {
+		return err
+	}
+	if string(diff) == "{}" {
+		o.Action = ImportUnchanged
+		return nil
+	}
+	o.Action = ImportUpdate
+	o.Diff = diff
+
+	patch := make(map[string]interface{})
+	if err := json.Unmarshal(diff, &patch); err != nil {
+		return err
+	}
+	m, _ := patch["metadata"].(map[string]interface{})
+	if m == nil {
+		m = make(map[string]interface{})
+		patch["metadata"] = m
+	}
+	m["resourceVersion"] = metadata.Metadata.ResourceVersion
+	body, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+
+	_, err = writer.PatchRaw(gvr, o.Namespace, o.Name, types.MergePatchType, body, dryRun)
+	return err
+}
+
+func addBundleRoutes(s *Server, r chi.Router, operatorNamespace string) {
+	// Exports resources as a multi-document yaml or as a tar with one file per resource, ?format=yaml|tar. Resources
+	// are limited with ?resources=tenants,blueprints and redacted unless revealed.
+	r.With(authorize(s, PermissionExportResources), throttle(s, RateLimitBucketDirect)).Get("/export", func(w http.ResponseWriter, req *http.Request) {
+		format := req.URL.Query().Get("format")
+		if format == "" {
+			format = BundleFormatYAML
+		}
+		if format != BundleFormatYAML && format != BundleFormatTar {
+			writeError(w, 400, fmt.Sprintf("format: %q is not supported, use %s or %s", format, BundleFormatYAML, BundleFormatTar))
+			return
+		}
+		selected := make(map[string]bool)
+		if v := req.URL.Query().Get("resources"); v != "" {
+			for _, r := range strings.Split(v, ",") {
+				selected[strings.TrimSpace(r)] = true
+			}
+		}
+
+		client := clusterFrom(req).Client()
+		reveal, _ := strconv.ParseBool(req.URL.Query().Get("reveal"))
+		redact := s.Config().Redaction.Enabled && !reveal
+
+		var yamlBundle bytes.Buffer
+		var tarBundle bytes.Buffer
+		tw := tar.NewWriter(&tarBundle)
+		now := time.Now().UTC()
+		exported := 0
+
+		for _, k := range bundleKinds {
+			if len(selected) > 0 && !selected[k.Resource] {
+				continue
+			}
+			resource, _ := findResource(k.Resource)
+			if !client.Serves(resource.GroupVersion) {
+				continue
+			}
+
+			reader, allowed, err := s.access(req, client, resource)
+			if hasErr(w, err) {
+				return
+			}
+			list, err := resource.List(reader, operatorNamespace, allowed)
+			if hasErr(w, err) {
+				return
+			}
+			data, err := json.Marshal(list)
+			if hasErr(w, err) {
+				return
+			}
+			items := struct {
+				Items []map[string]interface{} `json:"items"`
+			}{}
+			if hasErr(w, json.Unmarshal(data, &items)) {
+				return
+			}
+
+			for _, obj := range items.Items {
+				cleanObject(obj)
+				obj["apiVersion"] = resource.GroupVersion.String()
+				obj["kind"] = k.Kind
+				if redact {
+					s.redactor.Redact(resource.Name, obj)
+				}
+
+				doc, err := yaml.Marshal(obj)
+				if hasErr(w, err) {
+					return
+				}
+
+				namespace, name := objectMetadata(obj)
+				if format == BundleFormatTar {
+					err := tw.WriteHeader(&tar.Header{
+						Name:    path.Join(resource.Name, namespace, name+".yaml"),
+						Mode:    0644,
+						Size:    int64(len(doc)),
+						ModTime: now,
+					})
+					if hasErr(w, err) {
+						return
+					}
+					if _, err := tw.Write(doc); hasErr(w, err) {
+						return
+					}
+				} else {
+					yamlBundle.WriteString("---\n")
+					yamlBundle.Write(doc)
+				}
+				exported++
+			}
+		}
+		if hasErr(w, tw.Close()) {
+			return
+		}
+
+		auditDetail(req, "format", format)
+		auditDetail(req, "resources", strconv.Itoa(exported))
+		if redact {
+			auditDetail(req, "redacted", "true")
+		}
+		log.Println("exported", exported, "resources from", clusterFrom(req).Name, "for", identityFrom(req).Username)
+
+		filename := fmt.Sprintf("aeto-%s-%s.%s", clusterFrom(req).Name, now.Format("20060102T150405Z"), format)
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+		if format == BundleFormatTar {
+			w.Header().Set("Content-Type", "application/x-tar")
+			w.Write(tarBundle.Bytes())
+			return
+		}
+		w.Header().Set("Content-Type", "application/yaml")
+		w.Write(yamlBundle.Bytes())
+	})
+
+	// Imports a bundle exported from this or another cluster. Every resource is first diffed against the cluster and
+	// validated with a server-side dry-run, nothing is applied unless all of them pass. ?dryRun=true only returns the
+	// diff. Tar bundles are sent with the content type application/x-tar.
+	r.With(authorize(s, PermissionImportResources), throttle(s, RateLimitBucketDirect)).Post("/import", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxBundleSize))
+		if err != nil {
+			writeError(w, 400, fmt.Sprintf("invalid request body, %s", err))
+			return
+		}
+		mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		objects, err := readBundle(body, mediaType == "application/x-tar")
+		if err != nil {
+			writeError(w, 400, fmt.Sprintf("invalid bundle, %s", err))
+			return
+		}
+
+		result := BundleImport{
+			DryRun:  dryRun(req),
+			Objects: make([]BundleObject, 0, len(objects)),
+		}
+		for _, obj := range objects {
+			o := BundleObject{object: obj}
+			o.Namespace, o.Name = objectMetadata(obj)
+			o.Kind, _ = obj["kind"].(string)
+			apiVersion, _ := obj["apiVersion"].(string)
+			for _, k := range bundleKinds {
+				if resource, _ := findResource(k.Resource); k.Kind == o.Kind && resource.GroupVersion.String() == apiVersion {
+					o.kind = k
+					o.Resource = k.Resource
+				}
+			}
+			if metadata, ok := obj["metadata"].(map[string]interface{}); ok && o.Namespace == "" {
+				o.Namespace = operatorNamespace
+				metadata["namespace"] = operatorNamespace
+			}
+			cleanObject(obj)
+
+			switch {
+			case o.Resource == "":
+				o.Action, o.Error = ImportFailed, fmt.Sprintf("%s %s can not be imported", apiVersion, o.Kind)
+			case o.Name == "":
+				o.Action, o.Error = ImportFailed, "metadata.name must not be empty"
+			case containsRedacted(obj):
+				o.Action, o.Error = ImportFailed, "contains redacted values, export with ?reveal=true to import"
+			}
+			result.Objects = append(result.Objects, o)
+		}
+		order := func(o BundleObject) int {
+			for i, k := range bundleKinds {
+				if k.Resource == o.Resource {
+					return i
+				}
+			}
+			return len(bundleKinds)
+		}
+		sort.SliceStable(result.Objects, func(i, j int) bool {
+			return order(result.Objects[i]) < order(result.Objects[j])
+		})
+
+		client := clusterFrom(req).Client()
+		failed := 0
+		for i := range result.Objects {
+			o := &result.Objects[i]
+			if o.Action == ImportFailed {
+				failed++
+				continue
+			}
+			if err := s.importObject(req, client, o, true); err != nil {
+				o.Action, o.Error = ImportFailed, err.Error()
+				failed++
+			}
+		}
+
+		result.Failed = failed
+		auditDetail(req, "resources", strconv.Itoa(len(result.Objects)))
+		if result.DryRun || failed > 0 {
+			if result.DryRun {
+				auditDetail(req, "dryRun", "true")
+			} else {
+				auditDetail(req, "failed", strconv.Itoa(failed))
+			}
+			data, err := json.Marshal(result)
+			if hasErr(w, err) {
+				return
+			}
+			if !result.DryRun {
+				w.WriteHeader(422)
+			}
+			w.Write(data)
+			return
+		}
+
+		for i := range result.Objects {
+			o := &result.Objects[i]
+			if o.Action == ImportUnchanged {
+				continue
+			}
+			if err := s.importObject(req, client, o, false); err != nil {
+				o.Action, o.Error = ImportFailed, err.Error()
+				result.Failed++
+			}
+		}
+		result.Applied = true
+		auditDetail(req, "failed", strconv.Itoa(result.Failed))
+		log.Println("imported", len(result.Objects)-result.Failed, "of", len(result.Objects), "resources to", clusterFrom(req).Name, "by", identityFrom(req).Username)
+
+		data, err := json.Marshal(result)
+		if hasErr(w, err) {
+			return
+		}
+		w.Write(data)
+	})
+}
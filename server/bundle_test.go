@@ -0,0 +1,33 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestImportObjectScopes(t *testing.T) {
+	config := DefaultConfig()
+	s := &Server{}
+	s.config.Store(&config)
+	client := &AetoClient{capabilities: newCapabilities()}
+
+	identity := &Identity{
+		Username: "apikey:ci",
+		Method:   AuthMethodAPIKey,
+		Scopes:   &APIKeyScopes{Namespaces: []string{"team-a"}},
+		Role:     RoleOperator,
+	}
+	req := withIdentity(httptest.NewRequest(http.MethodPost, "/api/import", nil), identity)
+
+	// The tenant does not exist, the import is rejected before it is looked up or created
+	o := &BundleObject{kind: bundleKinds[2], Namespace: "team-b", Name: "t1"}
+	err := s.importObject(req, client, o, true)
+	if err == nil || !strings.Contains(err.Error(), "not allowed to import tenants team-b/t1") {
+		t.Errorf("got error %v, expected the import to be rejected", err)
+	}
+	if o.Action != "" {
+		t.Errorf("got action %q, expected none", o.Action)
+	}
+}
@@ -4,33 +4,41 @@ import (
 	"fmt"
 	"reflect"
 	"sort"
+	"sync"
 	"time"
 
 	corev1alpha1 "github.com/kristofferahl/aeto/apis/core/v1alpha1"
 	"k8s.io/apimachinery/pkg/types"
 )
 
-var (
-	cache = &InMemoryCache{
-		changestream: &ChangeStream{
-			recordAfter: time.Now().UTC().Add(1 * time.Minute),
-			maxEvents:   10,
-			events:      make([]CacheEvent, 0),
-		},
+func NewInMemoryCache(cluster string) *InMemoryCache {
+	changestream := &ChangeStream{
+		cluster:     cluster,
+		recordAfter: time.Now().UTC().Add(1 * time.Minute),
+		enabled:     true,
+		maxEvents:   10,
+		events:      make([]CacheEvent, 0),
+	}
+	return &InMemoryCache{
+		changestream: changestream,
 		tenant: &Cache[corev1alpha1.Tenant]{
-			data: make(map[string]CacheEntry[corev1alpha1.Tenant]),
+			changestream: changestream,
+			data:         make(map[string]CacheEntry[corev1alpha1.Tenant]),
 		},
 		blueprint: &Cache[corev1alpha1.Blueprint]{
-			data: make(map[string]CacheEntry[corev1alpha1.Blueprint]),
+			changestream: changestream,
+			data:         make(map[string]CacheEntry[corev1alpha1.Blueprint]),
 		},
 		resourceSets: &Cache[corev1alpha1.ResourceSet]{
-			data: make(map[string]CacheEntry[corev1alpha1.ResourceSet]),
+			changestream: changestream,
+			data:         make(map[string]CacheEntry[corev1alpha1.ResourceSet]),
 		},
 		resourceTemplates: &Cache[corev1alpha1.ResourceTemplate]{
-			data: make(map[string]CacheEntry[corev1alpha1.ResourceTemplate]),
+			changestream: changestream,
+			data:         make(map[string]CacheEntry[corev1alpha1.ResourceTemplate]),
 		},
 	}
-)
+}
 
 type InMemoryCache struct {
 	changestream      *ChangeStream
@@ -40,34 +48,102 @@ type InMemoryCache struct {
 	resourceTemplates ResourceCache[corev1alpha1.ResourceTemplate]
 }
 
+// Reset removes all cached resources without recording any changes. Changes are not recorded for a minute after a
+// reset, allowing watches to repopulate the cache.
+func (c *InMemoryCache) Reset() {
+	c.changestream.mu.Lock()
+	c.changestream.recordAfter = time.Now().UTC().Add(1 * time.Minute)
+	c.changestream.mu.Unlock()
+
+	c.tenant.Reset()
+	c.blueprint.Reset()
+	c.resourceSets.Reset()
+	c.resourceTemplates.Reset()
+}
+
 type ChangeStream struct {
+	mu          sync.Mutex
+	cluster     string
 	recordAfter time.Time
+	enabled     bool
 	maxEvents   int
+	maxAge      time.Duration
 	events      []CacheEvent
+	subscribers map[chan CacheEvent]struct{}
+}
+
+func (s *ChangeStream) Configure(config Config) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.enabled = config.Features.ChangeStream
+	s.maxEvents = config.Retention.Changes
+	s.maxAge = config.Retention.MaxAge.Duration
+	s.prune(time.Now().UTC())
 }
 
 func (s *ChangeStream) AddEvent(e CacheEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	now := time.Now().UTC()
-	if now.After(s.recordAfter) {
-		e.time = now
-		e.Timestamp = e.time.Format(time.RFC3339)
-		s.events = append(s.events, e)
-		if len(s.events) > s.maxEvents {
-			s.events = s.events[len(s.events)-s.maxEvents:] // Remove older events
+	e.time = now
+	e.Cluster = s.cluster
+	e.Timestamp = e.time.Format(time.RFC3339)
+	for ch := range s.subscribers {
+		select {
+		case ch <- e:
+		default:
 		}
 	}
+	if s.enabled && now.After(s.recordAfter) {
+		s.events = append(s.events, e)
+		s.prune(now)
+	}
+}
+
+// Subscribe returns a channel receiving every change to the cache, whether recorded or not, until cancel is called.
+// Changes are dropped when the subscriber falls behind.
+func (s *ChangeStream) Subscribe() (<-chan CacheEvent, func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.subscribers == nil {
+		s.subscribers = make(map[chan CacheEvent]struct{})
+	}
+	ch := make(chan CacheEvent, 16)
+	s.subscribers[ch] = struct{}{}
+	return ch, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.subscribers, ch)
+	}
 }
 
 func (s *ChangeStream) TakeLast(n int) []CacheEvent {
-	changes := cache.changestream
-	sort.Slice(changes.events, func(i, j int) bool {
-		return changes.events[i].time.Before(changes.events[j].time)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune(time.Now().UTC())
+	sort.Slice(s.events, func(i, j int) bool {
+		return s.events[i].time.Before(s.events[j].time)
 	})
-	ne := len(changes.events)
+	ne := len(s.events)
 	if n > ne {
 		n = ne
 	}
-	return changes.events[ne-n:]
+	events := make([]CacheEvent, n)
+	copy(events, s.events[ne-n:])
+	return events
+}
+
+func (s *ChangeStream) prune(now time.Time) {
+	if len(s.events) > s.maxEvents {
+		s.events = s.events[len(s.events)-s.maxEvents:] // Remove older events
+	}
+	if s.maxAge > 0 {
+		i := 0
+		for i < len(s.events) && now.Sub(s.events[i].time) > s.maxAge {
+			i++
+		}
+		s.events = s.events[i:]
+	}
 }
 
 type ResourceCache[T CacheableEntry] interface {
@@ -75,6 +151,7 @@ type ResourceCache[T CacheableEntry] interface {
 	Update(id types.UID, newVersion string, obj T)
 	Delete(id types.UID)
 	Items(filters ...func(i T) bool) []T
+	Reset()
 }
 
 type CacheableEntry interface {
@@ -82,7 +159,9 @@ type CacheableEntry interface {
 }
 
 type Cache[T CacheableEntry] struct {
-	data map[string]CacheEntry[T]
+	mu           sync.RWMutex
+	changestream *ChangeStream
+	data         map[string]CacheEntry[T]
 }
 
 type CacheEntry[T CacheableEntry] struct {
@@ -91,6 +170,7 @@ type CacheEntry[T CacheableEntry] struct {
 }
 
 type CacheEvent struct {
+	Cluster   string `json:"cluster"`
 	Type      string `json:"type"`
 	Resource  string `json:"resource"`
 	Change    string `json:"change"`
@@ -98,32 +178,36 @@ type CacheEvent struct {
 	Timestamp string `json:"ts"`
 }
 
-func (s Cache[T]) Add(id types.UID, version string, obj T) {
+func (s *Cache[T]) Add(id types.UID, version string, obj T) {
 	if id == "" {
 		panic(fmt.Errorf("id must not be empty"))
 	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.data[string(id)] = CacheEntry[T]{
 		Version:  version,
 		Resource: obj,
 	}
-	cache.changestream.AddEvent(CacheEvent{
+	s.changestream.AddEvent(CacheEvent{
 		Change:   "Added",
 		Type:     reflect.TypeOf(obj).Name(),
 		Resource: obj.NamespacedName().String(),
 	})
 }
 
-func (s Cache[T]) Update(id types.UID, newVersion string, obj T) {
+func (s *Cache[T]) Update(id types.UID, newVersion string, obj T) {
 	if id == "" {
 		panic(fmt.Errorf("id must not be empty"))
 	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	oldObj := s.data[string(id)]
 	if oldObj.Version != newVersion {
 		s.data[string(id)] = CacheEntry[T]{
 			Version:  newVersion,
 			Resource: obj,
 		}
-		cache.changestream.AddEvent(CacheEvent{
+		s.changestream.AddEvent(CacheEvent{
 			Change:   "Updated",
 			Type:     reflect.TypeOf(obj).Name(),
 			Resource: obj.NamespacedName().String(),
@@ -131,32 +215,49 @@ func (s Cache[T]) Update(id types.UID, newVersion string, obj T) {
 	}
 }
 
-func (s Cache[T]) Delete(id types.UID) {
+func (s *Cache[T]) Delete(id types.UID) {
 	if id == "" {
 		panic(fmt.Errorf("id must not be empty"))
 	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	obj := s.data[string(id)]
 	delete(s.data, string(id))
-	cache.changestream.AddEvent(CacheEvent{
+	s.changestream.AddEvent(CacheEvent{
 		Change:   "Deleted",
-		Type:     reflect.TypeOf(obj).Name(),
+		Type:     reflect.TypeOf(obj.Resource).Name(),
 		Resource: obj.Resource.NamespacedName().String(),
 	})
 }
 
-func (s Cache[T]) Items(filters ...func(i T) bool) []T {
-	r := make([]T, 0)
+// Items returns the cached resources matching every filter. Filters run after the lock is released as they may block,
+// ie on access reviews.
+func (s *Cache[T]) Items(filters ...func(i T) bool) []T {
+	s.mu.RLock()
+	items := make([]T, 0, len(s.data))
 	for _, v := range s.data {
+		items = append(items, v.Resource)
+	}
+	s.mu.RUnlock()
+
+	r := make([]T, 0)
+	for _, i := range items {
 		match := true
 		for _, f := range filters {
-			if !f(v.Resource) {
+			if !f(i) {
 				match = false
 				break
 			}
 		}
 		if match {
-			r = append(r, v.Resource)
+			r = append(r, i)
 		}
 	}
 	return r
 }
+
+func (s *Cache[T]) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data = make(map[string]CacheEntry[T])
+}
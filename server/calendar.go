@@ -0,0 +1,438 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	// Time zones of schedule entries are resolved without relying on the zoneinfo of the host
+	_ "time/tzdata"
+
+	"github.com/go-chi/chi/v5"
+	sustainabilityv1alpha1 "github.com/kristofferahl/aeto/apis/sustainability/v1alpha1"
+)
+
+const (
+	TransitionSuspend = "suspend"
+	TransitionResume  = "resume"
+
+	scheduleDefaultTransitions = 10
+	scheduleMaxTransitions     = 100
+	scheduleMaxHorizon         = 366 * 24 * time.Hour
+	calendarDefaultDays        = 14
+	calendarMaxDays            = 90
+	calendarPastDays           = 7
+	overrideEntry              = "override"
+)
+
+// scheduleEntryPattern matches schedule entries the way the operator does, ie MON-FRI 08:00-18:00 Europe/Stockholm
+var scheduleEntryPattern = regexp.MustCompile(`^([a-zA-Z]{3})-([a-zA-Z]{3}) (\d\d):(\d\d)-(\d\d):(\d\d) (?P<tz>[a-zA-Z/_]+)$`)
+
+var scheduleWeekdays = []string{"MON", "TUE", "WED", "THU", "FRI", "SAT", "SUN"}
+
+// SavingsScheduleEntry is an entry of the schedule of a savings policy, suspending the policy on the days from a time
+// to a time in its time zone. Like the operator, the last minute is included and entries ending before they start
+// never suspend the policy.
+type SavingsScheduleEntry struct {
+	Entry    string   `json:"entry"`
+	Days     []string `json:"days,omitempty"`
+	From     string   `json:"from,omitempty"`
+	To       string   `json:"to,omitempty"`
+	TimeZone string   `json:"timeZone,omitempty"`
+	Error    string   `json:"error,omitempty"`
+
+	days     map[time.Weekday]bool
+	from, to int
+	location *time.Location
+}
+
+// SavingsTransition is a change of the state of a savings policy, caused by the schedule entries or the override.
+type SavingsTransition struct {
+	At         time.Time `json:"at"`
+	Transition string    `json:"transition"`
+	Entries    []string  `json:"entries"`
+}
+
+// SavingsPolicySchedule is the state of a savings policy evaluated from its schedule and override, along with the
+// upcoming transitions. Suspended is the evaluated state while the override holds the state reported by the operator.
+type SavingsPolicySchedule struct {
+	Namespace   string                 `json:"namespace"`
+	Name        string                 `json:"name"`
+	EvaluatedAt time.Time              `json:"evaluatedAt"`
+	Suspended   bool                   `json:"suspended"`
+	Override    SavingsPolicyOverride  `json:"override"`
+	Entries     []SavingsScheduleEntry `json:"entries"`
+	Transitions []SavingsTransition    `json:"transitions"`
+}
+
+// savingsInterval is a period a savings policy is suspended.
+type savingsInterval struct {
+	from, to time.Time
+	entries  []string
+}
+
+func parseScheduleEntry(entry string) SavingsScheduleEntry {
+	e := SavingsScheduleEntry{Entry: entry}
+	match := scheduleEntryPattern.FindStringSubmatch(entry)
+	if match == nil {
+		e.Error = "does not match DDD-DDD HH:MM-HH:MM Time/Zone"
+		return e
+	}
+
+	first := indexOf(scheduleWeekdays, strings.ToUpper(match[1]))
+	last := indexOf(scheduleWeekdays, strings.ToUpper(match[2]))
+	if first == -1 || last == -1 {
+		e.Error = fmt.Sprintf("days must be one of %s", strings.Join(scheduleWeekdays, ", "))
+		return e
+	}
+	e.days = make(map[time.Weekday]bool)
+	for i := first; ; i = (i + 1) % 7 {
+		e.Days = append(e.Days, scheduleWeekdays[i])
+		// Weekdays start on monday, time.Weekday on sunday
+		e.days[time.Weekday((i+1)%7)] = true
+		if i == last {
+			break
+		}
+	}
+
+	minutes := func(h, m string) int {
+		hour, _ := strconv.Atoi(h)
+		minute, _ := strconv.Atoi(m)
+		if hour > 23 || minute > 59 {
+			return -1
+		}
+		return hour*60 + minute
+	}
+	e.From, e.To = match[3]+":"+match[4], match[5]+":"+match[6]
+	if e.from, e.to = minutes(match[3], match[4]), minutes(match[5], match[6]); e.from == -1 || e.to == -1 {
+		e.Error = "times must be between 00:00 and 23:59"
+		return e
+	}
+
+	var err error
+	e.TimeZone = match[7]
+	if e.location, err = time.LoadLocation(e.TimeZone); err != nil {
+		e.Error = fmt.Sprintf("unknown time zone %s", e.TimeZone)
+	}
+	return e
+}
+
+func indexOf(values []string, value string) int {
+	for i, v := range values {
+		if v == value {
+			return i
+		}
+	}
+	return -1
+}
+
+// intervals returns the periods the entry suspends the policy overlapping start to end. Times are resolved in the time
+// zone of the entry for every day, so that the periods follow daylight saving time.
+func (e SavingsScheduleEntry) intervals(start, end time.Time) []savingsInterval {
+	if e.Error != "" {
+		return nil
+	}
+	intervals := make([]savingsInterval, 0)
+	first := start.In(e.location)
+	last := end.In(e.location)
+	for d := time.Date(first.Year(), first.Month(), first.Day()-1, 0, 0, 0, 0, e.location); !d.After(last); d = d.AddDate(0, 0, 1) {
+		if !e.days[d.Weekday()] {
+			continue
+		}
+		from := time.Date(d.Year(), d.Month(), d.Day(), e.from/60, e.from%60, 0, 0, e.location)
+		to := time.Date(d.Year(), d.Month(), d.Day(), e.to/60, e.to%60, 0, 0, e.location).Add(time.Minute)
+		if e.to < e.from || !to.After(start) || !from.Before(end) {
+			continue
+		}
+		intervals = append(intervals, savingsInterval{from: from.UTC(), to: to.UTC(), entries: []string{e.Entry}})
+	}
+	return intervals
+}
+
+// mergeIntervals joins overlapping and adjacent periods.
+func mergeIntervals(intervals []savingsInterval) []savingsInterval {
+	sort.Slice(intervals, func(i, j int) bool {
+		return intervals[i].from.Before(intervals[j].from)
+	})
+	merged := make([]savingsInterval, 0, len(intervals))
+	for _, i := range intervals {
+		n := len(merged)
+		if n == 0 || i.from.After(merged[n-1].to) {
+			merged = append(merged, i)
+			continue
+		}
+		if i.to.After(merged[n-1].to) {
+			merged[n-1].to = i.to
+		}
+		for _, e := range i.entries {
+			if indexOf(merged[n-1].entries, e) == -1 {
+				merged[n-1].entries = append(merged[n-1].entries, e)
+			}
+		}
+	}
+	return merged
+}
+
+// applyOverride suspends the policy from now until an override keeping it awake expires, or lifts every suspension until
+// an override applying savings expires.
+func applyOverride(intervals []savingsInterval, o SavingsPolicyOverride, now time.Time) []savingsInterval {
+	if o.Until == nil || !o.Until.After(now) {
+		return intervals
+	}
+	switch o.Override {
+	case OverrideKeepAwake:
+		return mergeIntervals(append(intervals, savingsInterval{from: now, to: *o.Until, entries: []string{overrideEntry}}))
+	case OverrideApplySavings:
+		kept := make([]savingsInterval, 0, len(intervals))
+		for _, i := range intervals {
+			if i.from.Before(now) {
+				before := i
+				before.to = minTime(i.to, now)
+				kept = append(kept, before)
+			}
+			if i.to.After(*o.Until) {
+				after := i
+				if after.from.Before(*o.Until) {
+					after.from = *o.Until
+					after.entries = append([]string{overrideEntry}, i.entries...)
+				}
+				kept = append(kept, after)
+			}
+		}
+		return kept
+	}
+	return intervals
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+// suspendedIntervals returns the periods a savings policy is suspended overlapping start to end, with its override
+// applied.
+func suspendedIntervals(entries []SavingsScheduleEntry, o SavingsPolicyOverride, now, start, end time.Time) []savingsInterval {
+	intervals := make([]savingsInterval, 0)
+	for _, e := range entries {
+		intervals = append(intervals, e.intervals(start, end)...)
+	}
+	return applyOverride(mergeIntervals(intervals), o, now)
+}
+
+// evaluateSchedule evaluates the state of a savings policy and its next transitions. The horizon is extended until
+// enough transitions are found, transitions at the end of the horizon are left out as the period may continue past it.
+func evaluateSchedule(policy sustainabilityv1alpha1.SavingsPolicy, now time.Time, transitions int) SavingsPolicySchedule {
+	s := SavingsPolicySchedule{
+		Namespace:   policy.Namespace,
+		Name:        policy.Name,
+		EvaluatedAt: now,
+		Override:    savingsPolicyOverride(policy, now),
+		Entries:     make([]SavingsScheduleEntry, 0),
+		Transitions: make([]SavingsTransition, 0),
+	}
+	for _, entry := range s.Override.Schedule {
+		s.Entries = append(s.Entries, parseScheduleEntry(entry))
+	}
+
+	for horizon := 14 * 24 * time.Hour; ; horizon *= 2 {
+		end := now.Add(horizon)
+		s.Suspended = false
+		s.Transitions = s.Transitions[:0]
+		for _, i := range suspendedIntervals(s.Entries, s.Override, now, now, end) {
+			if !i.from.After(now) && i.to.After(now) {
+				s.Suspended = true
+			}
+			if i.from.After(now) {
+				s.Transitions = append(s.Transitions, SavingsTransition{At: i.from, Transition: TransitionSuspend, Entries: i.entries})
+			}
+			if i.to.After(now) && i.to.Before(end) {
+				s.Transitions = append(s.Transitions, SavingsTransition{At: i.to, Transition: TransitionResume, Entries: i.entries})
+			}
+		}
+		if len(s.Transitions) >= transitions || horizon >= scheduleMaxHorizon {
+			break
+		}
+	}
+	if len(s.Transitions) > transitions {
+		s.Transitions = s.Transitions[:transitions]
+	}
+	return s
+}
+
+// calendarText escapes text values of icalendar properties.
+var calendarText = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`)
+
+// writeCalendar writes the periods savings policies are suspended as an icalendar feed.
+func writeCalendar(w http.ResponseWriter, cluster, name string, policies []sustainabilityv1alpha1.SavingsPolicy, now time.Time, days int) {
+	var b strings.Builder
+	line := func(l string) {
+		// Lines longer than 75 octets are folded, continuing with a space
+		for len(l) > 75 {
+			cut := 75
+			for cut > 0 && l[cut]&0xC0 == 0x80 {
+				cut--
+			}
+			b.WriteString(l[:cut] + "\r\n")
+			l = " " + l[cut:]
+		}
+		b.WriteString(l + "\r\n")
+	}
+	stamp := func(t time.Time) string {
+		return t.UTC().Format("20060102T150405Z")
+	}
+
+	line("BEGIN:VCALENDAR")
+	line("VERSION:2.0")
+	line("PRODID:-//aeto-web//savings policies//EN")
+	line("CALSCALE:GREGORIAN")
+	line("METHOD:PUBLISH")
+	line("X-WR-CALNAME:" + calendarText.Replace(name))
+	line("REFRESH-INTERVAL;VALUE=DURATION:PT1H")
+
+	start := now.Truncate(time.Hour).Add(-calendarPastDays * 24 * time.Hour)
+	end := now.Add(time.Duration(days) * 24 * time.Hour)
+	for _, p := range policies {
+		override := savingsPolicyOverride(p, now)
+		entries := make([]SavingsScheduleEntry, 0, len(override.Schedule))
+		for _, entry := range override.Schedule {
+			entries = append(entries, parseScheduleEntry(entry))
+		}
+		id := p.Namespace + "/" + p.Name
+		for _, i := range suspendedIntervals(entries, override, now, start, end) {
+			line("BEGIN:VEVENT")
+			line(fmt.Sprintf("UID:%s-%s-%s-%d@aeto-web", cluster, p.Namespace, p.Name, i.from.Unix()))
+			line("DTSTAMP:" + stamp(now))
+			line("DTSTART:" + stamp(i.from))
+			line("DTEND:" + stamp(i.to))
+			line("SUMMARY:" + calendarText.Replace(fmt.Sprintf("Savings policy %s suspended", id)))
+			line("DESCRIPTION:" + calendarText.Replace(fmt.Sprintf("Resources targeted by savings policy %s in cluster %s are kept awake (%s)", id, cluster, strings.Join(i.entries, ", "))))
+			line("END:VEVENT")
+		}
+	}
+	line("END:VCALENDAR")
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Write([]byte(b.String()))
+}
+
+// queryInt returns the positive integer query parameter, or the default when not set, capped at max.
+func queryInt(req *http.Request, param string, def, max int) (int, error) {
+	v := req.URL.Query().Get(param)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("%s: %q is not a positive number", param, v)
+	}
+	if n > max {
+		n = max
+	}
+	return n, nil
+}
+
+func addCalendarRoutes(s *Server, r chi.Router, operatorNamespace string) {
+	// policies returns the savings policies visible to the identity of the request, all of them without a name
+	policies := func(w http.ResponseWriter, req *http.Request) ([]sustainabilityv1alpha1.SavingsPolicy, bool) {
+		namespace := chi.URLParam(req, "namespace")
+		name := chi.URLParam(req, "name")
+
+		client := clusterFrom(req).Client()
+		if notServed(w, client, savingsPolicyResource) {
+			return nil, false
+		}
+		reader, allowed, err := s.access(req, client, savingsPolicyResource)
+		if hasErr(w, err) {
+			return nil, false
+		}
+
+		if name != "" {
+			if !allowed(namespace, name) {
+				writeError(w, 403, fmt.Sprintf("%s is not allowed to get %s %s/%s", identityFrom(req).Username, savingsPolicyResource.Name, namespace, name))
+				return nil, false
+			}
+			p, err := reader.SustainabilityV1Alpha1(namespace).GetSavingsPolicy(name)
+			if hasErr(w, err) {
+				return nil, false
+			}
+			return []sustainabilityv1alpha1.SavingsPolicy{*p}, true
+		}
+
+		list, err := reader.SustainabilityV1Alpha1(operatorNamespace).ListSavingsPolicies()
+		if hasErr(w, err) {
+			return nil, false
+		}
+		visible := filter(list.Items, func(p sustainabilityv1alpha1.SavingsPolicy) bool {
+			return allowed(p.Namespace, p.Name)
+		})
+		sort.Slice(visible, func(i, j int) bool {
+			return visible[i].Namespace+"/"+visible[i].Name < visible[j].Namespace+"/"+visible[j].Name
+		})
+		return visible, true
+	}
+
+	// Evaluates the schedules of savings policies, answering with their state and next ?transitions=<n> transitions
+	schedules := func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		transitions, err := queryInt(req, "transitions", scheduleDefaultTransitions, scheduleMaxTransitions)
+		if err != nil {
+			writeError(w, 400, err.Error())
+			return
+		}
+		list, ok := policies(w, req)
+		if !ok {
+			return
+		}
+
+		now := time.Now().UTC()
+		evaluated := make([]SavingsPolicySchedule, 0, len(list))
+		for _, p := range list {
+			evaluated = append(evaluated, evaluateSchedule(p, now, transitions))
+		}
+
+		var data []byte
+		if chi.URLParam(req, "name") != "" {
+			data, err = json.Marshal(evaluated[0])
+		} else {
+			data, err = json.Marshal(evaluated)
+		}
+		if hasErr(w, err) {
+			return
+		}
+		w.Write(data)
+	}
+
+	// Serves the periods savings policies are suspended as an icalendar feed, from a week ago until ?days=<n> ahead.
+	// Calendar apps may subscribe with an api key as the password of basic auth.
+	calendar := func(w http.ResponseWriter, req *http.Request) {
+		days, err := queryInt(req, "days", calendarDefaultDays, calendarMaxDays)
+		if err != nil {
+			writeError(w, 400, err.Error())
+			return
+		}
+		list, ok := policies(w, req)
+		if !ok {
+			return
+		}
+
+		cluster := clusterFrom(req).Name
+		name := fmt.Sprintf("aeto savings policies (%s)", cluster)
+		if n := chi.URLParam(req, "name"); n != "" {
+			name = fmt.Sprintf("aeto savings policy %s/%s (%s)", chi.URLParam(req, "namespace"), n, cluster)
+		}
+		writeCalendar(w, cluster, name, list, time.Now().UTC(), days)
+	}
+
+	read := r.With(authorize(s, PermissionReadResources), throttle(s, RateLimitBucketDirect))
+	read.Get("/savingspolicies/schedules", schedules)
+	read.Get("/savingspolicies/schedules.ics", calendar)
+	read.Get("/savingspolicies/{namespace}/{name}/schedule", schedules)
+	read.Get("/savingspolicies/{namespace}/{name}/schedule.ics", calendar)
+}
@@ -0,0 +1,267 @@
+package server
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func utc(value string) time.Time {
+	t, err := time.Parse("2006-01-02T15:04", value)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// formatIntervals returns the intervals as from/to in utc, followed by their entries.
+func formatIntervals(intervals []savingsInterval) []string {
+	formatted := make([]string, 0, len(intervals))
+	for _, i := range intervals {
+		formatted = append(formatted, i.from.Format("2006-01-02T15:04")+"/"+i.to.Format("2006-01-02T15:04")+" "+strings.Join(i.entries, ","))
+	}
+	return formatted
+}
+
+func TestParseScheduleEntry(t *testing.T) {
+	tests := []struct {
+		entry string
+		days  []string
+		err   string
+	}{
+		{entry: "MON-FRI 08:00-18:00 Europe/Stockholm", days: []string{"MON", "TUE", "WED", "THU", "FRI"}},
+		{entry: "fri-mon 20:00-06:00 UTC", days: []string{"FRI", "SAT", "SUN", "MON"}},
+		{entry: "SUN-SUN 00:00-23:59 America/New_York", days: []string{"SUN"}},
+		{entry: "MON-FRI 8:00-18:00 UTC", err: "does not match"},
+		{entry: "MON-FRI 08:00-18:00", err: "does not match"},
+		{entry: "MON-FRY 08:00-18:00 UTC", err: "days must be one of"},
+		{entry: "MON-FRI 08:00-24:00 UTC", err: "times must be between"},
+		{entry: "MON-FRI 08:00-18:00 Europe/Atlantis", err: "unknown time zone"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.entry, func(t *testing.T) {
+			e := parseScheduleEntry(tt.entry)
+			if tt.err != "" {
+				if !strings.Contains(e.Error, tt.err) {
+					t.Errorf("got error %q, expected it to contain %q", e.Error, tt.err)
+				}
+				return
+			}
+			if e.Error != "" {
+				t.Fatalf("unexpected error %s", e.Error)
+			}
+			if !reflect.DeepEqual(e.Days, tt.days) {
+				t.Errorf("got days %v, expected %v", e.Days, tt.days)
+			}
+		})
+	}
+}
+
+func TestScheduleEntryIntervals(t *testing.T) {
+	tests := []struct {
+		name       string
+		entry      string
+		start, end string
+		want       []string
+	}{
+		{
+			name:  "weekdays",
+			entry: "MON-FRI 08:00-18:00 UTC",
+			start: "2026-10-16T00:00",
+			end:   "2026-10-20T00:00",
+			want: []string{
+				"2026-10-16T08:00/2026-10-16T18:01 MON-FRI 08:00-18:00 UTC",
+				"2026-10-19T08:00/2026-10-19T18:01 MON-FRI 08:00-18:00 UTC",
+			},
+		},
+		{
+			name:  "overlapping the start",
+			entry: "MON-FRI 08:00-18:00 UTC",
+			start: "2026-10-19T12:00",
+			end:   "2026-10-19T13:00",
+			want:  []string{"2026-10-19T08:00/2026-10-19T18:01 MON-FRI 08:00-18:00 UTC"},
+		},
+		{
+			name:  "ending before it starts",
+			entry: "MON-SUN 20:00-06:00 UTC",
+			start: "2026-10-19T00:00",
+			end:   "2026-10-21T00:00",
+			want:  []string{},
+		},
+		{
+			name:  "daylight saving time ends",
+			entry: "SAT-MON 08:00-18:00 Europe/Stockholm",
+			start: "2026-10-24T00:00",
+			end:   "2026-10-27T00:00",
+			want: []string{
+				"2026-10-24T06:00/2026-10-24T16:01 SAT-MON 08:00-18:00 Europe/Stockholm",
+				"2026-10-25T07:00/2026-10-25T17:01 SAT-MON 08:00-18:00 Europe/Stockholm",
+				"2026-10-26T07:00/2026-10-26T17:01 SAT-MON 08:00-18:00 Europe/Stockholm",
+			},
+		},
+		{
+			name:  "daylight saving time starts",
+			entry: "SAT-SUN 08:00-18:00 Europe/Stockholm",
+			start: "2026-03-28T00:00",
+			end:   "2026-03-30T00:00",
+			want: []string{
+				"2026-03-28T07:00/2026-03-28T17:01 SAT-SUN 08:00-18:00 Europe/Stockholm",
+				"2026-03-29T06:00/2026-03-29T16:01 SAT-SUN 08:00-18:00 Europe/Stockholm",
+			},
+		},
+		{
+			name:  "across the clock change",
+			entry: "SUN-SUN 01:00-04:00 Europe/Stockholm",
+			start: "2026-10-24T00:00",
+			end:   "2026-10-26T00:00",
+			want:  []string{"2026-10-24T23:00/2026-10-25T03:01 SUN-SUN 01:00-04:00 Europe/Stockholm"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := parseScheduleEntry(tt.entry)
+			if e.Error != "" {
+				t.Fatal(e.Error)
+			}
+			got := formatIntervals(e.intervals(utc(tt.start), utc(tt.end)))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, expected %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergeIntervals(t *testing.T) {
+	interval := func(from, to, entry string) savingsInterval {
+		return savingsInterval{from: utc(from), to: utc(to), entries: []string{entry}}
+	}
+
+	tests := []struct {
+		name      string
+		intervals []savingsInterval
+		want      []string
+	}{
+		{
+			name: "disjoint",
+			intervals: []savingsInterval{
+				interval("2026-10-19T12:00", "2026-10-19T13:00", "b"),
+				interval("2026-10-19T08:00", "2026-10-19T10:00", "a"),
+			},
+			want: []string{
+				"2026-10-19T08:00/2026-10-19T10:00 a",
+				"2026-10-19T12:00/2026-10-19T13:00 b",
+			},
+		},
+		{
+			name: "overlapping",
+			intervals: []savingsInterval{
+				interval("2026-10-19T08:00", "2026-10-19T12:00", "a"),
+				interval("2026-10-19T10:00", "2026-10-19T14:00", "b"),
+			},
+			want: []string{"2026-10-19T08:00/2026-10-19T14:00 a,b"},
+		},
+		{
+			name: "adjacent",
+			intervals: []savingsInterval{
+				interval("2026-10-19T08:00", "2026-10-19T10:00", "a"),
+				interval("2026-10-19T10:00", "2026-10-19T12:00", "b"),
+			},
+			want: []string{"2026-10-19T08:00/2026-10-19T12:00 a,b"},
+		},
+		{
+			name: "contained",
+			intervals: []savingsInterval{
+				interval("2026-10-19T08:00", "2026-10-19T18:00", "a"),
+				interval("2026-10-19T10:00", "2026-10-19T12:00", "b"),
+			},
+			want: []string{"2026-10-19T08:00/2026-10-19T18:00 a,b"},
+		},
+		{
+			name: "same entry twice",
+			intervals: []savingsInterval{
+				interval("2026-10-19T08:00", "2026-10-19T12:00", "a"),
+				interval("2026-10-19T11:00", "2026-10-19T14:00", "a"),
+			},
+			want: []string{"2026-10-19T08:00/2026-10-19T14:00 a"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatIntervals(mergeIntervals(tt.intervals)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, expected %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyOverride(t *testing.T) {
+	now := utc("2026-10-19T12:00")
+	intervals := func() []savingsInterval {
+		return []savingsInterval{
+			{from: utc("2026-10-19T08:00"), to: utc("2026-10-19T18:00"), entries: []string{"a"}},
+			{from: utc("2026-10-20T08:00"), to: utc("2026-10-20T18:00"), entries: []string{"a"}},
+		}
+	}
+	until := func(value string) *time.Time {
+		t := utc(value)
+		return &t
+	}
+
+	tests := []struct {
+		name     string
+		override SavingsPolicyOverride
+		want     []string
+	}{
+		{
+			name:     "none",
+			override: SavingsPolicyOverride{Override: OverrideNone},
+			want: []string{
+				"2026-10-19T08:00/2026-10-19T18:00 a",
+				"2026-10-20T08:00/2026-10-20T18:00 a",
+			},
+		},
+		{
+			name:     "expired",
+			override: SavingsPolicyOverride{Override: OverrideApplySavings, Until: until("2026-10-19T11:00")},
+			want: []string{
+				"2026-10-19T08:00/2026-10-19T18:00 a",
+				"2026-10-20T08:00/2026-10-20T18:00 a",
+			},
+		},
+		{
+			name:     "suspended until tomorrow",
+			override: SavingsPolicyOverride{Override: OverrideKeepAwake, Until: until("2026-10-20T10:00")},
+			want: []string{
+				"2026-10-19T08:00/2026-10-20T18:00 a,override",
+			},
+		},
+		{
+			name:     "resumed for an hour",
+			override: SavingsPolicyOverride{Override: OverrideApplySavings, Until: until("2026-10-19T13:00")},
+			want: []string{
+				"2026-10-19T08:00/2026-10-19T12:00 a",
+				"2026-10-19T13:00/2026-10-19T18:00 override,a",
+				"2026-10-20T08:00/2026-10-20T18:00 a",
+			},
+		},
+		{
+			name:     "resumed until tomorrow",
+			override: SavingsPolicyOverride{Override: OverrideApplySavings, Until: until("2026-10-21T00:00")},
+			want: []string{
+				"2026-10-19T08:00/2026-10-19T12:00 a",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatIntervals(applyOverride(intervals(), tt.override, now)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, expected %v", got, tt.want)
+			}
+		})
+	}
+}
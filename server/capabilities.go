@@ -0,0 +1,105 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	acmawsv1alpha1 "github.com/kristofferahl/aeto/apis/acm.aws/v1alpha1"
+	corev1alpha1 "github.com/kristofferahl/aeto/apis/core/v1alpha1"
+	eventv1alpha1 "github.com/kristofferahl/aeto/apis/event/v1alpha1"
+	route53awsv1alpha1 "github.com/kristofferahl/aeto/apis/route53.aws/v1alpha1"
+	sustainabilityv1alpha1 "github.com/kristofferahl/aeto/apis/sustainability/v1alpha1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+)
+
+const (
+	capabilitiesInterval = 1 * time.Minute
+)
+
+var aetoGroupVersions = []schema.GroupVersion{
+	corev1alpha1.GroupVersion,
+	eventv1alpha1.GroupVersion,
+	sustainabilityv1alpha1.GroupVersion,
+	acmawsv1alpha1.GroupVersion,
+	route53awsv1alpha1.GroupVersion,
+}
+
+// Capabilities describes which aeto api groups and versions are served by a cluster.
+type Capabilities struct {
+	mu        sync.RWMutex
+	groups    map[schema.GroupVersion]bool
+	checkedAt time.Time
+}
+
+type CapabilitiesView struct {
+	Groups    map[string]bool `json:"groups"`
+	Resources map[string]bool `json:"resources"`
+	CheckedAt string          `json:"checkedAt,omitempty"`
+}
+
+// newCapabilities returns capabilities where every group is assumed to be served until discovery says otherwise.
+func newCapabilities() *Capabilities {
+	groups := make(map[schema.GroupVersion]bool)
+	for _, gv := range aetoGroupVersions {
+		groups[gv] = true
+	}
+	return &Capabilities{
+		groups: groups,
+	}
+}
+
+// Discover updates the capabilities using the discovery api and returns the group versions that became served.
+func (c *Capabilities) Discover(client discovery.DiscoveryInterface) ([]schema.GroupVersion, error) {
+	groupList, err := client.ServerGroups()
+	if err != nil {
+		return nil, err
+	}
+
+	served := make(map[schema.GroupVersion]bool)
+	for _, g := range groupList.Groups {
+		for _, v := range g.Versions {
+			served[schema.GroupVersion{Group: g.Name, Version: v.Version}] = true
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	added := make([]schema.GroupVersion, 0)
+	for _, gv := range aetoGroupVersions {
+		if served[gv] && (!c.groups[gv] || c.checkedAt.IsZero()) {
+			added = append(added, gv)
+		}
+		c.groups[gv] = served[gv]
+	}
+	c.checkedAt = time.Now().UTC()
+
+	return added, nil
+}
+
+func (c *Capabilities) Serves(gv schema.GroupVersion) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.groups[gv]
+}
+
+func (c *Capabilities) View() CapabilitiesView {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	view := CapabilitiesView{
+		Groups:    make(map[string]bool),
+		Resources: make(map[string]bool),
+	}
+	for gv, served := range c.groups {
+		view.Groups[gv.String()] = served
+	}
+	for _, r := range apiResources {
+		view.Resources[r.Name] = c.groups[r.GroupVersion]
+	}
+	if !c.checkedAt.IsZero() {
+		view.CheckedAt = c.checkedAt.Format(time.RFC3339)
+	}
+	return view
+}
@@ -1,11 +1,32 @@
 package server
 
 import (
+	"context"
+	"fmt"
+	"sync/atomic"
+
+	acmawsv1alpha1 "github.com/kristofferahl/aeto/apis/acm.aws/v1alpha1"
+	corev1alpha1 "github.com/kristofferahl/aeto/apis/core/v1alpha1"
+	eventv1alpha1 "github.com/kristofferahl/aeto/apis/event/v1alpha1"
+	route53awsv1alpha1 "github.com/kristofferahl/aeto/apis/route53.aws/v1alpha1"
+	sustainabilityv1alpha1 "github.com/kristofferahl/aeto/apis/sustainability/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/kubernetes"
 	rest "k8s.io/client-go/rest"
 )
 
 type AetoClient struct {
 	restConfig             *rest.Config
+	cache                  *InMemoryCache
+	stopCh                 chan struct{}
+	watching               atomic.Bool
+	discovery              discovery.DiscoveryInterface
+	kubernetes             kubernetes.Interface
+	reviewer               *AccessReviewer
+	capabilities           *Capabilities
 	corev1Alpha1           *CoreV1Alpha1Client
 	eventv1Alpha1          *rest.RESTClient
 	sustainabilityv1Alpha1 *rest.RESTClient
@@ -13,9 +34,11 @@ type AetoClient struct {
 	route53AwsV1Alpha1     *rest.RESTClient
 }
 
-func NewForConfig(c *rest.Config) (*AetoClient, error) {
+func NewForConfig(c *rest.Config, cache *InMemoryCache) (*AetoClient, error) {
 	client := &AetoClient{
 		restConfig: c,
+		cache:      cache,
+		stopCh:     make(chan struct{}),
 	}
 
 	corev1Alpha1Client, err := client.NewCoreV1Alpha1Client()
@@ -43,8 +66,26 @@ func NewForConfig(c *rest.Config) (*AetoClient, error) {
 		return nil, err
 	}
 
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(c)
+	if err != nil {
+		return nil, err
+	}
+
+	kubernetesClient, err := kubernetes.NewForConfig(c)
+	if err != nil {
+		return nil, err
+	}
+
+	// Clients are created for every group version as creating them does not require the group version to be served.
+	// Use Serves to check if the cluster serves a group version before using its client.
 	return &AetoClient{
 		restConfig:             c,
+		cache:                  cache,
+		stopCh:                 client.stopCh,
+		discovery:              discoveryClient,
+		kubernetes:             kubernetesClient,
+		reviewer:               NewAccessReviewer(kubernetesClient),
+		capabilities:           newCapabilities(),
 		corev1Alpha1:           corev1Alpha1Client,
 		eventv1Alpha1:          eventv1Alpha1Client,
 		sustainabilityv1Alpha1: sustainabilityv1Alpha1Client,
@@ -52,3 +93,145 @@ func NewForConfig(c *rest.Config) (*AetoClient, error) {
 		route53AwsV1Alpha1:     route53AwsV1Alpha1Client,
 	}, nil
 }
+
+// RunAs returns a client impersonating the identity, or the client itself when there is none.
+func (c *AetoClient) RunAs(identity *RunAs) (*AetoClient, error) {
+	if identity == nil {
+		return c, nil
+	}
+	return c.Impersonate(&Identity{Username: identity.Username, Groups: identity.Groups})
+}
+
+// Impersonate returns a client making direct api calls, including changes to cached resources, as the given identity so
+// that the RBAC of the identity applies. Cached resources and watches are shared with the original client, use
+// AllowFunc to authorize access to them.
+func (c *AetoClient) Impersonate(identity *Identity) (*AetoClient, error) {
+	config := rest.CopyConfig(c.restConfig)
+	config.Impersonate = rest.ImpersonationConfig{
+		UserName: identity.Username,
+		Groups:   identity.Groups,
+	}
+
+	client := &AetoClient{
+		restConfig:   config,
+		cache:        c.cache,
+		stopCh:       c.stopCh,
+		discovery:    c.discovery,
+		kubernetes:   c.kubernetes,
+		reviewer:     c.reviewer,
+		capabilities: c.capabilities,
+	}
+
+	var err error
+	if client.corev1Alpha1, err = client.NewCoreV1Alpha1Client(); err != nil {
+		return nil, err
+	}
+	if client.eventv1Alpha1, err = client.NewEventV1Alpha1Client(); err != nil {
+		return nil, err
+	}
+	if client.sustainabilityv1Alpha1, err = client.NewSustainabilityV1Alpha1Client(); err != nil {
+		return nil, err
+	}
+	if client.acmAwsV1Alpha1, err = client.NewAcmAwsV1Alpha1Client(); err != nil {
+		return nil, err
+	}
+	if client.route53AwsV1Alpha1, err = client.NewRoute53AwsV1Alpha1Client(); err != nil {
+		return nil, err
+	}
+	client.watching.Store(c.watching.Load())
+
+	return client, nil
+}
+
+// AllowFunc returns a func deciding if the identity may see a cached resource.
+func (c *AetoClient) AllowFunc(ctx context.Context, identity *Identity, gvr schema.GroupVersionResource) allowFunc {
+	return c.reviewer.AllowFunc(ctx, identity, gvr)
+}
+
+// restClient returns the rest client of a group version.
+func (c *AetoClient) restClient(gv schema.GroupVersion) (rest.Interface, error) {
+	switch gv {
+	case corev1alpha1.GroupVersion:
+		return c.corev1Alpha1.REST, nil
+	case eventv1alpha1.GroupVersion:
+		return c.eventv1Alpha1, nil
+	case sustainabilityv1alpha1.GroupVersion:
+		return c.sustainabilityv1Alpha1, nil
+	case acmawsv1alpha1.GroupVersion:
+		return c.acmAwsV1Alpha1, nil
+	case route53awsv1alpha1.GroupVersion:
+		return c.route53AwsV1Alpha1, nil
+	}
+	return nil, fmt.Errorf("no client for group version %s", gv)
+}
+
+// GetRaw fetches a resource from the api server, bypassing the cache, and returns it as json.
+func (c *AetoClient) GetRaw(gvr schema.GroupVersionResource, namespace, name string) ([]byte, error) {
+	client, err := c.restClient(gvr.GroupVersion())
+	if err != nil {
+		return nil, err
+	}
+
+	return client.
+		Get().
+		Namespace(namespace).
+		Resource(gvr.Resource).
+		Name(name).
+		Do(context.Background()).
+		Raw()
+}
+
+// CreateRaw creates a resource from its json and returns the created resource as json.
+func (c *AetoClient) CreateRaw(gvr schema.GroupVersionResource, namespace string, body []byte, dryRun bool) ([]byte, error) {
+	client, err := c.restClient(gvr.GroupVersion())
+	if err != nil {
+		return nil, err
+	}
+
+	req := client.
+		Post().
+		Namespace(namespace).
+		Resource(gvr.Resource).
+		SetHeader("Content-Type", "application/json").
+		Body(body)
+	if dryRun {
+		req = req.Param("dryRun", metav1.DryRunAll)
+	}
+	return req.Do(context.Background()).Raw()
+}
+
+// PatchRaw applies a patch to a resource and returns the patched resource as json.
+func (c *AetoClient) PatchRaw(gvr schema.GroupVersionResource, namespace, name string, pt types.PatchType, patch []byte, dryRun bool) ([]byte, error) {
+	client, err := c.restClient(gvr.GroupVersion())
+	if err != nil {
+		return nil, err
+	}
+
+	req := client.
+		Patch(pt).
+		Namespace(namespace).
+		Resource(gvr.Resource).
+		Name(name).
+		Body(patch)
+	if dryRun {
+		req = req.Param("dryRun", metav1.DryRunAll)
+	}
+	return req.Do(context.Background()).Raw()
+}
+
+func (c *AetoClient) Serves(gv schema.GroupVersion) bool {
+	return c.capabilities.Serves(gv)
+}
+
+func (c *AetoClient) Capabilities() CapabilitiesView {
+	return c.capabilities.View()
+}
+
+func (c *AetoClient) Changes() *ChangeStream {
+	return c.cache.changestream
+}
+
+// Close stops all watches started by the client.
+func (c *AetoClient) Close() {
+	close(c.stopCh)
+}
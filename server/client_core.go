@@ -2,13 +2,16 @@ package server
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"sort"
 	"strings"
 
 	corev1alpha1 "github.com/kristofferahl/aeto/apis/core/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/rest"
@@ -46,6 +49,8 @@ func (c *AetoClient) NewCoreV1Alpha1Client() (*CoreV1Alpha1Client, error) {
 func (c *AetoClient) CoreV1Alpha1(namespace string) CoreV1Alpha1 {
 	return &corev1Alpha1{
 		client: c.corev1Alpha1,
+		cache:  c.cache,
+		stopCh: c.stopCh,
 		ns:     namespace,
 	}
 }
@@ -60,10 +65,14 @@ type CoreV1Alpha1 interface {
 	GetResourceSet(name string) (*corev1alpha1.ResourceSet, error)
 	ListResourceTemplates(filters ...func(i corev1alpha1.ResourceTemplate) bool) (*corev1alpha1.ResourceTemplateList, error)
 	GetResourceTemplate(name string) (*corev1alpha1.ResourceTemplate, error)
+	CreateTenant(tenant *corev1alpha1.Tenant, dryRun bool) (*corev1alpha1.Tenant, error)
+	DeleteTenant(name string, uid types.UID, resourceVersion string, dryRun bool) error
 }
 
 type corev1Alpha1 struct {
 	client *CoreV1Alpha1Client
+	cache  *InMemoryCache
+	stopCh <-chan struct{}
 	ns     string
 }
 
@@ -74,7 +83,8 @@ func (c *corev1Alpha1) Watch() error {
 		func() corev1alpha1.Tenant {
 			return corev1alpha1.Tenant{}
 		},
-		cache.tenant); err != nil {
+		c.cache.tenant,
+		c.stopCh); err != nil {
 		return err
 	}
 
@@ -84,7 +94,8 @@ func (c *corev1Alpha1) Watch() error {
 		func() corev1alpha1.Blueprint {
 			return corev1alpha1.Blueprint{}
 		},
-		cache.blueprint); err != nil {
+		c.cache.blueprint,
+		c.stopCh); err != nil {
 		return err
 	}
 
@@ -94,7 +105,8 @@ func (c *corev1Alpha1) Watch() error {
 		func() corev1alpha1.ResourceSet {
 			return corev1alpha1.ResourceSet{}
 		},
-		cache.resourceSets); err != nil {
+		c.cache.resourceSets,
+		c.stopCh); err != nil {
 		return err
 	}
 
@@ -114,7 +126,7 @@ func (c *corev1Alpha1) Watch() error {
 				log.Println("Add", "resourcetemplates", fmt.Sprintf("error fetching resource %s/%s, err:", c.ns, u.GetName()), err)
 				return
 			}
-			cache.resourceTemplates.Add(u.GetUID(), u.GetResourceVersion(), result)
+			c.cache.resourceTemplates.Add(u.GetUID(), u.GetResourceVersion(), result)
 		},
 		UpdateFunc: func(oldObj, newObj interface{}) {
 			ou := oldObj.(*unstructured.Unstructured)
@@ -132,14 +144,14 @@ func (c *corev1Alpha1) Watch() error {
 				log.Println("Add", "resourcetemplates", fmt.Sprintf("error fetching resource %s/%s, err:", c.ns, nu.GetName()), err)
 				return
 			}
-			cache.resourceTemplates.Update(nu.GetUID(), nu.GetResourceVersion(), result)
+			c.cache.resourceTemplates.Update(nu.GetUID(), nu.GetResourceVersion(), result)
 		},
 		DeleteFunc: func(obj interface{}) {
 			u := obj.(*unstructured.Unstructured)
 			log.Println("Delete", "resourcetemplates", u.GetUID())
-			cache.resourceTemplates.Delete(u.GetUID())
+			c.cache.resourceTemplates.Delete(u.GetUID())
 		},
-	}); err != nil {
+	}, c.stopCh); err != nil {
 		return err
 	}
 
@@ -152,7 +164,7 @@ func (c *corev1Alpha1) ListTenants(filters ...func(i corev1alpha1.Tenant) bool)
 	filters = append(filters, func(i corev1alpha1.Tenant) bool {
 		return i.GetNamespace() == c.ns
 	})
-	result.Items = cache.tenant.Items(filters...)
+	result.Items = c.cache.tenant.Items(filters...)
 
 	sort.Slice(result.Items, func(i, j int) bool {
 		return strings.Compare(result.Items[i].NamespacedName().String(), result.Items[j].NamespacedName().String()) == -1
@@ -174,7 +186,7 @@ func (c *corev1Alpha1) ListBlueprints(filters ...func(i corev1alpha1.Blueprint)
 	filters = append(filters, func(i corev1alpha1.Blueprint) bool {
 		return i.Namespace == c.ns
 	})
-	result.Items = cache.blueprint.Items(filters...)
+	result.Items = c.cache.blueprint.Items(filters...)
 
 	sort.Slice(result.Items, func(i, j int) bool {
 		return strings.Compare(result.Items[i].NamespacedName().String(), result.Items[j].NamespacedName().String()) == -1
@@ -196,7 +208,7 @@ func (c *corev1Alpha1) ListResourceSets(filters ...func(i corev1alpha1.ResourceS
 	filters = append(filters, func(i corev1alpha1.ResourceSet) bool {
 		return i.GetNamespace() == c.ns
 	})
-	result.Items = cache.resourceSets.Items(filters...)
+	result.Items = c.cache.resourceSets.Items(filters...)
 
 	sort.Slice(result.Items, func(i, j int) bool {
 		return strings.Compare(result.Items[i].NamespacedName().String(), result.Items[j].NamespacedName().String()) == -1
@@ -218,7 +230,7 @@ func (c *corev1Alpha1) ListResourceTemplates(filters ...func(i corev1alpha1.Reso
 	filters = append(filters, func(i corev1alpha1.ResourceTemplate) bool {
 		return i.GetNamespace() == c.ns
 	})
-	result.Items = cache.resourceTemplates.Items(filters...)
+	result.Items = c.cache.resourceTemplates.Items(filters...)
 
 	sort.Slice(result.Items, func(i, j int) bool {
 		return strings.Compare(result.Items[i].NamespacedName().String(), result.Items[j].NamespacedName().String()) == -1
@@ -233,3 +245,56 @@ func (c *corev1Alpha1) GetResourceTemplate(name string) (*corev1alpha1.ResourceT
 	})
 	return one(result.Items, err, &corev1alpha1.ResourceTemplate{})
 }
+
+func (c *corev1Alpha1) CreateTenant(tenant *corev1alpha1.Tenant, dryRun bool) (*corev1alpha1.Tenant, error) {
+	tenant.APIVersion = corev1alpha1.GroupVersion.String()
+	tenant.Kind = "Tenant"
+	body, err := json.Marshal(tenant)
+	if err != nil {
+		return nil, err
+	}
+
+	result := corev1alpha1.Tenant{}
+	req := c.client.REST.
+		Post().
+		Namespace(c.ns).
+		Resource("tenants").
+		SetHeader("Content-Type", "application/json").
+		Body(body)
+	if dryRun {
+		req = req.Param("dryRun", metav1.DryRunAll)
+	}
+	err = req.Do(context.Background()).Into(&result)
+
+	return &result, err
+}
+
+// DeleteTenant deletes the tenant with the given uid, making sure a tenant re-created with the same name is left alone.
+// When a resourceVersion is given the tenant is also left alone when it has changed since.
+func (c *corev1Alpha1) DeleteTenant(name string, uid types.UID, resourceVersion string, dryRun bool) error {
+	opts := metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{
+			UID: &uid,
+		},
+	}
+	if resourceVersion != "" {
+		opts.Preconditions.ResourceVersion = &resourceVersion
+	}
+	if dryRun {
+		opts.DryRun = []string{metav1.DryRunAll}
+	}
+	body, err := json.Marshal(opts)
+	if err != nil {
+		return err
+	}
+
+	return c.client.REST.
+		Delete().
+		Namespace(c.ns).
+		Resource("tenants").
+		Name(name).
+		SetHeader("Content-Type", "application/json").
+		Body(body).
+		Do(context.Background()).
+		Error()
+}
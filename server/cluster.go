@@ -0,0 +1,235 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	corev1alpha1 "github.com/kristofferahl/aeto/apis/core/v1alpha1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+type contextKey string
+
+const (
+	clusterContextKey contextKey = "cluster"
+)
+
+// Cluster is a connection to a kubernetes cluster running aeto, with its own client and cache. The client is replaced
+// when the cluster is reconnected while the cache is kept for the lifetime of the cluster.
+type Cluster struct {
+	Name    string
+	config  ClusterConfig
+	cache   *InMemoryCache
+	client  atomic.Pointer[AetoClient]
+	mu      sync.Mutex
+	lastErr error
+	retryAt time.Time
+	leading atomic.Bool
+}
+
+// Client returns the current client of the cluster, or nil while the cluster is not yet connected.
+func (c *Cluster) Client() *AetoClient {
+	return c.client.Load()
+}
+
+const (
+	connectBackoffInitial = 1 * time.Second
+	connectBackoffMax     = 2 * time.Minute
+)
+
+// ClusterStatus describes the connection state of a cluster.
+type ClusterStatus struct {
+	Name      string `json:"name"`
+	Connected bool   `json:"connected"`
+	Error     string `json:"error,omitempty"`
+	RetryAt   string `json:"retryAt,omitempty"`
+	Leader    bool   `json:"leader"`
+}
+
+func newClusters(config Config) []*Cluster {
+	clusters := make([]*Cluster, 0)
+	for _, cc := range config.ClusterList() {
+		cluster := &Cluster{
+			Name:   cc.Name,
+			config: cc,
+			cache:  NewInMemoryCache(cc.Name),
+		}
+		cluster.cache.changestream.Configure(config)
+		clusters = append(clusters, cluster)
+	}
+	return clusters
+}
+
+// connectWithRetry connects to the cluster, retrying with exponential backoff until a connection is made.
+func (c *Cluster) connectWithRetry(config Config) {
+	backoff := wait.Backoff{
+		Duration: connectBackoffInitial,
+		Factor:   2,
+		Jitter:   0.1,
+		Steps:    math.MaxInt32,
+		Cap:      connectBackoffMax,
+	}
+
+	for {
+		err := c.connect(config)
+		if err == nil {
+			return
+		}
+
+		delay := backoff.Step()
+		log.Println("failed to connect to cluster", c.Name, "retrying in", delay.Round(time.Second), err)
+
+		c.mu.Lock()
+		c.lastErr = err
+		c.retryAt = time.Now().Add(delay)
+		c.mu.Unlock()
+
+		time.Sleep(delay)
+	}
+}
+
+// connect creates a new client for the cluster and starts watching resources. The connection is only considered up
+// once the api server responds to discovery. Any previous client is closed and the cache is reset so that it is
+// repopulated by the new watches.
+func (c *Cluster) connect(config Config) error {
+	restConfig, err := getClusterRestConfig(config.Kubernetes, c.config)
+	if err != nil {
+		return err
+	}
+
+	client, err := NewForConfig(restConfig, c.cache)
+	if err != nil {
+		return err
+	}
+
+	added, err := client.capabilities.Discover(client.discovery)
+	if err != nil {
+		return err
+	}
+	c.logServed(added)
+
+	previous := c.client.Load()
+	if previous != nil {
+		previous.Close()
+		c.cache.Reset()
+	}
+
+	c.watch(client, config)
+	c.client.Store(client)
+
+	c.mu.Lock()
+	c.lastErr = nil
+	c.retryAt = time.Time{}
+	c.mu.Unlock()
+
+	log.Println("connected to cluster", c.Name, restConfig.Host)
+	return nil
+}
+
+func (c *Cluster) Status() ClusterStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	status := ClusterStatus{
+		Name:      c.Name,
+		Connected: c.Client() != nil,
+		Leader:    c.leading.Load(),
+	}
+	if c.lastErr != nil {
+		status.Error = c.lastErr.Error()
+	}
+	if !c.retryAt.IsZero() {
+		status.RetryAt = c.retryAt.UTC().Format(time.RFC3339)
+	}
+	return status
+}
+
+// retryAfter returns the number of seconds until the next connection attempt.
+func (c *Cluster) retryAfter() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	seconds := int(math.Ceil(time.Until(c.retryAt).Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	return seconds
+}
+
+// discover refreshes the capabilities of the client and starts watching core resources once they are served. When
+// discovery fails the previous capabilities are kept.
+func (c *Cluster) discover(client *AetoClient, config Config) {
+	added, err := client.capabilities.Discover(client.discovery)
+	if err != nil {
+		log.Println("failed to discover api groups in cluster", c.Name, err)
+	}
+	c.logServed(added)
+	c.watch(client, config)
+}
+
+func (c *Cluster) logServed(added []schema.GroupVersion) {
+	for _, gv := range added {
+		log.Println("cluster", c.Name, "serves", gv.String())
+	}
+}
+
+func (c *Cluster) watch(client *AetoClient, config Config) {
+	if client.Serves(corev1alpha1.GroupVersion) && client.watching.CompareAndSwap(false, true) {
+		if err := client.CoreV1Alpha1(config.Namespaces.Operator).Watch(); err != nil {
+			log.Println("failed to watch resources in cluster", c.Name, err)
+			client.watching.Store(false)
+		}
+	}
+}
+
+// usesKubeconfig returns true when the cluster connects using the local kubeconfig file.
+func (c *Cluster) usesKubeconfig(config Config) bool {
+	return c.config.Secret == nil && !config.Kubernetes.InCluster
+}
+
+func findCluster(clusters []*Cluster, name string) *Cluster {
+	for _, c := range clusters {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// withCluster makes the cluster named by the {cluster} url parameter available to handlers. When the route has no
+// such parameter the first configured cluster is used. Requests for a cluster that is not yet connected are answered
+// with 503 and a hint of when to retry.
+func withCluster(s *Server) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			clusters := s.clusters
+			cluster := clusters[0]
+			if name := chi.URLParam(req, "cluster"); name != "" {
+				cluster = findCluster(clusters, name)
+			}
+			if cluster == nil {
+				w.WriteHeader(404)
+				return
+			}
+			auditRecordFrom(req).Target.Cluster = cluster.Name
+			if cluster.Client() == nil {
+				w.Header().Set("Retry-After", strconv.Itoa(cluster.retryAfter()))
+				writeError(w, 503, fmt.Sprintf("not yet connected to cluster %s", cluster.Name))
+				return
+			}
+			next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), clusterContextKey, cluster)))
+		})
+	}
+}
+
+func clusterFrom(req *http.Request) *Cluster {
+	return req.Context().Value(clusterContextKey).(*Cluster)
+}
@@ -0,0 +1,937 @@
+package server
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	redactedValue = "*****"
+)
+
+type Config struct {
+	Listen     string           `json:"listen"`
+	TLS        TLSConfig        `json:"tls"`
+	Kubernetes KubernetesConfig `json:"kubernetes"`
+	Namespaces NamespacesConfig `json:"namespaces"`
+	Retention  RetentionConfig  `json:"retention"`
+	Features   FeaturesConfig   `json:"features"`
+	Auth       AuthConfig       `json:"auth"`
+	Audit      AuditConfig      `json:"audit"`
+	Redaction  RedactionConfig  `json:"redaction"`
+	Security   SecurityConfig   `json:"security"`
+	RateLimit  RateLimitConfig  `json:"rateLimit"`
+	Expiry     ExpiryConfig     `json:"expiry"`
+	Leader     LeaderConfig     `json:"leaderElection"`
+	Scheduler  SchedulerConfig  `json:"scheduler"`
+	Migrations MigrationsConfig `json:"migrations"`
+}
+
+// LeaderConfig makes one replica per cluster, holding a lease in the operator namespace, run scheduled actions and
+// migrations, delete expired tenants and restore the schedule of savings policies once an override applying savings has
+// expired. When disabled every replica acts as the leader.
+type LeaderConfig struct {
+	Enabled bool   `json:"enabled"`
+	Lease   string `json:"lease"`
+}
+
+// SchedulerConfig enables running one-off actions at a later time. Schedules are persisted in a config map in the
+// operator namespace of every cluster and finished schedules are kept for the retention.
+type SchedulerConfig struct {
+	Enabled   bool     `json:"enabled"`
+	ConfigMap string   `json:"configMap"`
+	Retention Duration `json:"retention"`
+}
+
+// MigrationsConfig names the config map in the operator namespace of every cluster that blueprint migrations are
+// persisted in, they are run by the leader of the cluster.
+type MigrationsConfig struct {
+	ConfigMap string `json:"configMap"`
+}
+
+// ExpiryConfig enables deleting tenants annotated with an expiry once expired. Tenants are notified with an event when
+// the grace period before their expiry starts and are never deleted before a full grace period has passed since.
+type ExpiryConfig struct {
+	Enabled     bool     `json:"enabled"`
+	GracePeriod Duration `json:"gracePeriod"`
+}
+
+// RateLimitConfig limits api requests per client with token buckets. Every request takes a token from the api bucket
+// while requests bypassing the cache also take a token from the stricter direct bucket. Anonymous clients are told apart
+// by the address they connect from, or by the forwarded address when connecting through one of the trusted proxies.
+type RateLimitConfig struct {
+	Enabled        bool                  `json:"enabled"`
+	API            RateLimitBucketConfig `json:"api"`
+	Direct         RateLimitBucketConfig `json:"direct"`
+	TrustedProxies []string              `json:"trustedProxies,omitempty"`
+}
+
+// RateLimitBucketConfig is a token bucket refilled with rate tokens per second holding at most burst tokens.
+type RateLimitBucketConfig struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+// TLSConfig enables serving over https when both files are set.
+type TLSConfig struct {
+	CertFile string `json:"certFile,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty"`
+}
+
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != "" && c.KeyFile != ""
+}
+
+type SecurityConfig struct {
+	Headers SecurityHeadersConfig `json:"headers"`
+	CSRF    CSRFConfig            `json:"csrf"`
+}
+
+type SecurityHeadersConfig struct {
+	Enabled               bool     `json:"enabled"`
+	ContentSecurityPolicy string   `json:"contentSecurityPolicy"`
+	FrameOptions          string   `json:"frameOptions"`
+	ReferrerPolicy        string   `json:"referrerPolicy"`
+	HSTSMaxAge            Duration `json:"hstsMaxAge"`
+}
+
+type CSRFConfig struct {
+	Enabled    bool   `json:"enabled"`
+	CookieName string `json:"cookieName"`
+	HeaderName string `json:"headerName"`
+}
+
+type KubernetesConfig struct {
+	InCluster  bool            `json:"inCluster"`
+	Kubeconfig string          `json:"kubeconfig,omitempty"`
+	Context    string          `json:"context,omitempty"`
+	Clusters   []ClusterConfig `json:"clusters,omitempty"`
+}
+
+// ClusterConfig describes a cluster to connect to. Clusters are reached through the kubernetes configuration above,
+// optionally using a specific kubeconfig context, or through a kubeconfig stored in a secret. Clusters without a
+// context use kubernetes.context, or the current context of the kubeconfig when that is empty too.
+type ClusterConfig struct {
+	Name    string     `json:"name"`
+	Context string     `json:"context,omitempty"`
+	Secret  *SecretRef `json:"secret,omitempty"`
+}
+
+type SecretRef struct {
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+	Key       string `json:"key,omitempty"`
+}
+
+const (
+	DefaultClusterName      = "default"
+	defaultKubeconfigSecret = "kubeconfig"
+)
+
+var clusterNameExpr = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+// ClusterList returns the configured clusters with defaults applied. A single cluster named "default" is returned when
+// no clusters are configured.
+func (c Config) ClusterList() []ClusterConfig {
+	if len(c.Kubernetes.Clusters) == 0 {
+		return []ClusterConfig{{Name: DefaultClusterName}}
+	}
+
+	clusters := make([]ClusterConfig, 0, len(c.Kubernetes.Clusters))
+	for _, cc := range c.Kubernetes.Clusters {
+		if cc.Secret != nil {
+			secret := *cc.Secret
+			if secret.Namespace == "" {
+				secret.Namespace = c.Namespaces.Operator
+			}
+			if secret.Key == "" {
+				secret.Key = defaultKubeconfigSecret
+			}
+			cc.Secret = &secret
+		}
+		clusters = append(clusters, cc)
+	}
+	return clusters
+}
+
+type NamespacesConfig struct {
+	Operator string `json:"operator"`
+}
+
+type RetentionConfig struct {
+	Changes int      `json:"changes"`
+	MaxAge  Duration `json:"maxAge"`
+}
+
+type FeaturesConfig struct {
+	ChangeStream bool `json:"changeStream"`
+}
+
+// AuditConfig controls the audit log of authenticated requests. Records are written as JSON lines to stdout or to a
+// file rotated by size, and the most recent records are kept in memory for /api/audit.
+type AuditConfig struct {
+	Enabled bool            `json:"enabled"`
+	Output  string          `json:"output"`
+	File    AuditFileConfig `json:"file"`
+	Retain  int             `json:"retain"`
+}
+
+type AuditFileConfig struct {
+	Path       string `json:"path"`
+	MaxSize    int    `json:"maxSize"`
+	MaxBackups int    `json:"maxBackups"`
+}
+
+// RedactionConfig controls the masking of sensitive values in api responses. The data and stringData of Secrets are
+// always masked, annotations are masked when their key matches any of the regular expressions and paths are masked in
+// every resource, or only in resources of the given type. Paths are separated by dots and * matches any key or item,
+// ie spec.parameters.*.default.
+type RedactionConfig struct {
+	Enabled     bool            `json:"enabled"`
+	Annotations []string        `json:"annotations"`
+	Paths       []RedactionPath `json:"paths,omitempty"`
+}
+
+type RedactionPath struct {
+	Resource string `json:"resource,omitempty"`
+	Path     string `json:"path"`
+}
+
+type AuthConfig struct {
+	Mode          string            `json:"mode"`
+	Impersonate   bool              `json:"impersonate"`
+	OIDC          OIDCConfig        `json:"oidc"`
+	Session       SessionConfig     `json:"session"`
+	TokenReview   TokenReviewConfig `json:"tokenReview"`
+	APIKeys       APIKeysConfig     `json:"apiKeys"`
+	Roles         RolesConfig       `json:"roles"`
+	DefaultRole   string            `json:"defaultRole"`
+	AnonymousRole string            `json:"anonymousRole"`
+}
+
+// RolesConfig maps groups to roles. Users in several groups get the role with the most permissions.
+type RolesConfig struct {
+	Viewer   []string `json:"viewer,omitempty"`
+	Operator []string `json:"operator,omitempty"`
+	Admin    []string `json:"admin,omitempty"`
+}
+
+type OIDCConfig struct {
+	IssuerURL     string   `json:"issuerURL,omitempty"`
+	ClientID      string   `json:"clientID,omitempty"`
+	ClientSecret  string   `json:"clientSecret,omitempty" redact:"true"`
+	RedirectURL   string   `json:"redirectURL,omitempty"`
+	Scopes        []string `json:"scopes"`
+	UsernameClaim string   `json:"usernameClaim"`
+	GroupsClaim   string   `json:"groupsClaim"`
+	AllowedGroups []string `json:"allowedGroups,omitempty"`
+}
+
+// SessionConfig configures the session cookie. Cookies are marked secure when the request arrived over https, directly
+// or through a proxy setting X-Forwarded-Proto, and always when Secure is set.
+type SessionConfig struct {
+	CookieName string   `json:"cookieName"`
+	TTL        Duration `json:"ttl"`
+	Secure     bool     `json:"secure"`
+}
+
+// TokenReviewConfig enables bearer token authentication for automation. Tokens are validated by the TokenReview api
+// of a cluster, the first cluster unless configured otherwise.
+type TokenReviewConfig struct {
+	Enabled   bool     `json:"enabled"`
+	Cluster   string   `json:"cluster,omitempty"`
+	Audiences []string `json:"audiences,omitempty"`
+}
+
+// APIKeysConfig enables api keys for headless clients. Keys are minted by admins and stored hashed in a secret in the
+// operator namespace of the first cluster.
+type APIKeysConfig struct {
+	Enabled bool   `json:"enabled"`
+	Secret  string `json:"secret"`
+}
+
+const (
+	AuthModeNone = "none"
+	AuthModeOIDC = "oidc"
+)
+
+// Duration is a time.Duration that is read from and written to configuration as a string, ie "1h30m".
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string, ie \"30s\" or \"1h\"")
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Listen: ":9000",
+		Namespaces: NamespacesConfig{
+			Operator: "aeto",
+		},
+		Retention: RetentionConfig{
+			Changes: 10,
+			MaxAge:  Duration{24 * time.Hour},
+		},
+		Features: FeaturesConfig{
+			ChangeStream: true,
+		},
+		Auth: AuthConfig{
+			Mode: AuthModeNone,
+			OIDC: OIDCConfig{
+				Scopes:        []string{"openid", "profile", "email", "groups"},
+				UsernameClaim: "email",
+				GroupsClaim:   "groups",
+			},
+			Session: SessionConfig{
+				CookieName: "aeto-web-session",
+				TTL:        Duration{12 * time.Hour},
+			},
+			APIKeys: APIKeysConfig{
+				Secret: "aeto-web-api-keys",
+			},
+			DefaultRole:   RoleViewer,
+			AnonymousRole: RoleViewer,
+		},
+		Audit: AuditConfig{
+			Enabled: true,
+			Output:  AuditOutputStdout,
+			File: AuditFileConfig{
+				Path:       "aeto-web-audit.log",
+				MaxSize:    100,
+				MaxBackups: 5,
+			},
+			Retain: 1000,
+		},
+		Security: SecurityConfig{
+			Headers: SecurityHeadersConfig{
+				Enabled: true,
+				ContentSecurityPolicy: strings.Join([]string{
+					"default-src 'self'",
+					"script-src 'self'",
+					"style-src 'self' 'unsafe-inline' https://fonts.googleapis.com https://cdnjs.cloudflare.com",
+					"font-src 'self' https://fonts.gstatic.com",
+					"img-src 'self' data:",
+					"connect-src 'self'",
+					"frame-ancestors 'none'",
+					"base-uri 'self'",
+				}, "; "),
+				FrameOptions:   "DENY",
+				ReferrerPolicy: "strict-origin-when-cross-origin",
+				HSTSMaxAge:     Duration{365 * 24 * time.Hour},
+			},
+			CSRF: CSRFConfig{
+				Enabled:    true,
+				CookieName: "aeto-web-csrf",
+				HeaderName: "X-CSRF-Token",
+			},
+		},
+		RateLimit: RateLimitConfig{
+			Enabled: true,
+			API: RateLimitBucketConfig{
+				Rate:  20,
+				Burst: 50,
+			},
+			Direct: RateLimitBucketConfig{
+				Rate:  2,
+				Burst: 10,
+			},
+		},
+		Expiry: ExpiryConfig{
+			GracePeriod: Duration{24 * time.Hour},
+		},
+		Leader: LeaderConfig{
+			Enabled: true,
+			Lease:   "aeto-web-leader",
+		},
+		Scheduler: SchedulerConfig{
+			Enabled:   true,
+			ConfigMap: "aeto-web-schedules",
+			Retention: Duration{7 * 24 * time.Hour},
+		},
+		Migrations: MigrationsConfig{
+			ConfigMap: "aeto-web-migrations",
+		},
+		Redaction: RedactionConfig{
+			Enabled: true,
+			Annotations: []string{
+				`^kubectl\.kubernetes\.io/last-applied-configuration$`,
+				`(?i)(password|passwd|secret|token|credential|private-?key|api-?key)`,
+			},
+		},
+	}
+}
+
+// ConfigError holds all problems found when validating a Config.
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return "invalid configuration:\n  - " + strings.Join(e.Problems, "\n  - ")
+}
+
+func (c Config) Validate() error {
+	problems := make([]string, 0)
+
+	if c.Listen == "" {
+		problems = append(problems, "listen: must not be empty")
+	} else if i := strings.LastIndex(c.Listen, ":"); i == -1 {
+		problems = append(problems, fmt.Sprintf("listen: %q must be in the form [host]:port", c.Listen))
+	} else if port, err := strconv.Atoi(c.Listen[i+1:]); err != nil || port < 0 || port > 65535 {
+		problems = append(problems, fmt.Sprintf("listen: %q does not contain a valid port", c.Listen))
+	}
+
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		problems = append(problems, "tls: certFile and keyFile must both be set to enable tls")
+	}
+
+	if c.Kubernetes.InCluster && c.Kubernetes.Kubeconfig != "" {
+		problems = append(problems, "kubernetes: inCluster and kubeconfig are mutually exclusive")
+	}
+	if c.Kubernetes.InCluster && c.Kubernetes.Context != "" {
+		problems = append(problems, "kubernetes: inCluster and context are mutually exclusive")
+	}
+
+	names := make(map[string]bool)
+	for i, cc := range c.Kubernetes.Clusters {
+		field := fmt.Sprintf("kubernetes.clusters[%d]", i)
+		if !clusterNameExpr.MatchString(cc.Name) {
+			problems = append(problems, fmt.Sprintf("%s.name: %q must consist of lower case alphanumeric characters or '-'", field, cc.Name))
+		}
+		if names[cc.Name] {
+			problems = append(problems, fmt.Sprintf("%s.name: %q is not unique", field, cc.Name))
+		}
+		names[cc.Name] = true
+		if cc.Secret != nil && cc.Secret.Name == "" {
+			problems = append(problems, fmt.Sprintf("%s.secret.name: must not be empty", field))
+		}
+		if cc.Secret == nil && cc.Context != "" && c.Kubernetes.InCluster {
+			problems = append(problems, fmt.Sprintf("%s.context: can not be used with kubernetes.inCluster unless a secret is set", field))
+		}
+	}
+
+	if c.Namespaces.Operator == "" {
+		problems = append(problems, "namespaces.operator: must not be empty")
+	}
+
+	if c.Retention.Changes < 1 {
+		problems = append(problems, fmt.Sprintf("retention.changes: must be greater than 0, was %d", c.Retention.Changes))
+	}
+	if c.Retention.MaxAge.Duration < 0 {
+		problems = append(problems, fmt.Sprintf("retention.maxAge: must not be negative, was %s", c.Retention.MaxAge))
+	}
+
+	switch c.Auth.Mode {
+	case AuthModeNone:
+	case AuthModeOIDC:
+		oidc := c.Auth.OIDC
+		if oidc.IssuerURL == "" {
+			problems = append(problems, "auth.oidc.issuerURL: must not be empty")
+		} else if u, err := url.Parse(oidc.IssuerURL); err != nil || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("auth.oidc.issuerURL: %q is not a valid url", oidc.IssuerURL))
+		}
+		if oidc.ClientID == "" {
+			problems = append(problems, "auth.oidc.clientID: must not be empty")
+		}
+		if oidc.ClientSecret == "" {
+			problems = append(problems, "auth.oidc.clientSecret: must not be empty")
+		}
+		if u, err := url.Parse(oidc.RedirectURL); err != nil || u.Host == "" || u.Path != oidcCallbackPath {
+			problems = append(problems, fmt.Sprintf("auth.oidc.redirectURL: %q must be an absolute url ending with %s", oidc.RedirectURL, oidcCallbackPath))
+		} else if u.Scheme == "http" && c.Auth.Session.Secure {
+			problems = append(problems, fmt.Sprintf("auth.session.secure: browsers never send secure cookies over http, the redirectURL %q is not https", oidc.RedirectURL))
+		}
+		if oidc.UsernameClaim == "" {
+			problems = append(problems, "auth.oidc.usernameClaim: must not be empty")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("auth.mode: unsupported mode %q, must be one of [%s]", c.Auth.Mode, strings.Join([]string{AuthModeNone, AuthModeOIDC}, ", ")))
+	}
+
+	if c.Auth.Impersonate && c.Auth.Mode == AuthModeNone {
+		problems = append(problems, "auth.impersonate: requires an auth.mode other than none")
+	}
+	if name := c.Auth.TokenReview.Cluster; name != "" {
+		found := false
+		for _, cc := range c.ClusterList() {
+			found = found || cc.Name == name
+		}
+		if !found {
+			problems = append(problems, fmt.Sprintf("auth.tokenReview.cluster: unknown cluster %q", name))
+		}
+	}
+	if c.Auth.APIKeys.Enabled && c.Auth.Mode == AuthModeNone {
+		problems = append(problems, "auth.apiKeys.enabled: requires an auth.mode other than none")
+	}
+	if c.Auth.APIKeys.Enabled && c.Auth.APIKeys.Secret == "" {
+		problems = append(problems, "auth.apiKeys.secret: must not be empty")
+	}
+	for i, role := range []string{c.Auth.DefaultRole, c.Auth.AnonymousRole} {
+		if role != "" && roleRank(role) == 0 {
+			field := []string{"defaultRole", "anonymousRole"}[i]
+			problems = append(problems, fmt.Sprintf("auth.%s: unknown role %q, must be empty or one of [%s]", field, role, strings.Join(roles, ", ")))
+		}
+	}
+	switch c.Audit.Output {
+	case AuditOutputStdout:
+	case AuditOutputFile:
+		if c.Audit.File.Path == "" {
+			problems = append(problems, "audit.file.path: must not be empty")
+		}
+		if c.Audit.File.MaxSize < 1 {
+			problems = append(problems, fmt.Sprintf("audit.file.maxSize: must be at least 1 (megabytes), was %d", c.Audit.File.MaxSize))
+		}
+		if c.Audit.File.MaxBackups < 0 {
+			problems = append(problems, fmt.Sprintf("audit.file.maxBackups: must not be negative, was %d", c.Audit.File.MaxBackups))
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("audit.output: unsupported output %q, must be one of [%s]", c.Audit.Output, strings.Join([]string{AuditOutputStdout, AuditOutputFile}, ", ")))
+	}
+	if c.Audit.Retain < 0 {
+		problems = append(problems, fmt.Sprintf("audit.retain: must not be negative, was %d", c.Audit.Retain))
+	}
+	for i, a := range c.Redaction.Annotations {
+		if _, err := regexp.Compile(a); err != nil {
+			problems = append(problems, fmt.Sprintf("redaction.annotations[%d]: %q is not a valid regular expression, %s", i, a, err))
+		}
+	}
+	for i, p := range c.Redaction.Paths {
+		if p.Path == "" || strings.Contains(p.Path, "..") || strings.HasPrefix(p.Path, ".") || strings.HasSuffix(p.Path, ".") {
+			problems = append(problems, fmt.Sprintf("redaction.paths[%d].path: %q must be dot separated keys, ie spec.parameters.*.default", i, p.Path))
+		}
+	}
+	if c.Security.CSRF.Enabled && (c.Security.CSRF.CookieName == "" || c.Security.CSRF.HeaderName == "") {
+		problems = append(problems, "security.csrf: cookieName and headerName must not be empty")
+	}
+	if c.Security.CSRF.Enabled && c.Security.CSRF.CookieName == c.Auth.Session.CookieName {
+		problems = append(problems, "security.csrf.cookieName: must not be the same as auth.session.cookieName")
+	}
+	if c.Security.Headers.HSTSMaxAge.Duration < 0 {
+		problems = append(problems, "security.headers.hstsMaxAge: must not be negative")
+	}
+	for i, b := range []RateLimitBucketConfig{c.RateLimit.API, c.RateLimit.Direct} {
+		if c.RateLimit.Enabled && (b.Rate <= 0 || b.Burst < 1) {
+			name := []string{RateLimitBucketAPI, RateLimitBucketDirect}[i]
+			problems = append(problems, fmt.Sprintf("rateLimit.%s: rate must be positive and burst at least 1, was %v and %d", name, b.Rate, b.Burst))
+		}
+	}
+	for _, cidr := range c.RateLimit.TrustedProxies {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			problems = append(problems, fmt.Sprintf("rateLimit.trustedProxies: %q is not a valid cidr", cidr))
+		}
+	}
+	if c.Expiry.GracePeriod.Duration < 0 {
+		problems = append(problems, fmt.Sprintf("expiry.gracePeriod: must not be negative, was %s", c.Expiry.GracePeriod))
+	}
+	if c.Leader.Enabled && c.Leader.Lease == "" {
+		problems = append(problems, "leaderElection.lease: must not be empty")
+	}
+	if c.Scheduler.Enabled && c.Scheduler.ConfigMap == "" {
+		problems = append(problems, "scheduler.configMap: must not be empty")
+	}
+	if c.Scheduler.Retention.Duration < 0 {
+		problems = append(problems, fmt.Sprintf("scheduler.retention: must not be negative, was %s", c.Scheduler.Retention))
+	}
+	if c.Migrations.ConfigMap == "" {
+		problems = append(problems, "migrations.configMap: must not be empty")
+	}
+	if c.Auth.Session.CookieName == "" {
+		problems = append(problems, "auth.session.cookieName: must not be empty")
+	}
+	if c.Auth.Session.TTL.Duration < time.Minute {
+		problems = append(problems, fmt.Sprintf("auth.session.ttl: must be at least 1m, was %s", c.Auth.Session.TTL))
+	}
+
+	if len(problems) > 0 {
+		return &ConfigError{Problems: problems}
+	}
+	return nil
+}
+
+// Changed returns the json names of the top level sections that differ from other.
+func (c Config) Changed(other Config) []string {
+	changed := make([]string, 0)
+	a, b := reflect.ValueOf(c), reflect.ValueOf(other)
+	for i := 0; i < a.NumField(); i++ {
+		if !reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+			changed = append(changed, strings.Split(a.Type().Field(i).Tag.Get("json"), ",")[0])
+		}
+	}
+	return changed
+}
+
+// Redacted returns a copy of the configuration where all fields tagged with `redact:"true"` are masked.
+func (c Config) Redacted() Config {
+	redact(reflect.ValueOf(&c).Elem())
+	return c
+}
+
+func redact(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Field(i)
+			if !f.CanSet() {
+				continue
+			}
+			if v.Type().Field(i).Tag.Get("redact") == "true" && f.Kind() == reflect.String {
+				if f.String() != "" {
+					f.SetString(redactedValue)
+				}
+				continue
+			}
+			redact(f)
+		}
+	case reflect.Slice:
+		if v.IsNil() {
+			return
+		}
+		c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		reflect.Copy(c, v)
+		for i := 0; i < c.Len(); i++ {
+			redact(c.Index(i))
+		}
+		v.Set(c)
+	case reflect.Pointer:
+		if v.IsNil() {
+			return
+		}
+		c := reflect.New(v.Elem().Type())
+		c.Elem().Set(v.Elem())
+		redact(c.Elem())
+		v.Set(c)
+	}
+}
+
+// configOption is a configuration value that may be overridden by an environment variable and a command line flag.
+// Flags take precedence over environment variables which take precedence over the configuration file.
+type configOption struct {
+	flag  string
+	env   string
+	usage string
+	set   func(c *Config, value string) error
+}
+
+var configOptions = []configOption{
+	{
+		flag: "listen", env: "AETO_WEB_LISTEN", usage: "address to listen on, ie :9000",
+		set: func(c *Config, v string) error {
+			c.Listen = v
+			return nil
+		},
+	},
+	{
+		flag: "tls-cert-file", env: "AETO_WEB_TLS_CERT_FILE", usage: "certificate to serve https with",
+		set: func(c *Config, v string) error {
+			c.TLS.CertFile = v
+			return nil
+		},
+	},
+	{
+		flag: "tls-key-file", env: "AETO_WEB_TLS_KEY_FILE", usage: "private key to serve https with",
+		set: func(c *Config, v string) error {
+			c.TLS.KeyFile = v
+			return nil
+		},
+	},
+	{
+		flag: "in-cluster", env: "K8S_INCLUSTERCONFIG", usage: "use the in-cluster kubernetes configuration",
+		set: func(c *Config, v string) (err error) {
+			c.Kubernetes.InCluster, err = strconv.ParseBool(v)
+			return
+		},
+	},
+	{
+		flag: "kubeconfig", env: "KUBECONFIG", usage: "path to the kubeconfig file",
+		set: func(c *Config, v string) error {
+			c.Kubernetes.Kubeconfig = v
+			return nil
+		},
+	},
+	{
+		flag: "context", env: "AETO_WEB_KUBE_CONTEXT", usage: "kubeconfig context to use instead of the current context",
+		set: func(c *Config, v string) error {
+			c.Kubernetes.Context = v
+			return nil
+		},
+	},
+	{
+		flag: "operator-namespace", env: "AETO_WEB_OPERATOR_NAMESPACE", usage: "namespace of the aeto operator",
+		set: func(c *Config, v string) error {
+			c.Namespaces.Operator = v
+			return nil
+		},
+	},
+	{
+		flag: "retention-changes", env: "AETO_WEB_RETENTION_CHANGES", usage: "number of resource changes to keep in memory",
+		set: func(c *Config, v string) (err error) {
+			c.Retention.Changes, err = strconv.Atoi(v)
+			return
+		},
+	},
+	{
+		flag: "retention-max-age", env: "AETO_WEB_RETENTION_MAX_AGE", usage: "max age of resource changes kept in memory, ie 24h",
+		set: func(c *Config, v string) (err error) {
+			c.Retention.MaxAge.Duration, err = time.ParseDuration(v)
+			return
+		},
+	},
+	{
+		flag: "feature-changestream", env: "AETO_WEB_FEATURE_CHANGESTREAM", usage: "record resource changes for the dashboard",
+		set: func(c *Config, v string) (err error) {
+			c.Features.ChangeStream, err = strconv.ParseBool(v)
+			return
+		},
+	},
+	{
+		flag: "auth-mode", env: "AETO_WEB_AUTH_MODE", usage: "authentication mode, none or oidc",
+		set: func(c *Config, v string) error {
+			c.Auth.Mode = v
+			return nil
+		},
+	},
+	{
+		flag: "auth-impersonate", env: "AETO_WEB_AUTH_IMPERSONATE", usage: "impersonate the authenticated user so that cluster RBAC applies",
+		set: func(c *Config, v string) (err error) {
+			c.Auth.Impersonate, err = strconv.ParseBool(v)
+			return
+		},
+	},
+	{
+		flag: "oidc-issuer-url", env: "AETO_WEB_OIDC_ISSUER_URL", usage: "url of the OIDC issuer",
+		set: func(c *Config, v string) error {
+			c.Auth.OIDC.IssuerURL = v
+			return nil
+		},
+	},
+	{
+		flag: "oidc-client-id", env: "AETO_WEB_OIDC_CLIENT_ID", usage: "OIDC client id",
+		set: func(c *Config, v string) error {
+			c.Auth.OIDC.ClientID = v
+			return nil
+		},
+	},
+	{
+		flag: "oidc-client-secret", env: "AETO_WEB_OIDC_CLIENT_SECRET", usage: "OIDC client secret, prefer the environment variable",
+		set: func(c *Config, v string) error {
+			c.Auth.OIDC.ClientSecret = v
+			return nil
+		},
+	},
+	{
+		flag: "oidc-redirect-url", env: "AETO_WEB_OIDC_REDIRECT_URL", usage: "OIDC redirect url, ie https://aeto.example.com" + oidcCallbackPath,
+		set: func(c *Config, v string) error {
+			c.Auth.OIDC.RedirectURL = v
+			return nil
+		},
+	},
+	{
+		flag: "auth-token-review", env: "AETO_WEB_AUTH_TOKEN_REVIEW", usage: "accept bearer tokens validated with the TokenReview api",
+		set: func(c *Config, v string) (err error) {
+			c.Auth.TokenReview.Enabled, err = strconv.ParseBool(v)
+			return
+		},
+	},
+	{
+		flag: "auth-api-keys", env: "AETO_WEB_AUTH_API_KEYS", usage: "accept api keys minted by admins",
+		set: func(c *Config, v string) (err error) {
+			c.Auth.APIKeys.Enabled, err = strconv.ParseBool(v)
+			return
+		},
+	},
+	{
+		flag: "auth-default-role", env: "AETO_WEB_AUTH_DEFAULT_ROLE", usage: "role of authenticated users not in any role group, empty denies access",
+		set: func(c *Config, v string) error {
+			c.Auth.DefaultRole = v
+			return nil
+		},
+	},
+	{
+		flag: "auth-anonymous-role", env: "AETO_WEB_AUTH_ANONYMOUS_ROLE", usage: "role of unauthenticated users with auth mode none, empty denies access",
+		set: func(c *Config, v string) error {
+			c.Auth.AnonymousRole = v
+			return nil
+		},
+	},
+	{
+		flag: "audit", env: "AETO_WEB_AUDIT", usage: "record authenticated requests in the audit log",
+		set: func(c *Config, v string) (err error) {
+			c.Audit.Enabled, err = strconv.ParseBool(v)
+			return
+		},
+	},
+	{
+		flag: "audit-output", env: "AETO_WEB_AUDIT_OUTPUT", usage: "where to write audit records, stdout or file",
+		set: func(c *Config, v string) error {
+			c.Audit.Output = v
+			return nil
+		},
+	},
+	{
+		flag: "audit-file", env: "AETO_WEB_AUDIT_FILE", usage: "path of the audit log file when output is file",
+		set: func(c *Config, v string) error {
+			c.Audit.File.Path = v
+			return nil
+		},
+	},
+	{
+		flag: "redaction", env: "AETO_WEB_REDACTION", usage: "mask secrets and sensitive values in api responses",
+		set: func(c *Config, v string) (err error) {
+			c.Redaction.Enabled, err = strconv.ParseBool(v)
+			return
+		},
+	},
+	{
+		flag: "csrf", env: "AETO_WEB_CSRF", usage: "require CSRF tokens for api requests changing anything",
+		set: func(c *Config, v string) (err error) {
+			c.Security.CSRF.Enabled, err = strconv.ParseBool(v)
+			return
+		},
+	},
+	{
+		flag: "rate-limit", env: "AETO_WEB_RATE_LIMIT", usage: "limit the rate of api requests per client",
+		set: func(c *Config, v string) (err error) {
+			c.RateLimit.Enabled, err = strconv.ParseBool(v)
+			return
+		},
+	},
+	{
+		flag: "expiry", env: "AETO_WEB_EXPIRY", usage: "delete tenants once their expiry has passed",
+		set: func(c *Config, v string) (err error) {
+			c.Expiry.Enabled, err = strconv.ParseBool(v)
+			return
+		},
+	},
+	{
+		flag: "expiry-grace-period", env: "AETO_WEB_EXPIRY_GRACE_PERIOD", usage: "time between notifying and deleting expired tenants, ie 24h",
+		set: func(c *Config, v string) (err error) {
+			c.Expiry.GracePeriod.Duration, err = time.ParseDuration(v)
+			return
+		},
+	},
+	{
+		flag: "leader-election", env: "AETO_WEB_LEADER_ELECTION", usage: "elect a single replica per cluster to run scheduled actions, migrations and expiry",
+		set: func(c *Config, v string) (err error) {
+			c.Leader.Enabled, err = strconv.ParseBool(v)
+			return
+		},
+	},
+	{
+		flag: "scheduler", env: "AETO_WEB_SCHEDULER", usage: "run scheduled actions",
+		set: func(c *Config, v string) (err error) {
+			c.Scheduler.Enabled, err = strconv.ParseBool(v)
+			return
+		},
+	},
+	{
+		flag: "session-secure", env: "AETO_WEB_SESSION_SECURE", usage: "always mark cookies secure, even for requests not known to arrive over https",
+		set: func(c *Config, v string) (err error) {
+			c.Auth.Session.Secure, err = strconv.ParseBool(v)
+			return
+		},
+	},
+}
+
+// ConfigLoader loads the configuration from defaults, an optional configuration file, environment variables and flags.
+// The loader remembers the flags it was created with so that the configuration can be reloaded with the same overrides.
+type ConfigLoader struct {
+	Path  string
+	flags map[string]string
+}
+
+func NewConfigLoader(args []string, output io.Writer) (*ConfigLoader, error) {
+	fs := flag.NewFlagSet("aeto-web", flag.ContinueOnError)
+	fs.SetOutput(output)
+
+	path := fs.String("config", os.Getenv("AETO_WEB_CONFIG"), "path to the configuration file (env AETO_WEB_CONFIG)")
+	values := make(map[string]*string)
+	for _, o := range configOptions {
+		values[o.flag] = fs.String(o.flag, "", fmt.Sprintf("%s (env %s)", o.usage, o.env))
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	loader := &ConfigLoader{
+		Path:  *path,
+		flags: make(map[string]string),
+	}
+	fs.Visit(func(f *flag.Flag) {
+		if v, ok := values[f.Name]; ok {
+			loader.flags[f.Name] = *v
+		}
+	})
+	return loader, nil
+}
+
+func (l *ConfigLoader) Load() (Config, error) {
+	config := DefaultConfig()
+
+	if l.Path != "" {
+		data, err := os.ReadFile(l.Path)
+		if err != nil {
+			return config, fmt.Errorf("failed to read configuration file, %w", err)
+		}
+		if err := yaml.UnmarshalStrict(data, &config); err != nil {
+			return config, fmt.Errorf("failed to parse configuration file %s, %w", l.Path, err)
+		}
+	}
+
+	problems := make([]string, 0)
+	for _, o := range configOptions {
+		if v := os.Getenv(o.env); v != "" {
+			if err := o.set(&config, v); err != nil {
+				problems = append(problems, fmt.Sprintf("env %s: %s", o.env, err))
+			}
+		}
+		if v, ok := l.flags[o.flag]; ok {
+			if err := o.set(&config, v); err != nil {
+				problems = append(problems, fmt.Sprintf("flag --%s: %s", o.flag, err))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return config, &ConfigError{Problems: problems}
+	}
+
+	return config, config.Validate()
+}
+
+func modTime(path string) time.Time {
+	if path == "" {
+		return time.Time{}
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return stat.ModTime()
+}
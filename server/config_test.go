@@ -0,0 +1,340 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func oidcConfig(c *Config) {
+	c.Auth.Mode = AuthModeOIDC
+	c.Auth.OIDC.IssuerURL = "https://login.example.com"
+	c.Auth.OIDC.ClientID = "aeto-web"
+	c.Auth.OIDC.ClientSecret = "secret"
+	c.Auth.OIDC.RedirectURL = "https://aeto.example.com" + oidcCallbackPath
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(c *Config)
+		problem string
+	}{
+		{
+			name:   "defaults",
+			modify: func(c *Config) {},
+		},
+		{
+			name:    "empty listen",
+			modify:  func(c *Config) { c.Listen = "" },
+			problem: "listen: must not be empty",
+		},
+		{
+			name:    "listen without port",
+			modify:  func(c *Config) { c.Listen = "localhost" },
+			problem: "must be in the form [host]:port",
+		},
+		{
+			name:    "listen with invalid port",
+			modify:  func(c *Config) { c.Listen = ":70000" },
+			problem: "does not contain a valid port",
+		},
+		{
+			name:    "tls without key",
+			modify:  func(c *Config) { c.TLS.CertFile = "tls.crt" },
+			problem: "tls: certFile and keyFile must both be set",
+		},
+		{
+			name: "in cluster with kubeconfig",
+			modify: func(c *Config) {
+				c.Kubernetes.InCluster = true
+				c.Kubernetes.Kubeconfig = "~/.kube/config"
+			},
+			problem: "inCluster and kubeconfig are mutually exclusive",
+		},
+		{
+			name: "duplicate cluster names",
+			modify: func(c *Config) {
+				c.Kubernetes.Clusters = []ClusterConfig{{Name: "prod"}, {Name: "prod"}}
+			},
+			problem: `kubernetes.clusters[1].name: "prod" is not unique`,
+		},
+		{
+			name: "invalid cluster name",
+			modify: func(c *Config) {
+				c.Kubernetes.Clusters = []ClusterConfig{{Name: "Prod"}}
+			},
+			problem: "must consist of lower case alphanumeric characters",
+		},
+		{
+			name:   "oidc",
+			modify: oidcConfig,
+		},
+		{
+			name: "oidc without issuer",
+			modify: func(c *Config) {
+				oidcConfig(c)
+				c.Auth.OIDC.IssuerURL = ""
+			},
+			problem: "auth.oidc.issuerURL: must not be empty",
+		},
+		{
+			name: "oidc redirect url not ending with the callback path",
+			modify: func(c *Config) {
+				oidcConfig(c)
+				c.Auth.OIDC.RedirectURL = "https://aeto.example.com/callback"
+			},
+			problem: "auth.oidc.redirectURL",
+		},
+		{
+			name: "oidc over http",
+			modify: func(c *Config) {
+				oidcConfig(c)
+				c.Auth.OIDC.RedirectURL = "http://localhost:9000" + oidcCallbackPath
+			},
+		},
+		{
+			name: "oidc over http with secure cookies",
+			modify: func(c *Config) {
+				oidcConfig(c)
+				c.Auth.OIDC.RedirectURL = "http://localhost:9000" + oidcCallbackPath
+				c.Auth.Session.Secure = true
+			},
+			problem: "auth.session.secure",
+		},
+		{
+			name:    "unsupported auth mode",
+			modify:  func(c *Config) { c.Auth.Mode = "basic" },
+			problem: `auth.mode: unsupported mode "basic"`,
+		},
+		{
+			name:    "impersonate without login",
+			modify:  func(c *Config) { c.Auth.Impersonate = true },
+			problem: "auth.impersonate: requires an auth.mode other than none",
+		},
+		{
+			name:   "token review without login",
+			modify: func(c *Config) { c.Auth.TokenReview.Enabled = true },
+		},
+		{
+			name:    "token review of unknown cluster",
+			modify:  func(c *Config) { c.Auth.TokenReview.Cluster = "prod" },
+			problem: `auth.tokenReview.cluster: unknown cluster "prod"`,
+		},
+		{
+			name:    "unknown anonymous role",
+			modify:  func(c *Config) { c.Auth.AnonymousRole = "root" },
+			problem: `auth.anonymousRole: unknown role "root"`,
+		},
+		{
+			name:   "anonymous users denied",
+			modify: func(c *Config) { c.Auth.AnonymousRole = "" },
+		},
+		{
+			name:    "audit file without path",
+			modify:  func(c *Config) { c.Audit.Output, c.Audit.File.Path = AuditOutputFile, "" },
+			problem: "audit.file.path: must not be empty",
+		},
+		{
+			name:    "invalid redaction annotation",
+			modify:  func(c *Config) { c.Redaction.Annotations = []string{"("} },
+			problem: "redaction.annotations[0]",
+		},
+		{
+			name:    "invalid redaction path",
+			modify:  func(c *Config) { c.Redaction.Paths = []RedactionPath{{Path: "spec..value"}} },
+			problem: "redaction.paths[0].path",
+		},
+		{
+			name:    "csrf cookie named as the session cookie",
+			modify:  func(c *Config) { c.Security.CSRF.CookieName = c.Auth.Session.CookieName },
+			problem: "security.csrf.cookieName: must not be the same as auth.session.cookieName",
+		},
+		{
+			name:    "rate limit without burst",
+			modify:  func(c *Config) { c.RateLimit.Direct.Burst = 0 },
+			problem: "rateLimit.direct: rate must be positive and burst at least 1",
+		},
+		{
+			name:   "rate limit disabled without burst",
+			modify: func(c *Config) { c.RateLimit.Enabled, c.RateLimit.Direct.Burst = false, 0 },
+		},
+		{
+			name:    "invalid trusted proxy",
+			modify:  func(c *Config) { c.RateLimit.TrustedProxies = []string{"10.0.0.1"} },
+			problem: `rateLimit.trustedProxies: "10.0.0.1" is not a valid cidr`,
+		},
+		{
+			name:    "negative expiry grace period",
+			modify:  func(c *Config) { c.Expiry.GracePeriod = Duration{-time.Hour} },
+			problem: "expiry.gracePeriod: must not be negative",
+		},
+		{
+			name:    "leader election without lease",
+			modify:  func(c *Config) { c.Leader.Lease = "" },
+			problem: "leaderElection.lease: must not be empty",
+		},
+		{
+			name:    "short session ttl",
+			modify:  func(c *Config) { c.Auth.Session.TTL = Duration{time.Second} },
+			problem: "auth.session.ttl: must be at least 1m",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := DefaultConfig()
+			tt.modify(&c)
+
+			err := c.Validate()
+			if tt.problem == "" {
+				if err != nil {
+					t.Fatalf("unexpected error %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.problem) {
+				t.Errorf("got error %v, expected it to contain %q", err, tt.problem)
+			}
+		})
+	}
+}
+
+func TestConfigValidateOrder(t *testing.T) {
+	c := DefaultConfig()
+	c.Auth.DefaultRole, c.Auth.AnonymousRole = "root", "guest"
+	want := []string{
+		`auth.defaultRole: unknown role "root", must be empty or one of [viewer, operator, admin]`,
+		`auth.anonymousRole: unknown role "guest", must be empty or one of [viewer, operator, admin]`,
+	}
+
+	for i := 0; i < 10; i++ {
+		err, ok := c.Validate().(*ConfigError)
+		if !ok || !reflect.DeepEqual(err.Problems, want) {
+			t.Fatalf("got problems %v, expected %v", err, want)
+		}
+	}
+}
+
+func TestConfigChanged(t *testing.T) {
+	current := DefaultConfig()
+	next := DefaultConfig()
+	if changed := current.Changed(next); len(changed) != 0 {
+		t.Errorf("got %v, expected no changes", changed)
+	}
+
+	next.RateLimit.API.Burst = 100
+	next.Auth.Roles.Admin = []string{"admins"}
+	next.Leader.Enabled = false
+	next.Migrations.ConfigMap = "migrations"
+	want := []string{"auth", "rateLimit", "leaderElection", "migrations"}
+	if changed := current.Changed(next); !reflect.DeepEqual(changed, want) {
+		t.Errorf("got %v, expected %v", changed, want)
+	}
+}
+
+func TestConfigLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("listen: :8000\nnamespaces:\n  operator: aeto-system\nretention:\n  changes: 10\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("AETO_WEB_OPERATOR_NAMESPACE", "from-env")
+	t.Setenv("AETO_WEB_RETENTION_CHANGES", "20")
+
+	loader, err := NewConfigLoader([]string{"--config", path, "--retention-changes", "30"}, os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := loader.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Listen != ":8000" {
+		t.Errorf("listen is %q, expected the value of the file", c.Listen)
+	}
+	if c.Namespaces.Operator != "from-env" {
+		t.Errorf("operator namespace is %q, expected the env to override the file", c.Namespaces.Operator)
+	}
+	if c.Retention.Changes != 30 {
+		t.Errorf("retention changes is %d, expected the flag to override the env", c.Retention.Changes)
+	}
+	if c.Retention.MaxAge != DefaultConfig().Retention.MaxAge {
+		t.Errorf("retention max age is %s, expected the default", c.Retention.MaxAge)
+	}
+}
+
+func TestConfigLoadInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		args    []string
+		problem string
+	}{
+		{
+			name:    "unknown field",
+			file:    "listen: :8000\nlisten_address: :9000\n",
+			problem: "listen_address",
+		},
+		{
+			name:    "invalid duration",
+			file:    "retention:\n  maxAge: 1 day\n",
+			problem: "failed to parse configuration file",
+		},
+		{
+			name:    "invalid flag value",
+			args:    []string{"--retention-changes", "many"},
+			problem: "flag --retention-changes",
+		},
+		{
+			name:    "invalid configuration",
+			args:    []string{"--listen", ""},
+			problem: "listen: must not be empty",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := tt.args
+			if tt.file != "" {
+				path := filepath.Join(t.TempDir(), "config.yaml")
+				if err := os.WriteFile(path, []byte(tt.file), 0o600); err != nil {
+					t.Fatal(err)
+				}
+				args = append([]string{"--config", path}, args...)
+			}
+
+			loader, err := NewConfigLoader(args, os.Stderr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := loader.Load(); err == nil || !strings.Contains(err.Error(), tt.problem) {
+				t.Errorf("got error %v, expected it to contain %q", err, tt.problem)
+			}
+		})
+	}
+}
+
+func TestConfigRedacted(t *testing.T) {
+	c := DefaultConfig()
+	oidcConfig(&c)
+
+	redacted := c.Redacted()
+	if redacted.Auth.OIDC.ClientSecret != redactedValue {
+		t.Errorf("client secret is %q, expected it to be redacted", redacted.Auth.OIDC.ClientSecret)
+	}
+	if redacted.Auth.OIDC.ClientID != c.Auth.OIDC.ClientID {
+		t.Errorf("client id is %q, expected it to be left as is", redacted.Auth.OIDC.ClientID)
+	}
+	if c.Auth.OIDC.ClientSecret != "secret" {
+		t.Errorf("redacting changed the original configuration")
+	}
+
+	c.Auth.OIDC.ClientSecret = ""
+	if redacted := c.Redacted(); redacted.Auth.OIDC.ClientSecret != "" {
+		t.Errorf("empty client secret is %q, expected it to stay empty", redacted.Auth.OIDC.ClientSecret)
+	}
+}
@@ -0,0 +1,456 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	corev1alpha1 "github.com/kristofferahl/aeto/apis/core/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// expiresAtAnnotation holds the RFC3339 time a tenant expires at
+	expiresAtAnnotation = "web.aeto.net/expires-at"
+	// expiryKeepAnnotation set to true opts a tenant out of being deleted when expired
+	expiryKeepAnnotation = "web.aeto.net/keep"
+	// expiryNotifiedAnnotation holds the time the tenant was notified about its expiry
+	expiryNotifiedAnnotation = "web.aeto.net/expiry-notified-at"
+
+	ExpiryNone     = "none"
+	ExpiryActive   = "active"
+	ExpiryExpiring = "expiring"
+	ExpiryExpired  = "expired"
+	ExpiryKept     = "kept"
+	ExpiryInvalid  = "invalid"
+
+	expiryCheckInterval = time.Minute
+	systemUser          = "aeto-web"
+)
+
+// TenantExpiry describes when a tenant expires. Tenants are notified when the grace period before their expiry starts
+// and are deleted once expired, but never before a full grace period has passed since they were notified.
+type TenantExpiry struct {
+	Namespace        string     `json:"namespace"`
+	Name             string     `json:"name"`
+	State            string     `json:"state"`
+	ExpiresAt        *time.Time `json:"expiresAt,omitempty"`
+	NotifiedAt       *time.Time `json:"notifiedAt,omitempty"`
+	DeleteAfter      *time.Time `json:"deleteAfter,omitempty"`
+	RemainingSeconds int64      `json:"remainingSeconds,omitempty"`
+	Keep             bool       `json:"keep"`
+	Error            string     `json:"error,omitempty"`
+}
+
+func parseAnnotationTime(tenant corev1alpha1.Tenant, annotation string) (*time.Time, error) {
+	v, ok := tenant.Annotations[annotation]
+	if !ok {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %q is not an RFC3339 timestamp", annotation, v)
+	}
+	return &t, nil
+}
+
+func tenantExpiry(tenant corev1alpha1.Tenant, grace time.Duration, now time.Time) TenantExpiry {
+	e := TenantExpiry{
+		Namespace: tenant.Namespace,
+		Name:      tenant.Name,
+		State:     ExpiryNone,
+	}
+	e.Keep, _ = strconv.ParseBool(tenant.Annotations[expiryKeepAnnotation])
+
+	var err error
+	if e.ExpiresAt, err = parseAnnotationTime(tenant, expiresAtAnnotation); err != nil {
+		e.State, e.Error = ExpiryInvalid, err.Error()
+		return e
+	}
+	if e.NotifiedAt, err = parseAnnotationTime(tenant, expiryNotifiedAnnotation); err != nil {
+		e.State, e.Error = ExpiryInvalid, err.Error()
+		return e
+	}
+	if e.ExpiresAt == nil {
+		return e
+	}
+
+	notifyAt := e.ExpiresAt.Add(-grace)
+	deleteAfter := *e.ExpiresAt
+	if e.NotifiedAt != nil {
+		if t := e.NotifiedAt.Add(grace); t.After(deleteAfter) {
+			deleteAfter = t
+		}
+	} else if now.After(notifyAt) {
+		if t := now.Add(grace); t.After(deleteAfter) {
+			deleteAfter = t
+		}
+	}
+	e.DeleteAfter = &deleteAfter
+	if remaining := e.ExpiresAt.Sub(now); remaining > 0 {
+		e.RemainingSeconds = int64(remaining.Seconds())
+	}
+
+	switch {
+	case e.Keep:
+		e.State = ExpiryKept
+	case !now.Before(deleteAfter):
+		e.State = ExpiryExpired
+	case !now.Before(notifyAt):
+		e.State = ExpiryExpiring
+	default:
+		e.State = ExpiryActive
+	}
+	return e
+}
+
+// patchTenantAnnotations sets annotations of a tenant, or removes them when nil, failing with a conflict when the
+// tenant has changed since it was cached.
+func patchTenantAnnotations(client *AetoClient, tenant corev1alpha1.Tenant, annotations map[string]*string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"resourceVersion": tenant.ResourceVersion,
+			"annotations":     annotations,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = client.PatchRaw(corev1alpha1.GroupVersion.WithResource(tenantResource.Name), tenant.Namespace, tenant.Name, types.MergePatchType, patch, false)
+	return err
+}
+
+// notifyExpiry records an event on the tenant announcing when it will be deleted.
+func notifyExpiry(client *AetoClient, tenant corev1alpha1.Tenant, e TenantExpiry) error {
+	now := metav1.Now()
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: tenant.Name + "-expiring-",
+			Namespace:    tenant.Namespace,
+		},
+		InvolvedObject: corev1.ObjectReference{
+			APIVersion:      corev1alpha1.GroupVersion.String(),
+			Kind:            "Tenant",
+			Namespace:       tenant.Namespace,
+			Name:            tenant.Name,
+			UID:             tenant.UID,
+			ResourceVersion: tenant.ResourceVersion,
+		},
+		Reason:         "TenantExpiring",
+		Message:        fmt.Sprintf("Tenant expires at %s and will be deleted after %s unless extended or annotated with %s=true", e.ExpiresAt.Format(time.RFC3339), e.DeleteAfter.Format(time.RFC3339), expiryKeepAnnotation),
+		Type:           corev1.EventTypeWarning,
+		Source:         corev1.EventSource{Component: systemUser},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+	_, err := client.kubernetes.CoreV1().Events(tenant.Namespace).Create(context.Background(), event, metav1.CreateOptions{})
+	return err
+}
+
+// watchExpiry notifies tenants about to expire and deletes expired tenants of every cluster led by this replica, when
+// enabled.
+func (s *Server) watchExpiry() {
+	for range time.Tick(expiryCheckInterval) {
+		config := s.Config()
+		if !config.Expiry.Enabled {
+			continue
+		}
+		for _, c := range s.clusters {
+			client := c.Client()
+			if client == nil || !client.Serves(tenantResource.GroupVersion) || !s.leads(c) {
+				continue
+			}
+			s.expireTenants(c.Name, client, config)
+		}
+	}
+}
+
+func (s *Server) expireTenants(cluster string, client *AetoClient, config Config) {
+	tenants, _ := client.CoreV1Alpha1(config.Namespaces.Operator).ListTenants(func(i corev1alpha1.Tenant) bool {
+		_, ok := i.Annotations[expiresAtAnnotation]
+		return ok && i.DeletionTimestamp == nil
+	})
+
+	now := time.Now().UTC()
+	for _, tenant := range tenants.Items {
+		e := tenantExpiry(tenant, config.Expiry.GracePeriod.Duration, now)
+		id := tenant.Namespace + "/" + tenant.Name
+
+		if (e.State == ExpiryExpiring || e.State == ExpiryExpired) && e.NotifiedAt == nil {
+			record := AuditRecord{
+				User:       systemUser,
+				AuthMethod: systemUser,
+				Action:     "expire-notify",
+				Mutation:   true,
+				Target: AuditTarget{
+					Cluster:   cluster,
+					Resource:  tenantResource.Name,
+					Namespace: tenant.Namespace,
+					Name:      tenant.Name,
+				},
+				Outcome: AuditOutcomeSuccess,
+				Details: map[string]string{
+					"expiresAt":   e.ExpiresAt.Format(time.RFC3339),
+					"deleteAfter": e.DeleteAfter.Format(time.RFC3339),
+				},
+			}
+			notified := now.Format(time.RFC3339)
+			err := patchTenantAnnotations(client, tenant, map[string]*string{expiryNotifiedAnnotation: &notified})
+			if apierrors.IsConflict(err) {
+				log.Println("expiring tenant", id, "in cluster", cluster, "changed since it was read, not notifying yet")
+				continue
+			}
+			if err != nil {
+				log.Println("failed to mark tenant", id, "in cluster", cluster, "as notified about its expiry,", err)
+				record.Outcome = AuditOutcomeFailure
+				record.Details["error"] = err.Error()
+			} else if err := notifyExpiry(client, tenant, e); err != nil {
+				log.Println("failed to record expiry event for tenant", id, "in cluster", cluster+",", err)
+				record.Outcome = AuditOutcomeFailure
+				record.Details["error"] = err.Error()
+			} else {
+				log.Println("tenant", id, "in cluster", cluster, "expires at", e.ExpiresAt.Format(time.RFC3339), "and will be deleted after", e.DeleteAfter.Format(time.RFC3339))
+			}
+			s.audit.Record(record)
+			continue
+		}
+
+		if e.State != ExpiryExpired {
+			continue
+		}
+		// The tenant may have been extended or kept since it was cached, in which case it is checked again next time
+		err := client.CoreV1Alpha1(tenant.Namespace).DeleteTenant(tenant.Name, tenant.UID, tenant.ResourceVersion, false)
+		if apierrors.IsConflict(err) {
+			log.Println("expired tenant", id, "in cluster", cluster, "changed since it was read, not deleting it yet")
+			continue
+		}
+		record := AuditRecord{
+			User:       systemUser,
+			AuthMethod: systemUser,
+			Action:     "expire",
+			Mutation:   true,
+			Target: AuditTarget{
+				Cluster:   cluster,
+				Resource:  tenantResource.Name,
+				Namespace: tenant.Namespace,
+				Name:      tenant.Name,
+			},
+			Outcome: AuditOutcomeSuccess,
+			Details: map[string]string{
+				"expiresAt": e.ExpiresAt.Format(time.RFC3339),
+			},
+		}
+		if err != nil {
+			log.Println("failed to delete expired tenant", id, "in cluster", cluster+",", err)
+			record.Outcome = AuditOutcomeFailure
+			record.Details["error"] = err.Error()
+		} else {
+			log.Println("expired tenant", id, "deleted from cluster", cluster)
+		}
+		s.audit.Record(record)
+	}
+}
+
+// ExpiryChange sets the expiry of a tenant from now with ttl, to an exact time with expiresAt, or moves it with extend
+// and shorten. Keep opts the tenant out of, or back in to, being deleted when expired.
+type ExpiryChange struct {
+	TTL       *Duration  `json:"ttl,omitempty"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	Extend    *Duration  `json:"extend,omitempty"`
+	Shorten   *Duration  `json:"shorten,omitempty"`
+	Keep      *bool      `json:"keep,omitempty"`
+}
+
+// apply returns the annotations to patch the tenant with.
+func (c ExpiryChange) apply(current TenantExpiry, grace time.Duration, now time.Time) (map[string]*string, error) {
+	changes := 0
+	for _, set := range []bool{c.TTL != nil, c.ExpiresAt != nil, c.Extend != nil, c.Shorten != nil} {
+		if set {
+			changes++
+		}
+	}
+	if changes > 1 {
+		return nil, fmt.Errorf("only one of ttl, expiresAt, extend and shorten may be set")
+	}
+	if changes == 0 && c.Keep == nil {
+		return nil, fmt.Errorf("one of ttl, expiresAt, extend, shorten or keep must be set")
+	}
+
+	annotations := make(map[string]*string)
+	var expiresAt time.Time
+	switch {
+	case c.TTL != nil:
+		if c.TTL.Duration <= 0 {
+			return nil, fmt.Errorf("ttl: must be positive")
+		}
+		expiresAt = now.Add(c.TTL.Duration)
+	case c.ExpiresAt != nil:
+		expiresAt = *c.ExpiresAt
+	case c.Extend != nil || c.Shorten != nil:
+		if current.ExpiresAt == nil {
+			return nil, fmt.Errorf("tenant %s/%s has no expiry to extend or shorten", current.Namespace, current.Name)
+		}
+		if c.Extend != nil {
+			expiresAt = current.ExpiresAt.Add(c.Extend.Duration)
+		} else {
+			expiresAt = current.ExpiresAt.Add(-c.Shorten.Duration)
+		}
+	}
+	if changes > 0 {
+		v := expiresAt.UTC().Format(time.RFC3339)
+		annotations[expiresAtAnnotation] = &v
+		// Notify again when the new expiry is outside the grace period
+		if expiresAt.Add(-grace).After(now) {
+			annotations[expiryNotifiedAnnotation] = nil
+		}
+	}
+	if c.Keep != nil {
+		if *c.Keep {
+			v := "true"
+			annotations[expiryKeepAnnotation] = &v
+		} else {
+			annotations[expiryKeepAnnotation] = nil
+		}
+	}
+	return annotations, nil
+}
+
+func addExpiryRoutes(s *Server, r chi.Router, operatorNamespace string) {
+	r.With(authorize(s, PermissionReadResources)).Get("/expiries", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		client := clusterFrom(req).Client()
+		if notServed(w, client, tenantResource) {
+			return
+		}
+
+		allowed := s.allowFunc(req, client, corev1alpha1.GroupVersion.WithResource(tenantResource.Name))
+		tenants, _ := client.CoreV1Alpha1(operatorNamespace).ListTenants(func(i corev1alpha1.Tenant) bool {
+			_, ok := i.Annotations[expiresAtAnnotation]
+			return ok && allowed(i.Namespace, i.Name)
+		})
+
+		now := time.Now().UTC()
+		expiries := make([]TenantExpiry, 0, len(tenants.Items))
+		for _, t := range tenants.Items {
+			expiries = append(expiries, tenantExpiry(t, s.Config().Expiry.GracePeriod.Duration, now))
+		}
+
+		data, err := json.Marshal(expiries)
+		if hasErr(w, err) {
+			return
+		}
+		w.Write(data)
+	})
+
+	r.With(authorize(s, PermissionReadResources)).Get("/tenants/{namespace}/{name}/expiry", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		namespace := chi.URLParam(req, "namespace")
+		name := chi.URLParam(req, "name")
+
+		client := clusterFrom(req).Client()
+		if notServed(w, client, tenantResource) {
+			return
+		}
+
+		allowed := s.allowFunc(req, client, corev1alpha1.GroupVersion.WithResource(tenantResource.Name))
+		tenants, _ := client.CoreV1Alpha1(namespace).ListTenants(func(i corev1alpha1.Tenant) bool {
+			return i.Name == name && allowed(i.Namespace, i.Name)
+		})
+		if len(tenants.Items) == 0 {
+			writeError(w, 404, fmt.Sprintf("tenant %s/%s not found", namespace, name))
+			return
+		}
+
+		data, err := json.Marshal(tenantExpiry(tenants.Items[0], s.Config().Expiry.GracePeriod.Duration, time.Now().UTC()))
+		if hasErr(w, err) {
+			return
+		}
+		w.Write(data)
+	})
+
+	changeExpiry := func(remove bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			namespace := chi.URLParam(req, "namespace")
+			name := chi.URLParam(req, "name")
+
+			change := ExpiryChange{}
+			if !remove && !decodeJSON(w, req, &change) {
+				return
+			}
+
+			client := clusterFrom(req).Client()
+			if notServed(w, client, tenantResource) {
+				return
+			}
+
+			tenants, _ := client.CoreV1Alpha1(namespace).ListTenants(func(i corev1alpha1.Tenant) bool {
+				return i.Name == name
+			})
+			if len(tenants.Items) == 0 {
+				writeError(w, 404, fmt.Sprintf("tenant %s/%s not found", namespace, name))
+				return
+			}
+			tenant := tenants.Items[0]
+
+			now := time.Now().UTC()
+			grace := s.Config().Expiry.GracePeriod.Duration
+			annotations := map[string]*string{
+				expiresAtAnnotation:      nil,
+				expiryNotifiedAnnotation: nil,
+			}
+			if !remove {
+				var err error
+				annotations, err = change.apply(tenantExpiry(tenant, grace, now), grace, now)
+				if err != nil {
+					writeError(w, 400, err.Error())
+					return
+				}
+			}
+
+			writer, err := s.writer(req, client, tenantResource, namespace)
+			if hasErr(w, err) {
+				return
+			}
+			if hasErr(w, patchTenantAnnotations(writer, tenant, annotations)) {
+				return
+			}
+
+			// Answer with the expiry as it will be once the change reaches the cache
+			if tenant.Annotations == nil {
+				tenant.Annotations = make(map[string]string)
+			}
+			for k, v := range annotations {
+				if v == nil {
+					delete(tenant.Annotations, k)
+				} else {
+					tenant.Annotations[k] = *v
+				}
+			}
+			e := tenantExpiry(tenant, grace, now)
+			if e.ExpiresAt != nil {
+				auditDetail(req, "expiresAt", e.ExpiresAt.Format(time.RFC3339))
+			}
+			log.Println("expiry of tenant", namespace+"/"+name, "changed to", e.State, "by", identityFrom(req).Username)
+
+			data, err := json.Marshal(e)
+			if hasErr(w, err) {
+				return
+			}
+			w.Write(data)
+		}
+	}
+	r.With(authorize(s, PermissionManageExpiry), throttle(s, RateLimitBucketDirect)).Put("/tenants/{namespace}/{name}/expiry", changeExpiry(false))
+	r.With(authorize(s, PermissionManageExpiry), throttle(s, RateLimitBucketDirect)).Delete("/tenants/{namespace}/{name}/expiry", changeExpiry(true))
+}
@@ -0,0 +1,238 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	corev1alpha1 "github.com/kristofferahl/aeto/apis/core/v1alpha1"
+)
+
+func TestTenantExpiry(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	grace := 24 * time.Hour
+	at := func(d time.Duration) string {
+		return now.Add(d).Format(time.RFC3339)
+	}
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		state       string
+		deleteAfter time.Duration
+	}{
+		{
+			name:  "without expiry",
+			state: ExpiryNone,
+		},
+		{
+			name:        "before the grace period",
+			annotations: map[string]string{expiresAtAnnotation: at(48 * time.Hour)},
+			state:       ExpiryActive,
+			deleteAfter: 48 * time.Hour,
+		},
+		{
+			name:        "within the grace period, not yet notified",
+			annotations: map[string]string{expiresAtAnnotation: at(time.Hour)},
+			state:       ExpiryExpiring,
+			deleteAfter: grace,
+		},
+		{
+			name: "within the grace period, notified",
+			annotations: map[string]string{
+				expiresAtAnnotation:      at(time.Hour),
+				expiryNotifiedAnnotation: at(-23 * time.Hour),
+			},
+			state:       ExpiryExpiring,
+			deleteAfter: time.Hour,
+		},
+		{
+			name:        "expired, never notified",
+			annotations: map[string]string{expiresAtAnnotation: at(-time.Hour)},
+			state:       ExpiryExpiring,
+			deleteAfter: grace,
+		},
+		{
+			name: "expired, notified less than a grace period ago",
+			annotations: map[string]string{
+				expiresAtAnnotation:      at(-time.Hour),
+				expiryNotifiedAnnotation: at(-2 * time.Hour),
+			},
+			state:       ExpiryExpiring,
+			deleteAfter: 22 * time.Hour,
+		},
+		{
+			name: "expired, notified a grace period ago",
+			annotations: map[string]string{
+				expiresAtAnnotation:      at(-time.Hour),
+				expiryNotifiedAnnotation: at(-grace - time.Hour),
+			},
+			state:       ExpiryExpired,
+			deleteAfter: -time.Hour,
+		},
+		{
+			name: "expired and kept",
+			annotations: map[string]string{
+				expiresAtAnnotation:      at(-time.Hour),
+				expiryNotifiedAnnotation: at(-grace - time.Hour),
+				expiryKeepAnnotation:     "true",
+			},
+			state:       ExpiryKept,
+			deleteAfter: -time.Hour,
+		},
+		{
+			name:        "invalid expiry",
+			annotations: map[string]string{expiresAtAnnotation: "tomorrow"},
+			state:       ExpiryInvalid,
+		},
+		{
+			name: "invalid notification",
+			annotations: map[string]string{
+				expiresAtAnnotation:      at(time.Hour),
+				expiryNotifiedAnnotation: "yesterday",
+			},
+			state: ExpiryInvalid,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tenant := corev1alpha1.Tenant{}
+			tenant.Namespace, tenant.Name = "aeto", "t1"
+			tenant.Annotations = tt.annotations
+
+			e := tenantExpiry(tenant, grace, now)
+			if e.State != tt.state {
+				t.Errorf("got state %s, expected %s", e.State, tt.state)
+			}
+			switch {
+			case tt.state == ExpiryNone || tt.state == ExpiryInvalid:
+				if e.DeleteAfter != nil {
+					t.Errorf("got delete after %s, expected none", e.DeleteAfter)
+				}
+			case e.DeleteAfter == nil:
+				t.Errorf("got no delete after, expected %s", now.Add(tt.deleteAfter))
+			case !e.DeleteAfter.Equal(now.Add(tt.deleteAfter)):
+				t.Errorf("got delete after %s, expected %s", e.DeleteAfter, now.Add(tt.deleteAfter))
+			}
+		})
+	}
+}
+
+func TestExpiryChangeApply(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	grace := 24 * time.Hour
+	expiresAt := now.Add(2 * time.Hour)
+	current := TenantExpiry{Namespace: "aeto", Name: "t1", ExpiresAt: &expiresAt}
+	duration := func(d time.Duration) *Duration {
+		return &Duration{d}
+	}
+	boolean := func(b bool) *bool {
+		return &b
+	}
+	exact := now.Add(72 * time.Hour)
+
+	tests := []struct {
+		name    string
+		change  ExpiryChange
+		current TenantExpiry
+		want    map[string]string
+		removed []string
+		err     string
+	}{
+		{
+			name:    "ttl",
+			change:  ExpiryChange{TTL: duration(48 * time.Hour)},
+			want:    map[string]string{expiresAtAnnotation: "2026-10-21T12:00:00Z"},
+			removed: []string{expiryNotifiedAnnotation},
+		},
+		{
+			name:   "ttl within the grace period",
+			change: ExpiryChange{TTL: duration(time.Hour)},
+			want:   map[string]string{expiresAtAnnotation: "2026-10-19T13:00:00Z"},
+		},
+		{
+			name:   "negative ttl",
+			change: ExpiryChange{TTL: duration(-time.Hour)},
+			err:    "ttl: must be positive",
+		},
+		{
+			name:    "exact time",
+			change:  ExpiryChange{ExpiresAt: &exact},
+			want:    map[string]string{expiresAtAnnotation: "2026-10-22T12:00:00Z"},
+			removed: []string{expiryNotifiedAnnotation},
+		},
+		{
+			name:    "extend",
+			change:  ExpiryChange{Extend: duration(48 * time.Hour)},
+			current: current,
+			want:    map[string]string{expiresAtAnnotation: "2026-10-21T14:00:00Z"},
+			removed: []string{expiryNotifiedAnnotation},
+		},
+		{
+			name:    "shorten",
+			change:  ExpiryChange{Shorten: duration(time.Hour)},
+			current: current,
+			want:    map[string]string{expiresAtAnnotation: "2026-10-19T13:00:00Z"},
+		},
+		{
+			name:   "extend without expiry",
+			change: ExpiryChange{Extend: duration(time.Hour)},
+			err:    "has no expiry to extend or shorten",
+		},
+		{
+			name:   "keep",
+			change: ExpiryChange{Keep: boolean(true)},
+			want:   map[string]string{expiryKeepAnnotation: "true"},
+		},
+		{
+			name:    "stop keeping",
+			change:  ExpiryChange{Keep: boolean(false)},
+			removed: []string{expiryKeepAnnotation},
+		},
+		{
+			name:    "ttl and keep",
+			change:  ExpiryChange{TTL: duration(48 * time.Hour), Keep: boolean(false)},
+			want:    map[string]string{expiresAtAnnotation: "2026-10-21T12:00:00Z"},
+			removed: []string{expiryNotifiedAnnotation, expiryKeepAnnotation},
+		},
+		{
+			name:   "more than one change",
+			change: ExpiryChange{TTL: duration(time.Hour), Extend: duration(time.Hour)},
+			err:    "only one of",
+		},
+		{
+			name: "no change",
+			err:  "must be set",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			annotations, err := tt.change.apply(tt.current, grace, now)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("got error %v, expected it to contain %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+
+			if len(annotations) != len(tt.want)+len(tt.removed) {
+				t.Errorf("got %d annotations, expected %d", len(annotations), len(tt.want)+len(tt.removed))
+			}
+			for k, v := range tt.want {
+				if got := annotations[k]; got == nil || *got != v {
+					t.Errorf("got %s=%v, expected %s", k, got, v)
+				}
+			}
+			for _, k := range tt.removed {
+				if got, ok := annotations[k]; !ok || got != nil {
+					t.Errorf("expected %s to be removed", k)
+				}
+			}
+		})
+	}
+}
@@ -1,16 +1,32 @@
 package server
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+)
+
+// errNotFound is returned when a cached resource does not exist.
+var errNotFound = errors.New("not found")
 
 func one[T any](items []T, err error, def *T) (*T, error) {
 	if err != nil {
 		return def, err
 	}
 	if len(items) < 1 {
-		return def, fmt.Errorf("not found")
+		return def, errNotFound
 	}
 	if len(items) > 1 {
 		return def, fmt.Errorf("unique match not found")
 	}
 	return &items[0], nil
 }
+
+func filter[T any](items []T, keep func(i T) bool) []T {
+	result := make([]T, 0, len(items))
+	for _, i := range items {
+		if keep(i) {
+			result = append(result, i)
+		}
+	}
+	return result
+}
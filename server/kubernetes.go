@@ -1,29 +1,79 @@
 package server
 
 import (
+	"context"
+	"fmt"
 	"os"
 	"path/filepath"
 
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
 	rest "k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
-func getRestConfig(inClusterConfig bool) (*rest.Config, error) {
+func getRestConfig(config KubernetesConfig, kubeContext string) (*rest.Config, error) {
 	var err error
 	var restConfig *rest.Config
 
-	if inClusterConfig {
+	if config.InCluster {
 		restConfig, err = rest.InClusterConfig()
 	} else {
-		kubeconfig := filepath.Join(homeDir(), ".kube", "config")
-		if path := os.Getenv("KUBECONFIG"); path != "" {
-			kubeconfig = path
+		if kubeContext == "" {
+			kubeContext = config.Context
 		}
-		restConfig, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+		restConfig, err = clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+			&clientcmd.ClientConfigLoadingRules{ExplicitPath: kubeconfigPath(config)},
+			&clientcmd.ConfigOverrides{CurrentContext: kubeContext},
+		).ClientConfig()
 	}
 	return restConfig, err
 }
 
+// kubeconfigPath returns the path of the kubeconfig file in use, or an empty string when using the in-cluster config.
+func kubeconfigPath(config KubernetesConfig) string {
+	if config.InCluster {
+		return ""
+	}
+	if config.Kubeconfig != "" {
+		return config.Kubeconfig
+	}
+	return filepath.Join(homeDir(), ".kube", "config")
+}
+
+func getClusterRestConfig(config KubernetesConfig, cluster ClusterConfig) (*rest.Config, error) {
+	if cluster.Secret == nil {
+		return getRestConfig(config, cluster.Context)
+	}
+
+	restConfig, err := getRestConfig(config, "")
+	if err != nil {
+		return nil, err
+	}
+
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := clientset.CoreV1().Secrets(cluster.Secret.Namespace).Get(context.Background(), cluster.Secret.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get kubeconfig secret %s/%s for cluster %s, %w", cluster.Secret.Namespace, cluster.Secret.Name, cluster.Name, err)
+	}
+
+	data, ok := secret.Data[cluster.Secret.Key]
+	if !ok {
+		return nil, fmt.Errorf("kubeconfig secret %s/%s for cluster %s has no key %s", cluster.Secret.Namespace, cluster.Secret.Name, cluster.Name, cluster.Secret.Key)
+	}
+
+	kubeconfig, err := clientcmd.Load(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return clientcmd.NewNonInteractiveClientConfig(*kubeconfig, cluster.Context, &clientcmd.ConfigOverrides{}, nil).ClientConfig()
+}
+
 func homeDir() string {
 	if h := os.Getenv("HOME"); h != "" {
 		return h
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+const (
+	leaderLeaseDuration = 15 * time.Second
+	leaderRenewDeadline = 10 * time.Second
+	leaderRetryPeriod   = 2 * time.Second
+)
+
+// electLeaders campaigns for the leadership of every cluster when leader election is enabled.
+func (s *Server) electLeaders() {
+	config := s.Config()
+	if !config.Leader.Enabled {
+		return
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = systemUser
+	}
+	suffix, err := randomHex(4)
+	if err != nil {
+		log.Fatal(err)
+	}
+	identity := hostname + "_" + suffix
+
+	for _, c := range s.clusters {
+		go c.elect(config.Leader.Lease, config.Namespaces.Operator, identity)
+	}
+}
+
+// leads returns true when this replica is the leader of the cluster, which it always is when leader election is
+// disabled.
+func (s *Server) leads(c *Cluster) bool {
+	return !s.Config().Leader.Enabled || c.leading.Load()
+}
+
+// elect campaigns for the leadership of the cluster for as long as the server runs. Campaigning starts over with the
+// new client when the cluster is reconnected and after the leadership was lost.
+func (c *Cluster) elect(lease, namespace, identity string) {
+	for {
+		client := c.Client()
+		if client == nil {
+			time.Sleep(leaderRetryPeriod)
+			continue
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			ticker := time.NewTicker(leaderRetryPeriod)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					if c.Client() != client {
+						cancel()
+						return
+					}
+				}
+			}
+		}()
+
+		elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+			Lock: &resourcelock.LeaseLock{
+				LeaseMeta: metav1.ObjectMeta{
+					Name:      lease,
+					Namespace: namespace,
+				},
+				Client: client.kubernetes.CoordinationV1(),
+				LockConfig: resourcelock.ResourceLockConfig{
+					Identity: identity,
+				},
+			},
+			LeaseDuration:   leaderLeaseDuration,
+			RenewDeadline:   leaderRenewDeadline,
+			RetryPeriod:     leaderRetryPeriod,
+			ReleaseOnCancel: true,
+			Name:            c.Name,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: func(ctx context.Context) {
+					c.leading.Store(true)
+					log.Println("leading cluster", c.Name, "as", identity)
+				},
+				OnStoppedLeading: func() {
+					if c.leading.Swap(false) {
+						log.Println("stopped leading cluster", c.Name)
+					}
+				},
+			},
+		})
+		if err != nil {
+			log.Println("failed to elect a leader for cluster", c.Name+",", err)
+		} else {
+			elector.Run(ctx)
+		}
+		cancel()
+		c.leading.Store(false)
+		time.Sleep(leaderRetryPeriod)
+	}
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/middleware"
+)
+
+// requestLogFormatter logs requests in the same format as the chi logger, followed by the identity making the request.
+type requestLogFormatter struct{}
+
+func (f *requestLogFormatter) NewLogEntry(req *http.Request) middleware.LogEntry {
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+
+	line := ""
+	if id := middleware.GetReqID(req.Context()); id != "" {
+		line = fmt.Sprintf("[%s] ", id)
+	}
+	line += fmt.Sprintf("\"%s %s://%s%s %s\" from %s", req.Method, scheme, req.Host, req.RequestURI, req.Proto, req.RemoteAddr)
+
+	return &requestLogEntry{
+		line: line,
+	}
+}
+
+type requestLogEntry struct {
+	line     string
+	identity *Identity
+}
+
+func (e *requestLogEntry) Write(status, bytes int, header http.Header, elapsed time.Duration, extra interface{}) {
+	by := ""
+	if e.identity != nil {
+		by = fmt.Sprintf(" by %s (%s)", e.identity.Username, e.identity.Method)
+	}
+	log.Printf("%s - %03d %dB in %s%s", e.line, status, bytes, elapsed, by)
+}
+
+func (e *requestLogEntry) Panic(v interface{}, stack []byte) {
+	middleware.PrintPrettyStack(v)
+}
+
+// logIdentity records the identity of a request in its log entry.
+func logIdentity(req *http.Request, identity *Identity) {
+	if entry, ok := middleware.GetLogEntry(req).(*requestLogEntry); ok {
+		entry.identity = identity
+	}
+}
@@ -0,0 +1,535 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	corev1alpha1 "github.com/kristofferahl/aeto/apis/core/v1alpha1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	MigrationPending   = "pending"
+	MigrationRunning   = "running"
+	MigrationPaused    = "paused"
+	MigrationCompleted = "completed"
+	MigrationAborted   = "aborted"
+
+	MigrationTenantPending  = "pending"
+	MigrationTenantMigrated = "migrated"
+	MigrationTenantSkipped  = "skipped"
+	MigrationTenantFailed   = "failed"
+
+	migrationDefaultBatchSize = 5
+	migrationDefaultInterval  = 10 * time.Second
+	migrationsRetained        = 50
+	// migrationCheckInterval is how often the leader looks for due batches, intervals shorter than this are rounded up
+	migrationCheckInterval = 5 * time.Second
+)
+
+// MigrationRequest selects the tenants to move to another blueprint. Tenants are selected by a label selector, by name
+// and by the blueprint they currently use, every given criteria must match.
+type MigrationRequest struct {
+	Selector      string   `json:"selector,omitempty"`
+	Tenants       []string `json:"tenants,omitempty"`
+	FromBlueprint string   `json:"fromBlueprint,omitempty"`
+	Blueprint     string   `json:"blueprint"`
+	BatchSize     int      `json:"batchSize,omitempty"`
+	Interval      Duration `json:"interval,omitempty"`
+}
+
+type MigrationTenant struct {
+	Namespace string     `json:"namespace"`
+	Name      string     `json:"name"`
+	SpecName  string     `json:"specName,omitempty"`
+	From      string     `json:"from"`
+	Status    string     `json:"status"`
+	Error     string     `json:"error,omitempty"`
+	Time      *time.Time `json:"time,omitempty"`
+}
+
+// Migration describes a migration job and the result of every selected tenant. Migrations are persisted in a config
+// map and run by the leader of the cluster, moving tenants to the blueprint in batches with an interval between
+// batches. A migration may be paused, resumed and aborted from any replica, pausing and aborting take effect before the
+// next tenant is migrated.
+type Migration struct {
+	ID          string            `json:"id,omitempty"`
+	Cluster     string            `json:"cluster"`
+	Request     MigrationRequest  `json:"request"`
+	Status      string            `json:"status"`
+	CreatedBy   string            `json:"createdBy"`
+	RunAs       *RunAs            `json:"runAs,omitempty"`
+	CreatedAt   time.Time         `json:"createdAt"`
+	UpdatedAt   time.Time         `json:"updatedAt"`
+	NextBatchAt *time.Time        `json:"nextBatchAt,omitempty"`
+	Tenants     []MigrationTenant `json:"tenants"`
+}
+
+func (m Migration) finished() bool {
+	return m.Status == MigrationCompleted || m.Status == MigrationAborted
+}
+
+// pending returns the index of the next tenant to migrate, or -1 when every tenant has been migrated or skipped.
+func (m Migration) pending() int {
+	for i, t := range m.Tenants {
+		if t.Status == MigrationTenantPending {
+			return i
+		}
+	}
+	return -1
+}
+
+// control changes the status of the migration to paused, running or aborted.
+func (m *Migration) control(status string, now time.Time) error {
+	switch {
+	case m.finished():
+		return fmt.Errorf("migration %s is %s", m.ID, m.Status)
+	case status == MigrationPaused && m.Status != MigrationRunning && m.Status != MigrationPending:
+		return fmt.Errorf("migration %s is %s and can not be paused", m.ID, m.Status)
+	case status == MigrationRunning && m.Status != MigrationPaused:
+		return fmt.Errorf("migration %s is %s and can not be resumed", m.ID, m.Status)
+	}
+
+	m.Status, m.UpdatedAt = status, now
+	if status == MigrationAborted {
+		m.NextBatchAt = nil
+		for i := range m.Tenants {
+			if m.Tenants[i].Status == MigrationTenantPending {
+				m.Tenants[i].Status = MigrationTenantSkipped
+			}
+		}
+	}
+	return nil
+}
+
+// newMigrationStore returns the store of the migrations of a cluster, kept in a config map in the operator namespace.
+func newMigrationStore(client *AetoClient, config Config) configMapStore[Migration] {
+	return configMapStore[Migration]{
+		client:    client,
+		namespace: config.Namespaces.Operator,
+		name:      config.Migrations.ConfigMap,
+	}
+}
+
+// createdAfter orders migrations with the most recent first.
+func createdAfter(a, b Migration) bool {
+	if a.CreatedAt.Equal(b.CreatedAt) {
+		return a.ID > b.ID
+	}
+	return a.CreatedAt.After(b.CreatedAt)
+}
+
+// watchMigrations runs the due batches of the migrations of every cluster led by this replica.
+func (s *Server) watchMigrations() {
+	for range time.Tick(migrationCheckInterval) {
+		config := s.Config()
+		for _, c := range s.clusters {
+			client := c.Client()
+			if client == nil || !s.leads(c) {
+				continue
+			}
+			s.runMigrations(c.Name, client, config)
+		}
+	}
+}
+
+// runMigrations runs a batch of every pending or running migration due, the oldest migration first.
+func (s *Server) runMigrations(cluster string, client *AetoClient, config Config) {
+	store := newMigrationStore(client, config)
+	migrations, err := store.List(createdAfter)
+	if err != nil {
+		log.Println("failed to list migrations in cluster", cluster+",", err)
+		return
+	}
+
+	now := time.Now().UTC()
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if (m.Status == MigrationPending || m.Status == MigrationRunning) && (m.NextBatchAt == nil || !m.NextBatchAt.After(now)) {
+			s.runMigrationBatch(cluster, client, store, m)
+		}
+	}
+}
+
+// runMigrationBatch migrates the next batch of tenants of a migration. Every tenant is claimed by reading the migration
+// again, so that pausing and aborting take effect before the next tenant, and its result is written before claiming the
+// next one. The cached tenant is read again right before it is changed so that tenants changed since the preview are
+// migrated from their current state, or skipped when no longer matching.
+func (s *Server) runMigrationBatch(cluster string, client *AetoClient, store configMapStore[Migration], m Migration) {
+	selector, err := labels.Parse(m.Request.Selector)
+	if err != nil {
+		log.Println("migration", m.ID, "has an invalid selector,", err)
+		return
+	}
+	writer, err := client.RunAs(m.RunAs)
+	if err != nil {
+		log.Println("migration", m.ID, "failed to impersonate", m.RunAs.Username+",", err)
+		return
+	}
+
+	done, result := -1, MigrationTenant{}
+	for n := 0; ; n++ {
+		next, completed := -1, false
+		err := store.Update(func(migrations map[string]Migration) error {
+			next, completed = -1, false
+			current, ok := migrations[m.ID]
+			if !ok {
+				return nil
+			}
+
+			now := time.Now().UTC()
+			if done >= 0 && done < len(current.Tenants) {
+				current.Tenants[done] = result
+				current.UpdatedAt = now
+			}
+			if current.Status == MigrationPending {
+				current.Status, current.UpdatedAt = MigrationRunning, now
+			}
+			if current.Status == MigrationRunning {
+				i := current.pending()
+				switch {
+				case i < 0:
+					current.Status, current.NextBatchAt, current.UpdatedAt = MigrationCompleted, nil, now
+					completed = true
+				case n < current.Request.BatchSize:
+					next = i
+				default:
+					at := now.Add(current.Request.Interval.Duration)
+					current.NextBatchAt = &at
+				}
+			}
+			migrations[m.ID] = current
+			m = current
+			return nil
+		})
+		if err != nil {
+			log.Println("failed to update migration", m.ID, "in cluster", cluster+",", err)
+			return
+		}
+		if completed {
+			log.Println("migration", m.ID, "completed")
+		}
+		if next < 0 {
+			return
+		}
+		done, result = next, s.migrateTenant(cluster, writer, m, m.Tenants[next], selector)
+	}
+}
+
+// migrateTenant moves a tenant of the migration to the blueprint, recording the change in the audit log, and returns
+// its result.
+func (s *Server) migrateTenant(cluster string, client *AetoClient, m Migration, t MigrationTenant, selector labels.Selector) MigrationTenant {
+	now := time.Now().UTC()
+	t.Time = &now
+
+	tenants, _ := client.CoreV1Alpha1(t.Namespace).ListTenants(func(i corev1alpha1.Tenant) bool {
+		return i.Name == t.Name
+	})
+	if len(tenants.Items) == 0 {
+		t.Status, t.Error = MigrationTenantSkipped, "tenant no longer exists"
+		return t
+	}
+	tenant := tenants.Items[0]
+	if !m.Request.matches(tenant, selector) {
+		t.Status, t.Error = MigrationTenantSkipped, fmt.Sprintf("tenant no longer matches, it uses blueprint %s", tenant.Blueprint())
+		return t
+	}
+
+	err := setTenantBlueprint(client, tenant, m.Request.Blueprint, false)
+	record := AuditRecord{
+		User:       systemUser,
+		AuthMethod: systemUser,
+		Action:     "migrate",
+		Mutation:   true,
+		Target: AuditTarget{
+			Cluster:   cluster,
+			Resource:  tenantResource.Name,
+			Namespace: tenant.Namespace,
+			Name:      tenant.Name,
+		},
+		Outcome: AuditOutcomeSuccess,
+		Details: map[string]string{
+			"id":        m.ID,
+			"blueprint": m.Request.Blueprint,
+			"from":      tenant.Blueprint(),
+			"createdBy": m.CreatedBy,
+		},
+	}
+	if m.RunAs != nil {
+		record.Details["runAs"] = m.RunAs.Username
+	}
+	if err != nil {
+		log.Println("migration", m.ID, "failed to migrate tenant", t.Namespace+"/"+t.Name+",", err)
+		record.Outcome = AuditOutcomeFailure
+		record.Details["error"] = err.Error()
+		t.Status, t.Error = MigrationTenantFailed, err.Error()
+	} else {
+		t.Status = MigrationTenantMigrated
+	}
+	s.audit.Record(record)
+	return t
+}
+
+// matches returns true for tenants selected by the request that do not already use the target blueprint.
+func (m MigrationRequest) matches(tenant corev1alpha1.Tenant, selector labels.Selector) bool {
+	if tenant.Blueprint() == m.Blueprint || tenant.DeletionTimestamp != nil {
+		return false
+	}
+	if m.FromBlueprint != "" && tenant.Blueprint() != m.FromBlueprint {
+		return false
+	}
+	if len(m.Tenants) > 0 && !containsAny(m.Tenants, []string{tenant.Name}) {
+		return false
+	}
+	return selector.Matches(labels.Set(tenant.Labels))
+}
+
+// setTenantBlueprint changes the blueprint of a tenant, failing with a conflict when the tenant has changed since it
+// was cached.
+func setTenantBlueprint(client *AetoClient, tenant corev1alpha1.Tenant, blueprint string, dryRun bool) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"resourceVersion": tenant.ResourceVersion,
+		},
+		"spec": map[string]interface{}{
+			"blueprint": blueprint,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = client.PatchRaw(corev1alpha1.GroupVersion.WithResource(tenantResource.Name), tenant.Namespace, tenant.Name, types.MergePatchType, patch, dryRun)
+	return err
+}
+
+// validateMigration checks the request and returns the selector of the tenants to migrate.
+func validateMigration(client *AetoClient, namespace string, m *MigrationRequest) (labels.Selector, []string) {
+	problems := make([]string, 0)
+
+	selector, err := labels.Parse(m.Selector)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("selector: %s", err))
+	}
+	if m.Selector == "" && len(m.Tenants) == 0 && m.FromBlueprint == "" {
+		problems = append(problems, "selector, tenants or fromBlueprint must be set to select the tenants to migrate")
+	}
+	if m.BatchSize == 0 {
+		m.BatchSize = migrationDefaultBatchSize
+	}
+	if m.BatchSize < 0 {
+		problems = append(problems, "batchSize: must be a positive number")
+	}
+	if m.Interval.Duration == 0 {
+		m.Interval.Duration = migrationDefaultInterval
+	}
+	if m.Interval.Duration < 0 {
+		problems = append(problems, "interval: must be a positive duration")
+	}
+
+	blueprints, _ := client.CoreV1Alpha1(namespace).ListBlueprints(func(i corev1alpha1.Blueprint) bool {
+		return i.Name == m.Blueprint
+	})
+	if m.Blueprint == "" {
+		problems = append(problems, "blueprint: must not be empty")
+	} else if len(blueprints.Items) == 0 {
+		problems = append(problems, fmt.Sprintf("blueprint: blueprint %s/%s does not exist", namespace, m.Blueprint))
+	} else {
+		problems = append(problems, validateBlueprintTemplates(client, blueprints.Items[0])...)
+	}
+
+	return selector, problems
+}
+
+func addMigrationRoutes(s *Server, r chi.Router, operatorNamespace string) {
+	// Creates a migration job, or previews the tenants it would migrate with ?dryRun=true
+	r.With(authorize(s, PermissionMigrateTenants), throttle(s, RateLimitBucketDirect)).Post("/migrations", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		request := MigrationRequest{}
+		if !decodeJSON(w, req, &request) {
+			return
+		}
+
+		client := clusterFrom(req).Client()
+		if notServed(w, client, tenantResource) {
+			return
+		}
+
+		selector, problems := validateMigration(client, operatorNamespace, &request)
+		if len(problems) > 0 {
+			writeErrors(w, 400, "invalid migration", problems)
+			return
+		}
+
+		if _, err := s.writer(req, client, tenantResource, operatorNamespace); hasErr(w, err) {
+			return
+		}
+
+		allowed := s.allowFunc(req, client, corev1alpha1.GroupVersion.WithResource(tenantResource.Name))
+		tenants, _ := client.CoreV1Alpha1(operatorNamespace).ListTenants(func(i corev1alpha1.Tenant) bool {
+			return allowed(i.Namespace, i.Name) && request.matches(i, selector)
+		})
+
+		m := Migration{
+			Cluster:   clusterFrom(req).Name,
+			Request:   request,
+			Status:    MigrationPending,
+			CreatedBy: identityFrom(req).Username,
+			RunAs:     s.runAs(req),
+			CreatedAt: time.Now().UTC(),
+			Tenants:   make([]MigrationTenant, 0, len(tenants.Items)),
+		}
+		m.UpdatedAt = m.CreatedAt
+		for _, t := range tenants.Items {
+			m.Tenants = append(m.Tenants, MigrationTenant{
+				Namespace: t.Namespace,
+				Name:      t.Name,
+				SpecName:  t.Spec.Name,
+				From:      t.Blueprint(),
+				Status:    MigrationTenantPending,
+			})
+		}
+		sort.Slice(m.Tenants, func(i, j int) bool {
+			return m.Tenants[i].Name < m.Tenants[j].Name
+		})
+
+		if dryRun(req) {
+			auditDetail(req, "dryRun", "true")
+			data, err := json.Marshal(m)
+			if hasErr(w, err) {
+				return
+			}
+			w.Write(data)
+			return
+		}
+
+		var err error
+		m.ID, err = randomHex(8)
+		if hasErr(w, err) {
+			return
+		}
+		err = newMigrationStore(client, s.Config()).Update(func(migrations map[string]Migration) error {
+			migrations[m.ID] = m
+
+			// Forget the oldest finished migrations
+			finished := make([]Migration, 0)
+			for _, other := range migrations {
+				if other.finished() {
+					finished = append(finished, other)
+				}
+			}
+			sort.Slice(finished, func(i, j int) bool {
+				return createdAfter(finished[i], finished[j])
+			})
+			for len(migrations) > migrationsRetained && len(finished) > 0 {
+				delete(migrations, finished[len(finished)-1].ID)
+				finished = finished[:len(finished)-1]
+			}
+			return nil
+		})
+		if hasErr(w, err) {
+			return
+		}
+		auditRecordFrom(req).Target.Name = m.ID
+		auditDetail(req, "blueprint", request.Blueprint)
+		auditDetail(req, "tenants", fmt.Sprint(len(m.Tenants)))
+		log.Println("migration", m.ID, "of", len(m.Tenants), "tenants to blueprint", request.Blueprint, "created by", m.CreatedBy)
+
+		data, err := json.Marshal(m)
+		if hasErr(w, err) {
+			return
+		}
+		w.WriteHeader(202)
+		w.Write(data)
+	})
+
+	r.With(authorize(s, PermissionReadResources), throttle(s, RateLimitBucketDirect)).Get("/migrations", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		migrations, err := newMigrationStore(clusterFrom(req).Client(), s.Config()).List(createdAfter)
+		if hasErr(w, err) {
+			return
+		}
+
+		data, err := json.Marshal(migrations)
+		if hasErr(w, err) {
+			return
+		}
+		w.Write(data)
+	})
+
+	r.With(authorize(s, PermissionReadResources), throttle(s, RateLimitBucketDirect)).Get("/migrations/{id}", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		id := chi.URLParam(req, "id")
+
+		_, migrations, err := newMigrationStore(clusterFrom(req).Client(), s.Config()).get()
+		if hasErr(w, err) {
+			return
+		}
+		m, ok := migrations[id]
+		if !ok {
+			writeError(w, 404, fmt.Sprintf("migration %s not found", id))
+			return
+		}
+
+		data, err := json.Marshal(m)
+		if hasErr(w, err) {
+			return
+		}
+		w.Write(data)
+	})
+
+	controls := map[string]string{
+		"pause":  MigrationPaused,
+		"resume": MigrationRunning,
+		"abort":  MigrationAborted,
+	}
+	for action, status := range controls {
+		status := status
+		r.With(authorize(s, PermissionMigrateTenants)).Post("/migrations/{id}/"+action, func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			id := chi.URLParam(req, "id")
+			auditRecordFrom(req).Target.Name = id
+
+			controlled := Migration{}
+			var invalid error
+			err := newMigrationStore(clusterFrom(req).Client(), s.Config()).Update(func(migrations map[string]Migration) error {
+				m, ok := migrations[id]
+				if !ok {
+					return errNotFound
+				}
+				if invalid = m.control(status, time.Now().UTC()); invalid != nil {
+					return invalid
+				}
+				migrations[id] = m
+				controlled = m
+				return nil
+			})
+			switch {
+			case err == errNotFound:
+				writeError(w, 404, fmt.Sprintf("migration %s not found", id))
+				return
+			case invalid != nil && err == invalid:
+				writeError(w, 409, err.Error())
+				return
+			}
+			if hasErr(w, err) {
+				return
+			}
+			log.Println("migration", id, status, "by", identityFrom(req).Username)
+
+			data, err := json.Marshal(controlled)
+			if hasErr(w, err) {
+				return
+			}
+			w.Write(data)
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestMigrationControl(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	next := now.Add(time.Minute)
+
+	tests := []struct {
+		name    string
+		from    string
+		control string
+		want    string
+		err     string
+	}{
+		{name: "pause pending", from: MigrationPending, control: MigrationPaused, want: MigrationPaused},
+		{name: "pause running", from: MigrationRunning, control: MigrationPaused, want: MigrationPaused},
+		{name: "pause paused", from: MigrationPaused, control: MigrationPaused, err: "can not be paused"},
+		{name: "resume paused", from: MigrationPaused, control: MigrationRunning, want: MigrationRunning},
+		{name: "resume running", from: MigrationRunning, control: MigrationRunning, err: "can not be resumed"},
+		{name: "abort running", from: MigrationRunning, control: MigrationAborted, want: MigrationAborted},
+		{name: "abort paused", from: MigrationPaused, control: MigrationAborted, want: MigrationAborted},
+		{name: "abort completed", from: MigrationCompleted, control: MigrationAborted, err: "is completed"},
+		{name: "resume aborted", from: MigrationAborted, control: MigrationRunning, err: "is aborted"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := Migration{
+				ID:          "m1",
+				Status:      tt.from,
+				NextBatchAt: &next,
+				Tenants: []MigrationTenant{
+					{Name: "t1", Status: MigrationTenantMigrated},
+					{Name: "t2", Status: MigrationTenantPending},
+				},
+			}
+			err := m.control(tt.control, now)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("got error %v, expected it to contain %q", err, tt.err)
+				}
+				if m.Status != tt.from {
+					t.Errorf("got status %s, expected it to remain %s", m.Status, tt.from)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+
+			if m.Status != tt.want || !m.UpdatedAt.Equal(now) {
+				t.Errorf("got status %s updated at %s, expected %s updated at %s", m.Status, m.UpdatedAt, tt.want, now)
+			}
+			skipped := m.Tenants[1].Status == MigrationTenantSkipped
+			if aborted := tt.want == MigrationAborted; skipped != aborted || (m.NextBatchAt == nil) != aborted {
+				t.Errorf("got pending tenant %s and next batch at %v after %s", m.Tenants[1].Status, m.NextBatchAt, tt.want)
+			}
+		})
+	}
+}
+
+func TestMigrationStore(t *testing.T) {
+	config := DefaultConfig()
+	store := newMigrationStore(&AetoClient{kubernetes: fake.NewSimpleClientset()}, config)
+
+	migrations, err := store.List(createdAfter)
+	if err != nil || len(migrations) != 0 {
+		t.Fatalf("got %v, %v, expected no migrations before the config map exists", migrations, err)
+	}
+
+	created := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	for i, id := range []string{"a", "b", "c"} {
+		m := Migration{ID: id, Status: MigrationPending, CreatedAt: created.Add(time.Duration(i) * time.Minute)}
+		err := store.Update(func(migrations map[string]Migration) error {
+			migrations[m.ID] = m
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = store.Update(func(migrations map[string]Migration) error {
+		m := migrations["b"]
+		if err := m.control(MigrationAborted, created); err != nil {
+			return err
+		}
+		migrations[m.ID] = m
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	migrations, err = store.List(createdAfter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]string, 0, len(migrations))
+	for _, m := range migrations {
+		ids = append(ids, m.ID+"="+m.Status)
+	}
+	if want := []string{"c=pending", "b=aborted", "a=pending"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("got %v, expected %v", ids, want)
+	}
+}
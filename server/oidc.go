@@ -0,0 +1,307 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/go-chi/chi/v5"
+	"golang.org/x/oauth2"
+)
+
+const (
+	oidcLoginPath    = "/auth/login"
+	oidcCallbackPath = "/auth/callback"
+	oidcLogoutPath   = "/auth/logout"
+	oidcLoginTimeout = 10 * time.Minute
+	oidcClockSkew    = 1 * time.Minute
+)
+
+// pendingLogin is a login that has been redirected to the provider but not yet returned to the callback. It is kept in
+// a short-lived cookie rather than on the server, so that only the browser that started the login can complete it and
+// the callback may be served by any replica.
+type pendingLogin struct {
+	State    string    `json:"state"`
+	Nonce    string    `json:"nonce"`
+	Verifier string    `json:"verifier"`
+	Redirect string    `json:"redirect"`
+	Expires  time.Time `json:"expires"`
+}
+
+// oidcProvider implements the OIDC authorization code flow with PKCE. Provider metadata is discovered on first use so
+// that the server starts even when the provider is unavailable, signing keys are fetched and cached by the verifier.
+type oidcProvider struct {
+	config   OIDCConfig
+	client   *http.Client
+	mu       sync.Mutex
+	provider *oidc.Provider
+	verifier *oidc.IDTokenVerifier
+}
+
+func newOIDCProvider(config OIDCConfig) *oidcProvider {
+	return &oidcProvider{
+		config: config,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func addAuthRoutes(s *Server, router chi.Router) {
+	config := s.Config()
+	if config.Auth.Mode != AuthModeOIDC {
+		return
+	}
+
+	provider := newOIDCProvider(config.Auth.OIDC)
+
+	router.Get(oidcLoginPath, func(w http.ResponseWriter, req *http.Request) {
+		authURL, login, err := provider.login(req.Context(), req.URL.Query().Get("redirect"))
+		if err != nil {
+			log.Println("failed to start OIDC login,", err)
+			writeError(w, 502, "identity provider unavailable")
+			return
+		}
+		setLoginCookie(w, req, s.Config().Auth.Session, login)
+		http.Redirect(w, req, authURL, http.StatusFound)
+	})
+
+	router.Get(oidcCallbackPath, func(w http.ResponseWriter, req *http.Request) {
+		if e := req.URL.Query().Get("error"); e != "" {
+			writeError(w, 401, fmt.Sprintf("login failed, %s %s", e, req.URL.Query().Get("error_description")))
+			return
+		}
+
+		sessionConfig := s.Config().Auth.Session
+		login, ok := loginCookie(req, sessionConfig)
+		clearLoginCookie(w, req, sessionConfig)
+		if !ok {
+			log.Println("OIDC login failed, the login was not started by this browser")
+			s.audit.Record(loginAuditRecord(req, anonymous, AuditOutcomeFailure))
+			writeError(w, 401, "login failed")
+			return
+		}
+
+		identity, redirect, err := provider.callback(req.Context(), login, req.URL.Query().Get("state"), req.URL.Query().Get("code"))
+		if err != nil {
+			log.Println("OIDC login failed,", err)
+			s.audit.Record(loginAuditRecord(req, anonymous, AuditOutcomeFailure))
+			writeError(w, 401, "login failed")
+			return
+		}
+
+		if !containsAny(identity.Groups, provider.config.AllowedGroups) {
+			log.Println("OIDC login denied for", identity.Username, "not a member of any allowed group")
+			s.audit.Record(loginAuditRecord(req, identity, AuditOutcomeDenied))
+			writeError(w, 403, fmt.Sprintf("%s is not a member of any of the allowed groups", identity.Username))
+			return
+		}
+
+		session, err := s.sessions.Create(*identity, s.Config().Auth.Session.TTL.Duration)
+		if hasErr(w, err) {
+			return
+		}
+		setSessionCookie(w, req, s.Config().Auth.Session, session)
+
+		log.Println("OIDC login succeeded for", identity.Username)
+		s.audit.Record(loginAuditRecord(req, identity, AuditOutcomeSuccess))
+		http.Redirect(w, req, redirect, http.StatusFound)
+	})
+
+	logout := func(w http.ResponseWriter, req *http.Request) {
+		sessionConfig := s.Config().Auth.Session
+		if cookie, err := req.Cookie(sessionConfig.CookieName); err == nil {
+			s.sessions.Delete(cookie.Value)
+		}
+		clearSessionCookie(w, req, sessionConfig)
+
+		redirect := "/"
+		if m, _, err := provider.discover(req.Context()); err == nil {
+			metadata := struct {
+				EndSessionEndpoint string `json:"end_session_endpoint"`
+			}{}
+			if err := m.Claims(&metadata); err == nil && metadata.EndSessionEndpoint != "" {
+				redirect = metadata.EndSessionEndpoint
+			}
+		}
+		http.Redirect(w, req, redirect, http.StatusFound)
+	}
+	// Logging out is only accepted as a POST, carrying the CSRF token, so that other sites can not log users out
+	router.Post(oidcLogoutPath, logout)
+
+	s.authenticators = append(s.authenticators, sessionAuthenticator(s))
+}
+
+// discover returns the provider and id token verifier, discovering the provider metadata on first use. The lock is
+// not held while discovering so that a slow provider never blocks logins in progress.
+func (p *oidcProvider) discover(ctx context.Context) (*oidc.Provider, *oidc.IDTokenVerifier, error) {
+	p.mu.Lock()
+	provider, verifier := p.provider, p.verifier
+	p.mu.Unlock()
+	if provider != nil {
+		return provider, verifier, nil
+	}
+
+	provider, err := oidc.NewProvider(oidc.ClientContext(ctx, p.client), p.config.IssuerURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	verifier = provider.Verifier(&oidc.Config{
+		ClientID: p.config.ClientID,
+		Now: func() time.Time {
+			return time.Now().Add(-oidcClockSkew)
+		},
+	})
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.provider == nil {
+		p.provider, p.verifier = provider, verifier
+	}
+	return p.provider, p.verifier, nil
+}
+
+func (p *oidcProvider) oauth2Config(provider *oidc.Provider) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     p.config.ClientID,
+		ClientSecret: p.config.ClientSecret,
+		RedirectURL:  p.config.RedirectURL,
+		Scopes:       p.config.Scopes,
+		Endpoint:     provider.Endpoint(),
+	}
+}
+
+// login starts a login and returns the url of the provider to redirect the user to, along with the pending login to
+// keep in the browser until the callback.
+func (p *oidcProvider) login(ctx context.Context, redirect string) (string, pendingLogin, error) {
+	m, _, err := p.discover(ctx)
+	if err != nil {
+		return "", pendingLogin{}, err
+	}
+
+	state, err := randomString(24)
+	if err != nil {
+		return "", pendingLogin{}, err
+	}
+	nonce, err := randomString(24)
+	if err != nil {
+		return "", pendingLogin{}, err
+	}
+	verifier, err := randomString(32)
+	if err != nil {
+		return "", pendingLogin{}, err
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+
+	login := pendingLogin{
+		State:    state,
+		Nonce:    nonce,
+		Verifier: verifier,
+		Redirect: localRedirect(redirect),
+		Expires:  time.Now().Add(oidcLoginTimeout),
+	}
+	return p.oauth2Config(m).AuthCodeURL(state,
+		oauth2.SetAuthURLParam("nonce", nonce),
+		oauth2.SetAuthURLParam("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:])),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+	), login, nil
+}
+
+// callback completes the pending login of the browser, exchanging the code for tokens and verifying the id token. The
+// state returned by the provider must be the one of the pending login, so that a callback started by someone else is
+// never completed.
+func (p *oidcProvider) callback(ctx context.Context, login pendingLogin, state, code string) (*Identity, string, error) {
+	if login.State == "" || subtle.ConstantTimeCompare([]byte(state), []byte(login.State)) != 1 {
+		return nil, "", fmt.Errorf("login state does not match the login started by this browser")
+	}
+	if time.Now().After(login.Expires) {
+		return nil, "", fmt.Errorf("login expired")
+	}
+
+	m, verifier, err := p.discover(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+
+	token, err := p.oauth2Config(m).Exchange(context.WithValue(ctx, oauth2.HTTPClient, p.client), code,
+		oauth2.SetAuthURLParam("code_verifier", login.Verifier))
+	if err != nil {
+		return nil, "", err
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, "", fmt.Errorf("token response did not contain an id_token")
+	}
+
+	claims, err := p.verify(ctx, verifier, rawIDToken)
+	if err != nil {
+		return nil, "", err
+	}
+	if claims["nonce"] != login.Nonce {
+		return nil, "", fmt.Errorf("id token nonce does not match")
+	}
+
+	username, ok := claims[p.config.UsernameClaim].(string)
+	if !ok || username == "" {
+		return nil, "", fmt.Errorf("id token has no %s claim", p.config.UsernameClaim)
+	}
+
+	return &Identity{
+		Username: username,
+		Groups:   stringsClaim(claims[p.config.GroupsClaim]),
+		Method:   AuthMethodSession,
+	}, localRedirect(login.Redirect), nil
+}
+
+// localRedirect returns the redirect when it is a local path, or / otherwise.
+func localRedirect(redirect string) string {
+	if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") || strings.HasPrefix(redirect, "/\\") {
+		return "/"
+	}
+	return redirect
+}
+
+// verify checks the signature, issuer, audience and expiry of an id token and returns its claims. When the token has
+// more than one audience the authorized party must be this client.
+func (p *oidcProvider) verify(ctx context.Context, verifier *oidc.IDTokenVerifier, rawIDToken string) (map[string]interface{}, error) {
+	token, err := verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := make(map[string]interface{})
+	if err := token.Claims(&claims); err != nil {
+		return nil, err
+	}
+
+	if azp, ok := claims["azp"]; ok || len(token.Audience) > 1 {
+		if azp != p.config.ClientID {
+			return nil, fmt.Errorf("id token authorized party %v is not %s", azp, p.config.ClientID)
+		}
+	}
+
+	return claims, nil
+}
+
+// stringsClaim returns the values of a claim that may be either a single string or a list of strings.
+func stringsClaim(claim interface{}) []string {
+	values := make([]string, 0)
+	switch v := claim.(type) {
+	case string:
+		values = append(values, v)
+	case []interface{}:
+		for _, i := range v {
+			if s, ok := i.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+	return values
+}
@@ -0,0 +1,280 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testKeyID = "test-key"
+
+// testIssuer is an OIDC provider serving discovery metadata and the signing key under testKeyID.
+type testIssuer struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issuer := &testIssuer{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                issuer.URL,
+			"authorization_endpoint":                issuer.URL + "/authorize",
+			"token_endpoint":                        issuer.URL + "/token",
+			"jwks_uri":                              issuer.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"alg": "RS256",
+				"use": "sig",
+				"kid": testKeyID,
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	issuer.Server = httptest.NewServer(mux)
+	t.Cleanup(issuer.Close)
+	return issuer
+}
+
+// sign returns an RS256 signed token with the given key id and claims.
+func (i *testIssuer) sign(t *testing.T, kid string, claims map[string]interface{}) string {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": kid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, i.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestOIDCVerify(t *testing.T) {
+	issuer := newTestIssuer(t)
+	provider := newOIDCProvider(OIDCConfig{
+		IssuerURL:     issuer.URL,
+		ClientID:      "aeto-web",
+		UsernameClaim: "email",
+		GroupsClaim:   "groups",
+	})
+
+	_, verifier, err := provider.discover(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := func(modify func(c map[string]interface{})) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":   issuer.URL,
+			"sub":   "1234",
+			"aud":   "aeto-web",
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"iat":   time.Now().Unix(),
+			"email": "jane@example.com",
+		}
+		if modify != nil {
+			modify(c)
+		}
+		return c
+	}
+
+	tests := []struct {
+		name  string
+		kid   string
+		token map[string]interface{}
+		err   string
+	}{
+		{
+			name:  "valid",
+			kid:   testKeyID,
+			token: claims(nil),
+		},
+		{
+			name: "expired",
+			kid:  testKeyID,
+			token: claims(func(c map[string]interface{}) {
+				c["exp"] = time.Now().Add(-oidcClockSkew - time.Minute).Unix()
+			}),
+			err: "expired",
+		},
+		{
+			name: "expired within clock skew",
+			kid:  testKeyID,
+			token: claims(func(c map[string]interface{}) {
+				c["exp"] = time.Now().Add(-oidcClockSkew / 2).Unix()
+			}),
+		},
+		{
+			name: "wrong audience",
+			kid:  testKeyID,
+			token: claims(func(c map[string]interface{}) {
+				c["aud"] = "someone-else"
+			}),
+			err: "audience",
+		},
+		{
+			name: "wrong issuer",
+			kid:  testKeyID,
+			token: claims(func(c map[string]interface{}) {
+				c["iss"] = "https://issuer.example.com"
+			}),
+			err: "issuer",
+		},
+		{
+			name:  "unknown key id",
+			kid:   "unknown",
+			token: claims(nil),
+			err:   "signature",
+		},
+		{
+			name: "multiple audiences without authorized party",
+			kid:  testKeyID,
+			token: claims(func(c map[string]interface{}) {
+				c["aud"] = []string{"aeto-web", "someone-else"}
+			}),
+			err: "authorized party",
+		},
+		{
+			name: "multiple audiences authorized for another client",
+			kid:  testKeyID,
+			token: claims(func(c map[string]interface{}) {
+				c["aud"] = []string{"aeto-web", "someone-else"}
+				c["azp"] = "someone-else"
+			}),
+			err: "authorized party",
+		},
+		{
+			name: "multiple audiences authorized for this client",
+			kid:  testKeyID,
+			token: claims(func(c map[string]interface{}) {
+				c["aud"] = []string{"aeto-web", "someone-else"}
+				c["azp"] = "aeto-web"
+			}),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := provider.verify(context.Background(), verifier, issuer.sign(t, tt.kid, tt.token))
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected error %v", err)
+				}
+				if got["email"] != "jane@example.com" {
+					t.Errorf("got claims %v", got)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got error %v, expected it to contain %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestOIDCTamperedToken(t *testing.T) {
+	issuer := newTestIssuer(t)
+	provider := newOIDCProvider(OIDCConfig{IssuerURL: issuer.URL, ClientID: "aeto-web"})
+
+	_, verifier, err := provider.discover(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := issuer.sign(t, testKeyID, map[string]interface{}{
+		"iss": issuer.URL,
+		"aud": "aeto-web",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	parts := strings.Split(token, ".")
+	payload, _ := json.Marshal(map[string]interface{}{
+		"iss":   issuer.URL,
+		"aud":   "aeto-web",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"email": "admin@example.com",
+	})
+	parts[1] = base64.RawURLEncoding.EncodeToString(payload)
+
+	if _, err := provider.verify(context.Background(), verifier, strings.Join(parts, ".")); err == nil {
+		t.Error("expected a tampered token to be rejected")
+	}
+}
+
+func TestOIDCLoginState(t *testing.T) {
+	issuer := newTestIssuer(t)
+	provider := newOIDCProvider(OIDCConfig{IssuerURL: issuer.URL, ClientID: "aeto-web"})
+	config := DefaultConfig().Auth.Session
+
+	authURL, login, err := provider.login(context.Background(), "//evil.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(authURL, "state="+login.State) {
+		t.Errorf("got auth url %s, expected it to carry state %s", authURL, login.State)
+	}
+	if login.Redirect != "/" {
+		t.Errorf("got redirect %s, expected only local redirects", login.Redirect)
+	}
+
+	w := httptest.NewRecorder()
+	setLoginCookie(w, httptest.NewRequest(http.MethodGet, oidcLoginPath, nil), config, login)
+	req := httptest.NewRequest(http.MethodGet, oidcCallbackPath, nil)
+	for _, c := range w.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	if got, ok := loginCookie(req, config); !ok || got.State != login.State || got.Verifier != login.Verifier {
+		t.Fatalf("got login %+v, expected %+v", got, login)
+	}
+
+	expired := login
+	expired.Expires = time.Now().Add(-time.Second)
+
+	tests := []struct {
+		name  string
+		login pendingLogin
+		state string
+		err   string
+	}{
+		{name: "not started by this browser", state: login.State, err: "does not match"},
+		{name: "started by someone else", login: login, state: "attacker-state", err: "does not match"},
+		{name: "expired", login: expired, state: login.State, err: "expired"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := provider.callback(context.Background(), tt.login, tt.state, "code")
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got error %v, expected it to contain %q", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/go-chi/chi/v5"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+)
+
+// patchMetadata holds the fields of an object used to guard a patch.
+type patchMetadata struct {
+	Metadata struct {
+		Name            string `json:"name"`
+		Namespace       string `json:"namespace"`
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+}
+
+// patchType returns the patch type of a request from its content type. Plain json is treated as a json merge patch.
+func patchType(req *http.Request) (types.PatchType, bool) {
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	switch mediaType {
+	case string(types.MergePatchType), "application/json":
+		return types.MergePatchType, true
+	case string(types.StrategicMergePatchType):
+		return types.StrategicMergePatchType, true
+	}
+	return "", false
+}
+
+// currentResource returns the resource about to be patched, from the cache for cached resources.
+func currentResource(client *AetoClient, resource apiResource, namespace, name string) (interface{}, bool, error) {
+	current, err := resource.Get(client, namespace, name)
+	if apierrors.IsNotFound(err) || errors.Is(err, errNotFound) {
+		return nil, false, nil
+	}
+	return current, err == nil, err
+}
+
+// applyPatch applies a json merge patch or a strategic merge patch to the json of the current resource. Strategic
+// merge patches are applied here as the api server only accepts them for built-in resources.
+func applyPatch(pt types.PatchType, original, patch []byte, current interface{}) ([]byte, error) {
+	if pt == types.StrategicMergePatchType {
+		return strategicpatch.StrategicMergePatch(original, patch, current)
+	}
+	return jsonpatch.MergePatch(original, patch)
+}
+
+// guardPatch applies a patch to the json of the current resource and returns the merge patch to send to the api server
+// along with the resourceVersion it carries. The resourceVersion is the one the patch was applied to, unless the patch
+// sets one, making the api server reject the patch when the resource has changed since. Patches that can not be applied
+// are returned as bad requests.
+func guardPatch(pt types.PatchType, original, patch []byte, current interface{}) ([]byte, string, error) {
+	patched, err := applyPatch(pt, original, patch, current)
+	if err != nil {
+		return nil, "", apierrors.NewBadRequest(fmt.Sprintf("failed to apply patch, %s", err))
+	}
+
+	before, after := patchMetadata{}, patchMetadata{}
+	if err := json.Unmarshal(original, &before); err != nil {
+		return nil, "", err
+	}
+	if err := json.Unmarshal(patched, &after); err != nil {
+		return nil, "", apierrors.NewBadRequest(fmt.Sprintf("failed to apply patch, %s", err))
+	}
+	if after.Metadata.Name != before.Metadata.Name || after.Metadata.Namespace != before.Metadata.Namespace {
+		return nil, "", apierrors.NewBadRequest("metadata.name and metadata.namespace can not be changed")
+	}
+	// Removing the resourceVersion would make the patch unconditional
+	if after.Metadata.ResourceVersion == "" {
+		after.Metadata.ResourceVersion = before.Metadata.ResourceVersion
+	}
+
+	mergePatch, err := jsonpatch.CreateMergePatch(original, patched)
+	if err != nil {
+		return nil, "", err
+	}
+	guarded := make(map[string]interface{})
+	if err := json.Unmarshal(mergePatch, &guarded); err != nil {
+		return nil, "", err
+	}
+	metadata, _ := guarded["metadata"].(map[string]interface{})
+	if metadata == nil {
+		metadata = make(map[string]interface{})
+		guarded["metadata"] = metadata
+	}
+	metadata["resourceVersion"] = after.Metadata.ResourceVersion
+
+	body, err := json.Marshal(guarded)
+	return body, after.Metadata.ResourceVersion, err
+}
+
+// writeConflict answers with 409 and the current state of the resource, as seen by the api server.
+func writeConflict(w http.ResponseWriter, message string, current []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(409)
+	data, _ := json.Marshal(struct {
+		Error   string          `json:"error"`
+		Current json.RawMessage `json:"current,omitempty"`
+	}{
+		Error:   message,
+		Current: current,
+	})
+	w.Write(data)
+}
+
+// patchResource applies a json merge patch or a strategic merge patch to a resource. The patch is applied to the
+// cached resource and sent to the api server as a merge patch carrying the cached resourceVersion, unless the patch
+// sets one, so that changes made since the resource was read are never overwritten. Conflicts are answered with 409
+// and the current resource while ?dryRun=true returns the resulting resource without persisting it.
+func patchResource(s *Server, resource apiResource) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		namespace := chi.URLParam(req, "namespace")
+		name := chi.URLParam(req, "name")
+
+		pt, ok := patchType(req)
+		if !ok {
+			writeError(w, 415, fmt.Sprintf("unsupported patch, use %s or %s", types.MergePatchType, types.StrategicMergePatchType))
+			return
+		}
+		auditDetail(req, "patchType", string(pt))
+
+		patch, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxRequestBodySize))
+		if err != nil {
+			writeError(w, 400, fmt.Sprintf("invalid request body, %s", err))
+			return
+		}
+		if !json.Valid(patch) {
+			writeError(w, 400, "invalid request body, patch is not valid json")
+			return
+		}
+
+		client := clusterFrom(req).Client()
+		if notServed(w, client, resource) {
+			return
+		}
+
+		reader, allowed, err := s.access(req, client, resource)
+		if hasErr(w, err) {
+			return
+		}
+		if !allowed(namespace, name) {
+			writeError(w, 403, fmt.Sprintf("%s is not allowed to get %s %s/%s", identityFrom(req).Username, resource.Name, namespace, name))
+			return
+		}
+
+		current, found, err := currentResource(reader, resource, namespace, name)
+		if hasErr(w, err) {
+			return
+		}
+		if !found {
+			writeError(w, 404, fmt.Sprintf("%s %s/%s not found", resource.Name, namespace, name))
+			return
+		}
+
+		original, err := json.Marshal(current)
+		if hasErr(w, err) {
+			return
+		}
+
+		body, resourceVersion, err := guardPatch(pt, original, patch, current)
+		if hasErr(w, err) {
+			return
+		}
+		auditDetail(req, "resourceVersion", resourceVersion)
+
+		writer, err := s.writer(req, client, resource, namespace)
+		if hasErr(w, err) {
+			return
+		}
+
+		gvr := resource.GroupVersion.WithResource(resource.Name)
+		result, err := writer.PatchRaw(gvr, namespace, name, types.MergePatchType, body, dryRun(req))
+		if apierrors.IsConflict(err) {
+			latest, _ := writer.GetRaw(gvr, namespace, name)
+			writeConflict(w, fmt.Sprintf("%s %s/%s has changed since resourceVersion %s, apply the patch to the current version", resource.Name, namespace, name, resourceVersion), latest)
+			return
+		}
+		if hasErr(w, err) {
+			return
+		}
+
+		if dryRun(req) {
+			auditDetail(req, "dryRun", "true")
+		} else {
+			log.Println(resource.Name, namespace+"/"+name, "patched by", identityFrom(req).Username)
+		}
+		w.Write(result)
+	}
+}
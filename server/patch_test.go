@@ -0,0 +1,123 @@
+package server
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1alpha1 "github.com/kristofferahl/aeto/apis/core/v1alpha1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestGuardPatch(t *testing.T) {
+	current := corev1alpha1.Tenant{}
+	current.Namespace, current.Name, current.ResourceVersion = "aeto", "t1", "41"
+	current.Labels = map[string]string{"team": "a"}
+	current.Spec.Name = "Tenant 1"
+	current.Spec.Blueprint = "default"
+	original, err := json.Marshal(current)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name            string
+		patchType       types.PatchType
+		patch           string
+		want            string
+		resourceVersion string
+		err             string
+	}{
+		{
+			name:            "merge patch",
+			patchType:       types.MergePatchType,
+			patch:           `{"spec":{"blueprint":"large"}}`,
+			want:            `{"metadata":{"resourceVersion":"41"},"spec":{"blueprint":"large"}}`,
+			resourceVersion: "41",
+		},
+		{
+			name:            "merge patch removing a label",
+			patchType:       types.MergePatchType,
+			patch:           `{"metadata":{"labels":{"team":null}}}`,
+			want:            `{"metadata":{"labels":{"team":null},"resourceVersion":"41"}}`,
+			resourceVersion: "41",
+		},
+		{
+			name:            "merge patch without changes",
+			patchType:       types.MergePatchType,
+			patch:           `{"spec":{"blueprint":"default"}}`,
+			want:            `{"metadata":{"resourceVersion":"41"}}`,
+			resourceVersion: "41",
+		},
+		{
+			name:            "merge patch setting the resource version",
+			patchType:       types.MergePatchType,
+			patch:           `{"metadata":{"resourceVersion":"40"},"spec":{"blueprint":"large"}}`,
+			want:            `{"metadata":{"resourceVersion":"40"},"spec":{"blueprint":"large"}}`,
+			resourceVersion: "40",
+		},
+		{
+			name:            "merge patch removing the resource version",
+			patchType:       types.MergePatchType,
+			patch:           `{"metadata":{"resourceVersion":null},"spec":{"blueprint":"large"}}`,
+			want:            `{"metadata":{"resourceVersion":"41"},"spec":{"blueprint":"large"}}`,
+			resourceVersion: "41",
+		},
+		{
+			name:            "strategic merge patch",
+			patchType:       types.StrategicMergePatchType,
+			patch:           `{"metadata":{"labels":{"env":"prod"}}}`,
+			want:            `{"metadata":{"labels":{"env":"prod"},"resourceVersion":"41"}}`,
+			resourceVersion: "41",
+		},
+		{
+			name:      "renaming",
+			patchType: types.MergePatchType,
+			patch:     `{"metadata":{"name":"t2"}}`,
+			err:       "metadata.name and metadata.namespace can not be changed",
+		},
+		{
+			name:      "moving to another namespace",
+			patchType: types.StrategicMergePatchType,
+			patch:     `{"metadata":{"namespace":"default"}}`,
+			err:       "metadata.name and metadata.namespace can not be changed",
+		},
+		{
+			name:      "replacing the resource",
+			patchType: types.MergePatchType,
+			patch:     `["spec"]`,
+			err:       "failed to apply patch",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, resourceVersion, err := guardPatch(tt.patchType, original, []byte(tt.patch), &corev1alpha1.Tenant{})
+			if tt.err != "" {
+				if !apierrors.IsBadRequest(err) || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("got error %v, expected a bad request containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+
+			if resourceVersion != tt.resourceVersion {
+				t.Errorf("got resourceVersion %q, expected %q", resourceVersion, tt.resourceVersion)
+			}
+			var got, want interface{}
+			if err := json.Unmarshal(body, &got); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal([]byte(tt.want), &want); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got patch %s, expected %s", body, tt.want)
+			}
+		})
+	}
+}
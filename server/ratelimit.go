@@ -0,0 +1,234 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// RateLimitBucketAPI limits every api request
+	RateLimitBucketAPI = "api"
+	// RateLimitBucketDirect additionally limits requests bypassing the cache, ie making calls to the api server
+	RateLimitBucketDirect = "direct"
+
+	rateLimitIdleTimeout = 10 * time.Minute
+
+	metricsPath = "/metrics"
+
+	peerAddrContextKey contextKey = "peerAddr"
+)
+
+type rateLimitClient struct {
+	limiters map[string]*rate.Limiter
+	lastSeen time.Time
+}
+
+// RateLimiter keeps token buckets per client, identified by the username of the request or by the client ip for
+// anonymous requests. Every client has one bucket for each configured bucket name.
+type RateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]RateLimitBucketConfig
+	proxies   []*net.IPNet
+	clients   map[string]*rateLimitClient
+	idle      time.Duration
+	prunedAt  time.Time
+	allowed   map[string]uint64
+	throttled map[string]uint64
+}
+
+func NewRateLimiter(config RateLimitConfig) *RateLimiter {
+	proxies := make([]*net.IPNet, 0, len(config.TrustedProxies))
+	for _, cidr := range config.TrustedProxies {
+		if _, n, err := net.ParseCIDR(cidr); err == nil {
+			proxies = append(proxies, n)
+		}
+	}
+
+	buckets := map[string]RateLimitBucketConfig{
+		RateLimitBucketAPI:    config.API,
+		RateLimitBucketDirect: config.Direct,
+	}
+
+	// A client may only be forgotten once all of its buckets have refilled, or it would get a full burst back early
+	idle := rateLimitIdleTimeout
+	for _, b := range buckets {
+		if b.Rate <= 0 {
+			continue
+		}
+		if refill := time.Duration(float64(b.Burst) / b.Rate * float64(time.Second)); refill > idle {
+			idle = refill
+		}
+	}
+
+	return &RateLimiter{
+		buckets:   buckets,
+		proxies:   proxies,
+		clients:   make(map[string]*rateLimitClient),
+		idle:      idle,
+		prunedAt:  time.Now(),
+		allowed:   make(map[string]uint64),
+		throttled: make(map[string]uint64),
+	}
+}
+
+// Reserve takes a token from the bucket of the client. When the bucket is empty no token is taken and the time until
+// a token is available is returned.
+func (l *RateLimiter) Reserve(client, bucket string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.prune(now)
+
+	c, ok := l.clients[client]
+	if !ok {
+		c = &rateLimitClient{
+			limiters: make(map[string]*rate.Limiter),
+		}
+		l.clients[client] = c
+	}
+	c.lastSeen = now
+
+	limiter, ok := c.limiters[bucket]
+	if !ok {
+		config := l.buckets[bucket]
+		limiter = rate.NewLimiter(rate.Limit(config.Rate), config.Burst)
+		c.limiters[bucket] = limiter
+	}
+
+	reservation := limiter.ReserveN(now, 1)
+	if !reservation.OK() {
+		l.throttled[bucket]++
+		return false, time.Minute
+	}
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		l.throttled[bucket]++
+		return false, delay
+	}
+	l.allowed[bucket]++
+	return true, 0
+}
+
+// prune forgets clients that have not made any requests for as long as it takes their buckets to refill, they would be
+// full by now anyway.
+func (l *RateLimiter) prune(now time.Time) {
+	if now.Sub(l.prunedAt) < time.Minute {
+		return
+	}
+	l.prunedAt = now
+	for key, c := range l.clients {
+		if now.Sub(c.lastSeen) > l.idle {
+			delete(l.clients, key)
+		}
+	}
+}
+
+// WriteMetrics writes the throttling metrics in the prometheus text format.
+func (l *RateLimiter) WriteMetrics(w http.ResponseWriter) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	buckets := make([]string, 0, len(l.buckets))
+	for b := range l.buckets {
+		buckets = append(buckets, b)
+	}
+	sort.Strings(buckets)
+
+	fmt.Fprintln(w, "# HELP aeto_web_ratelimit_requests_total Api requests checked by the rate limiter.")
+	fmt.Fprintln(w, "# TYPE aeto_web_ratelimit_requests_total counter")
+	for _, b := range buckets {
+		fmt.Fprintf(w, "aeto_web_ratelimit_requests_total{bucket=%q,outcome=\"allowed\"} %d\n", b, l.allowed[b])
+		fmt.Fprintf(w, "aeto_web_ratelimit_requests_total{bucket=%q,outcome=\"throttled\"} %d\n", b, l.throttled[b])
+	}
+	fmt.Fprintln(w, "# HELP aeto_web_ratelimit_clients Clients with rate limit buckets.")
+	fmt.Fprintln(w, "# TYPE aeto_web_ratelimit_clients gauge")
+	fmt.Fprintf(w, "aeto_web_ratelimit_clients %d\n", len(l.clients))
+}
+
+// Key identifies the client of a request by its username, or by its ip when not authenticated. The ip is the address
+// the request was received from, which is only replaced by a forwarded address when received from a trusted proxy.
+func (l *RateLimiter) Key(req *http.Request) string {
+	identity := identityFrom(req)
+	if identity.Method != AuthMethodAnonymous {
+		return "user:" + identity.Username
+	}
+
+	peer := hostOf(req.RemoteAddr)
+	if addr, ok := req.Context().Value(peerAddrContextKey).(string); ok {
+		peer = hostOf(addr)
+	}
+	if ip := net.ParseIP(peer); ip != nil {
+		for _, n := range l.proxies {
+			if n.Contains(ip) {
+				return "ip:" + hostOf(req.RemoteAddr)
+			}
+		}
+	}
+	return "ip:" + peer
+}
+
+// keepPeerAddr remembers the address a request was received from before it is replaced by a forwarded address.
+func keepPeerAddr(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), peerAddrContextKey, req.RemoteAddr)))
+	})
+}
+
+func hostOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// throttle answers requests with 429 and a hint of when to retry once the client has used up its bucket.
+func throttle(s *Server, bucket string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if s.rateLimiter == nil {
+				next.ServeHTTP(w, req)
+				return
+			}
+
+			ok, delay := s.rateLimiter.Reserve(s.rateLimiter.Key(req), bucket)
+			if !ok {
+				auditDetail(req, "throttled", bucket)
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+				writeError(w, 429, fmt.Sprintf("too many requests, retry in %s", delay.Round(time.Millisecond)))
+				return
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
+// throttleResource applies the stricter direct bucket to resources that are not cached.
+func throttleResource(s *Server, resource apiResource) func(next http.Handler) http.Handler {
+	if resource.Cached {
+		return func(next http.Handler) http.Handler {
+			return next
+		}
+	}
+	return throttle(s, RateLimitBucketDirect)
+}
+
+func addMetricsRoutes(s *Server, router chi.Router) {
+	router.With(authorize(s, PermissionReadResources)).Get(metricsPath, func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if s.rateLimiter != nil {
+			s.rateLimiter.WriteMetrics(w)
+		}
+	})
+}
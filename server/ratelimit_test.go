@@ -0,0 +1,207 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/middleware"
+	"github.com/go-chi/chi/v5"
+)
+
+func TestRateLimiterReserve(t *testing.T) {
+	tests := []struct {
+		name    string
+		bucket  RateLimitBucketConfig
+		clients []string
+		allowed []bool
+	}{
+		{
+			name:    "within burst",
+			bucket:  RateLimitBucketConfig{Rate: 1, Burst: 3},
+			clients: []string{"a", "a", "a"},
+			allowed: []bool{true, true, true},
+		},
+		{
+			name:    "burst used up",
+			bucket:  RateLimitBucketConfig{Rate: 1, Burst: 2},
+			clients: []string{"a", "a", "a", "a"},
+			allowed: []bool{true, true, false, false},
+		},
+		{
+			name:    "buckets per client",
+			bucket:  RateLimitBucketConfig{Rate: 1, Burst: 1},
+			clients: []string{"a", "b", "a", "b", "c"},
+			allowed: []bool{true, true, false, false, true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewRateLimiter(RateLimitConfig{API: tt.bucket, Direct: tt.bucket})
+			for i, client := range tt.clients {
+				ok, delay := l.Reserve(client, RateLimitBucketAPI)
+				if ok != tt.allowed[i] {
+					t.Fatalf("request %d of %s allowed %t, expected %t", i, client, ok, tt.allowed[i])
+				}
+				if !ok && (delay <= 0 || delay > time.Second) {
+					t.Errorf("request %d of %s should be retried in %s, expected at most a second", i, client, delay)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimiterBuckets(t *testing.T) {
+	l := NewRateLimiter(RateLimitConfig{
+		API:    RateLimitBucketConfig{Rate: 1, Burst: 5},
+		Direct: RateLimitBucketConfig{Rate: 1, Burst: 1},
+	})
+
+	if ok, _ := l.Reserve("a", RateLimitBucketDirect); !ok {
+		t.Fatal("first direct request should be allowed")
+	}
+	if ok, _ := l.Reserve("a", RateLimitBucketDirect); ok {
+		t.Error("second direct request should be throttled")
+	}
+	if ok, _ := l.Reserve("a", RateLimitBucketAPI); !ok {
+		t.Error("api requests should not be throttled by the direct bucket")
+	}
+}
+
+func TestRateLimiterKey(t *testing.T) {
+	l := NewRateLimiter(RateLimitConfig{TrustedProxies: []string{"10.0.0.0/8"}})
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  string
+		identity   *Identity
+		want       string
+	}{
+		{
+			name:       "authenticated",
+			remoteAddr: "192.0.2.1:1234",
+			identity:   &Identity{Username: "jane", Method: AuthMethodSession},
+			want:       "user:jane",
+		},
+		{
+			name:       "anonymous",
+			remoteAddr: "192.0.2.1:1234",
+			want:       "ip:192.0.2.1",
+		},
+		{
+			name:       "forwarded by an untrusted client",
+			remoteAddr: "192.0.2.1:1234",
+			forwarded:  "198.51.100.7",
+			want:       "ip:192.0.2.1",
+		},
+		{
+			name:       "forwarded by a trusted proxy",
+			remoteAddr: "10.1.2.3:1234",
+			forwarded:  "198.51.100.7",
+			want:       "ip:198.51.100.7",
+		},
+		{
+			name:       "trusted proxy not forwarding",
+			remoteAddr: "10.1.2.3:1234",
+			want:       "ip:10.1.2.3",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ""
+			handler := keepPeerAddr(middleware.RealIP(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if tt.identity != nil {
+					req = withIdentity(req, tt.identity)
+				}
+				got = l.Key(req)
+			})))
+
+			req := httptest.NewRequest(http.MethodGet, "/api/tenants", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.forwarded != "" {
+				req.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			if got != tt.want {
+				t.Errorf("got key %q, expected %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimiterPrune(t *testing.T) {
+	tests := []struct {
+		name   string
+		bucket RateLimitBucketConfig
+		idle   time.Duration
+		pruned bool
+	}{
+		{name: "refilled", bucket: RateLimitBucketConfig{Rate: 1, Burst: 10}, idle: 11 * time.Minute, pruned: true},
+		{name: "idle but not refilled", bucket: RateLimitBucketConfig{Rate: 0.01, Burst: 10}, idle: 11 * time.Minute},
+		{name: "slow bucket refilled", bucket: RateLimitBucketConfig{Rate: 0.01, Burst: 10}, idle: 17 * time.Minute, pruned: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewRateLimiter(RateLimitConfig{API: tt.bucket, Direct: tt.bucket})
+			l.Reserve("a", RateLimitBucketAPI)
+
+			l.prune(l.clients["a"].lastSeen.Add(tt.idle))
+			if _, kept := l.clients["a"]; kept == tt.pruned {
+				t.Errorf("got client kept %t after %s, expected %t", kept, tt.idle, !tt.pruned)
+			}
+		})
+	}
+}
+
+func TestMetricsRoutes(t *testing.T) {
+	config := DefaultConfig()
+	config.Auth.Mode = AuthModeOIDC
+	config.Auth.DefaultRole = ""
+	config.Auth.Roles.Viewer = []string{"viewers"}
+	s := &Server{rateLimiter: NewRateLimiter(config.RateLimit)}
+	s.config.Store(&config)
+	s.authenticators = []authenticator{func(req *http.Request) (*Identity, error) {
+		if username := req.Header.Get("X-User"); username != "" {
+			return &Identity{Username: username, Groups: []string{req.Header.Get("X-Group")}, Method: AuthMethodToken}, nil
+		}
+		return nil, nil
+	}}
+
+	r := chi.NewRouter()
+	r.Group(func(r chi.Router) {
+		r.Use(authenticate(s))
+		addMetricsRoutes(s, r)
+	})
+
+	tests := []struct {
+		name   string
+		user   string
+		group  string
+		status int
+	}{
+		{name: "anonymous", status: 401},
+		{name: "without a role", user: "scraper", status: 403},
+		{name: "viewer", user: "scraper", group: "viewers", status: 200},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, metricsPath, nil)
+			if tt.user != "" {
+				req.Header.Set("X-User", tt.user)
+				req.Header.Set("X-Group", tt.group)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tt.status {
+				t.Errorf("got status %d, expected %d", w.Code, tt.status)
+			}
+		})
+	}
+}
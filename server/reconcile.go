@@ -0,0 +1,174 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	corev1alpha1 "github.com/kristofferahl/aeto/apis/core/v1alpha1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// reconcileAnnotation is bumped to make the operator reconcile a tenant
+	reconcileAnnotation = "web.aeto.net/reconcile-requested-at"
+
+	reconcileDefaultWait = 30 * time.Second
+	reconcileMaxWait     = 55 * time.Second
+)
+
+// TenantReconcile reports how far the operator has come reconciling a tenant after the reconcile annotation was bumped.
+// The tenant has caught up once its status was written after the bump and every condition observed its generation.
+type TenantReconcile struct {
+	Namespace          string       `json:"namespace"`
+	Name               string       `json:"name"`
+	RequestedAt        string       `json:"requestedAt"`
+	ResourceVersion    string       `json:"resourceVersion"`
+	Generation         int64        `json:"generation"`
+	ObservedGeneration int64        `json:"observedGeneration"`
+	Status             string       `json:"status,omitempty"`
+	Seen               bool         `json:"seen"`
+	Updated            bool         `json:"updated"`
+	CaughtUp           bool         `json:"caughtUp"`
+	WaitedSeconds      float64      `json:"waitedSeconds"`
+	Changes            []CacheEvent `json:"changes"`
+}
+
+// observe updates the progress from the cached tenant, returning false when the tenant is no longer cached.
+func (r *TenantReconcile) observe(client *AetoClient) bool {
+	tenants, _ := client.CoreV1Alpha1(r.Namespace).ListTenants(func(i corev1alpha1.Tenant) bool {
+		return i.Name == r.Name
+	})
+	if len(tenants.Items) == 0 {
+		return false
+	}
+	tenant := tenants.Items[0]
+
+	r.Generation = tenant.Generation
+	r.Status = tenant.Status.Status
+	r.ObservedGeneration = 0
+	for i, c := range tenant.Status.Conditions {
+		if i == 0 || c.ObservedGeneration < r.ObservedGeneration {
+			r.ObservedGeneration = c.ObservedGeneration
+		}
+	}
+	r.Seen = tenant.Annotations[reconcileAnnotation] == r.RequestedAt
+	r.Updated = r.Seen && tenant.ResourceVersion != r.ResourceVersion
+	r.CaughtUp = r.Updated && len(tenant.Status.Conditions) > 0 && r.ObservedGeneration >= r.Generation
+	return true
+}
+
+// reconcileWait returns how long to follow the changes of a tenant, ?wait=<duration> defaulting to 30s.
+func reconcileWait(req *http.Request) (time.Duration, error) {
+	v := req.URL.Query().Get("wait")
+	if v == "" {
+		return reconcileDefaultWait, nil
+	}
+	wait, err := time.ParseDuration(v)
+	if err != nil || wait < 0 {
+		return 0, fmt.Errorf("wait: %q is not a valid duration", v)
+	}
+	if wait > reconcileMaxWait {
+		wait = reconcileMaxWait
+	}
+	return wait, nil
+}
+
+func addReconcileRoutes(s *Server, r chi.Router) {
+	// Bumps the reconcile annotation of a tenant and follows the changes to it in the cache until its status has caught
+	// up or the wait is over. Answers 200 once caught up and 202 while the operator is still reconciling.
+	r.With(authorize(s, PermissionReconcileTenants), throttle(s, RateLimitBucketDirect)).Post("/tenants/{namespace}/{name}/reconcile", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		namespace := chi.URLParam(req, "namespace")
+		name := chi.URLParam(req, "name")
+
+		wait, err := reconcileWait(req)
+		if err != nil {
+			writeError(w, 400, err.Error())
+			return
+		}
+
+		client := clusterFrom(req).Client()
+		if notServed(w, client, tenantResource) {
+			return
+		}
+
+		tenants, _ := client.CoreV1Alpha1(namespace).ListTenants(func(i corev1alpha1.Tenant) bool {
+			return i.Name == name
+		})
+		if len(tenants.Items) == 0 {
+			writeError(w, 404, fmt.Sprintf("tenant %s/%s not found", namespace, name))
+			return
+		}
+
+		writer, err := s.writer(req, client, tenantResource, namespace)
+		if hasErr(w, err) {
+			return
+		}
+
+		// Subscribe before bumping the annotation so that no change is missed
+		changes, cancel := client.Changes().Subscribe()
+		defer cancel()
+
+		progress := &TenantReconcile{
+			Namespace:   namespace,
+			Name:        name,
+			RequestedAt: time.Now().UTC().Format(time.RFC3339Nano),
+			Changes:     make([]CacheEvent, 0),
+		}
+		patch, err := json.Marshal(map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"annotations": map[string]string{
+					reconcileAnnotation: progress.RequestedAt,
+				},
+			},
+		})
+		if hasErr(w, err) {
+			return
+		}
+
+		result, err := writer.PatchRaw(corev1alpha1.GroupVersion.WithResource(tenantResource.Name), namespace, name, types.MergePatchType, patch, false)
+		if hasErr(w, err) {
+			return
+		}
+		bumped := patchMetadata{}
+		if hasErr(w, json.Unmarshal(result, &bumped)) {
+			return
+		}
+		progress.ResourceVersion = bumped.Metadata.ResourceVersion
+		log.Println("tenant", namespace+"/"+name, "reconcile requested by", identityFrom(req).Username)
+
+		started := time.Now()
+		timeout := time.NewTimer(wait)
+		defer timeout.Stop()
+		resource := namespace + "/" + name
+	follow:
+		for progress.observe(client) && !progress.CaughtUp {
+			select {
+			case e := <-changes:
+				if e.Type == "Tenant" && e.Resource == resource {
+					progress.Changes = append(progress.Changes, e)
+				}
+			case <-timeout.C:
+				break follow
+			case <-req.Context().Done():
+				return
+			}
+		}
+		progress.WaitedSeconds = time.Since(started).Round(time.Millisecond).Seconds()
+		auditDetail(req, "caughtUp", fmt.Sprint(progress.CaughtUp))
+
+		data, err := json.Marshal(progress)
+		if hasErr(w, err) {
+			return
+		}
+
+		if !progress.CaughtUp {
+			w.WriteHeader(202)
+		}
+		w.Write(data)
+	})
+}
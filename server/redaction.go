@@ -0,0 +1,277 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+var (
+	secretDocumentExpr = regexp.MustCompile(`(?m)^kind:\s*["']?Secret["']?\s*$`)
+	documentSeparator  = regexp.MustCompile(`(?m)^---.*$`)
+	yamlKeyValueExpr   = regexp.MustCompile(`^(\s+[^:#]+:\s*)\S.*$`)
+)
+
+// Redactor masks sensitive values in resources before they are written to a response. It masks the data and
+// stringData of every embedded Secret, including Secrets in raw yaml, annotations with keys matching any of the
+// configured expressions and the values at the configured paths.
+type Redactor struct {
+	annotations []*regexp.Regexp
+	paths       []redactionPath
+}
+
+type redactionPath struct {
+	resource string
+	segments []string
+}
+
+func NewRedactor(config RedactionConfig) (*Redactor, error) {
+	r := &Redactor{}
+	for _, a := range config.Annotations {
+		expr, err := regexp.Compile(a)
+		if err != nil {
+			return nil, err
+		}
+		r.annotations = append(r.annotations, expr)
+	}
+	for _, p := range config.Paths {
+		r.paths = append(r.paths, redactionPath{
+			resource: p.Resource,
+			segments: strings.Split(p.Path, "."),
+		})
+	}
+	return r, nil
+}
+
+// Redact masks sensitive values of a resource, or of every item of a list, served for the named resource type.
+func (r *Redactor) Redact(resource string, v interface{}) interface{} {
+	v = r.walk(v)
+
+	objects := []interface{}{v}
+	if m, ok := v.(map[string]interface{}); ok {
+		if items, ok := m["items"].([]interface{}); ok {
+			objects = items
+		}
+	}
+	for _, p := range r.paths {
+		if p.resource != "" && p.resource != resource {
+			continue
+		}
+		for _, o := range objects {
+			maskPath(o, p.segments)
+		}
+	}
+	return v
+}
+
+func (r *Redactor) walk(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		if value["kind"] == "Secret" {
+			maskValues(value["data"])
+			maskValues(value["stringData"])
+		}
+		if metadata, ok := value["metadata"].(map[string]interface{}); ok {
+			if annotations, ok := metadata["annotations"].(map[string]interface{}); ok {
+				for key := range annotations {
+					if r.sensitiveAnnotation(key) {
+						annotations[key] = redactedValue
+					}
+				}
+			}
+		}
+		for k, child := range value {
+			value[k] = r.walk(child)
+		}
+		return value
+	case []interface{}:
+		for i, child := range value {
+			value[i] = r.walk(child)
+		}
+		return value
+	case string:
+		if secretDocumentExpr.MatchString(value) {
+			return redactRawSecrets(value)
+		}
+	}
+	return v
+}
+
+func (r *Redactor) sensitiveAnnotation(key string) bool {
+	for _, expr := range r.annotations {
+		if expr.MatchString(key) {
+			return true
+		}
+	}
+	return false
+}
+
+func maskValues(v interface{}) {
+	if m, ok := v.(map[string]interface{}); ok {
+		for k := range m {
+			m[k] = redactedValue
+		}
+	}
+}
+
+// maskPath masks the value at the path, where * matches every key of an object or every item of an array.
+func maskPath(v interface{}, segments []string) {
+	if len(segments) == 0 {
+		return
+	}
+	segment, rest := segments[0], segments[1:]
+
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for k, child := range value {
+			if segment != "*" && segment != k {
+				continue
+			}
+			if len(rest) == 0 {
+				value[k] = redactedValue
+			} else {
+				maskPath(child, rest)
+			}
+		}
+	case []interface{}:
+		for i, child := range value {
+			if segment != "*" && segment != strconv.Itoa(i) {
+				continue
+			}
+			if len(rest) == 0 {
+				value[i] = redactedValue
+			} else {
+				maskPath(child, rest)
+			}
+		}
+	}
+}
+
+// redactRawSecrets masks the data and stringData of Secrets in raw yaml documents. The documents may be go templates
+// and are therefore redacted line by line rather than parsed.
+func redactRawSecrets(raw string) string {
+	separators := documentSeparator.FindAllString(raw, -1)
+	documents := documentSeparator.Split(raw, -1)
+
+	var out strings.Builder
+	for i, doc := range documents {
+		if secretDocumentExpr.MatchString(doc) {
+			doc = redactSecretDocument(doc)
+		}
+		out.WriteString(doc)
+		if i < len(separators) {
+			out.WriteString(separators[i])
+		}
+	}
+	return out.String()
+}
+
+func redactSecretDocument(doc string) string {
+	lines := strings.Split(doc, "\n")
+	inData := false
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if !strings.HasPrefix(line, " ") && !strings.HasPrefix(line, "\t") {
+			inData = strings.HasPrefix(line, "data:") || strings.HasPrefix(line, "stringData:")
+			continue
+		}
+		if !inData {
+			continue
+		}
+		if m := yamlKeyValueExpr.FindStringSubmatch(line); m != nil && !strings.HasSuffix(trimmed, "|") && !strings.HasSuffix(trimmed, ">") {
+			lines[i] = m[1] + redactedValue
+		} else if m == nil {
+			lines[i] = line[:len(line)-len(strings.TrimLeft(line, " \t"))] + redactedValue
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// bufferedResponseWriter holds on to a response so that it may be changed before being written.
+type bufferedResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *bufferedResponseWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+func (w *bufferedResponseWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+// redactResponses masks sensitive values in successful json responses and in the current resource of conflicts. Admins
+// may reveal them with ?reveal=true, which is recorded in the audit log.
+func redactResponses(s *Server) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if reveal, _ := strconv.ParseBool(req.URL.Query().Get("reveal")); reveal {
+				identity := identityFrom(req)
+				if !s.permitted(identity, PermissionRevealSecrets) {
+					writeError(w, 403, fmt.Sprintf("%s is not permitted to %s", identity.Username, PermissionRevealSecrets))
+					return
+				}
+				auditDetail(req, "revealed", "true")
+				log.Println("redacted values revealed to", identity.Username, "for", req.URL.Path)
+				next.ServeHTTP(w, req)
+				return
+			}
+
+			bw := &bufferedResponseWriter{ResponseWriter: w, status: 200}
+			next.ServeHTTP(bw, req)
+
+			body := bw.body.Bytes()
+			success := bw.status >= 200 && bw.status < 300
+			conflict := bw.status == http.StatusConflict
+			if (success || conflict) && strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") && len(body) > 0 {
+				// Numbers are kept as they were written, int64 values do not survive a round trip through float64
+				var v interface{}
+				decoder := json.NewDecoder(bytes.NewReader(body))
+				decoder.UseNumber()
+				if err := decoder.Decode(&v); err != nil {
+					log.Println("failed to redact response,", err)
+					writeError(w, 500, "failed to redact response")
+					return
+				}
+
+				resource := ""
+				if rctx := chi.RouteContext(req.Context()); rctx != nil {
+					resource = auditResource(rctx.RoutePattern())
+				}
+
+				// Conflicts carry the current state of the resource next to the error
+				if conflict {
+					if m, ok := v.(map[string]interface{}); ok && m["current"] != nil {
+						m["current"] = s.redactor.Redact(resource, m["current"])
+					}
+				} else {
+					v = s.redactor.Redact(resource, v)
+				}
+
+				redacted, err := json.Marshal(v)
+				if err != nil {
+					log.Println("failed to redact response,", err)
+					writeError(w, 500, "failed to redact response")
+					return
+				}
+				body = redacted
+			}
+
+			w.Header().Del("Content-Length")
+			w.WriteHeader(bw.status)
+			w.Write(body)
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func decode(t *testing.T, data string) interface{} {
+	var v interface{}
+	decoder := json.NewDecoder(strings.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestRedact(t *testing.T) {
+	config := DefaultConfig().Redaction
+	config.Paths = []RedactionPath{
+		{Path: "spec.password"},
+		{Resource: "blueprints", Path: "spec.parameters.*.default"},
+	}
+	r, err := NewRedactor(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		resource string
+		in       string
+		want     string
+	}{
+		{
+			name: "secret data",
+			in:   `{"kind":"Secret","data":{"token":"c2VjcmV0"},"stringData":{"password":"secret"},"type":"Opaque"}`,
+			want: `{"kind":"Secret","data":{"token":"*****"},"stringData":{"password":"*****"},"type":"Opaque"}`,
+		},
+		{
+			name: "config map data",
+			in:   `{"kind":"ConfigMap","data":{"token":"not-a-secret"}}`,
+			want: `{"kind":"ConfigMap","data":{"token":"not-a-secret"}}`,
+		},
+		{
+			name: "embedded secret",
+			in:   `{"kind":"ResourceTemplate","spec":{"resources":[{"kind":"Secret","data":{"key":"dmFsdWU="}}]}}`,
+			want: `{"kind":"ResourceTemplate","spec":{"resources":[{"kind":"Secret","data":{"key":"*****"}}]}}`,
+		},
+		{
+			name: "raw secret yaml",
+			in:   `{"spec":{"raw":"kind: ConfigMap\ndata:\n  a: b\n---\nkind: Secret\ndata:\n  password: c2VjcmV0\n"}}`,
+			want: `{"spec":{"raw":"kind: ConfigMap\ndata:\n  a: b\n---\nkind: Secret\ndata:\n  password: *****\n"}}`,
+		},
+		{
+			name: "sensitive annotations",
+			in:   `{"metadata":{"annotations":{"example.com/api-key":"abc","example.com/owner":"jane"}}}`,
+			want: `{"metadata":{"annotations":{"example.com/api-key":"*****","example.com/owner":"jane"}}}`,
+		},
+		{
+			name: "path of every resource",
+			in:   `{"spec":{"password":"secret","user":"jane"}}`,
+			want: `{"spec":{"password":"*****","user":"jane"}}`,
+		},
+		{
+			name:     "path of a resource type",
+			resource: "blueprints",
+			in:       `{"spec":{"parameters":{"a":{"default":"x"},"b":{"default":"y","type":"string"}}}}`,
+			want:     `{"spec":{"parameters":{"a":{"default":"*****"},"b":{"default":"*****","type":"string"}}}}`,
+		},
+		{
+			name:     "path of another resource type",
+			resource: "tenants",
+			in:       `{"spec":{"parameters":{"a":{"default":"x"}}}}`,
+			want:     `{"spec":{"parameters":{"a":{"default":"x"}}}}`,
+		},
+		{
+			name: "list items",
+			in:   `{"items":[{"spec":{"password":"a"}},{"spec":{"password":"b"}}]}`,
+			want: `{"items":[{"spec":{"password":"*****"}},{"spec":{"password":"*****"}}]}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := r.Redact(tt.resource, decode(t, tt.in))
+			if want := decode(t, tt.want); !reflect.DeepEqual(got, want) {
+				data, _ := json.Marshal(got)
+				t.Errorf("got %s, expected %s", data, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedactResponses(t *testing.T) {
+	r, err := NewRedactor(RedactionConfig{Paths: []RedactionPath{{Path: "spec.password"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{redactor: r}
+
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		want   string
+	}{
+		{
+			name:   "success",
+			status: 200,
+			body:   `{"spec":{"password":"secret"}}`,
+			want:   `{"spec":{"password":"*****"}}`,
+		},
+		{
+			name:   "conflict",
+			status: 409,
+			body:   `{"error":"changed","current":{"spec":{"password":"secret"}}}`,
+			want:   `{"error":"changed","current":{"spec":{"password":"*****"}}}`,
+		},
+		{
+			name:   "conflict without current resource",
+			status: 409,
+			body:   `{"error":"changed"}`,
+			want:   `{"error":"changed"}`,
+		},
+		{
+			name:   "large integers",
+			status: 200,
+			body:   `{"metadata":{"generation":9007199254740993},"spec":{"password":"secret","replicas":1.5}}`,
+			want:   `{"metadata":{"generation":9007199254740993},"spec":{"password":"*****","replicas":1.5}}`,
+		},
+		{
+			name:   "error",
+			status: 400,
+			body:   `{"error":"invalid","spec":{"password":"secret"}}`,
+			want:   `{"error":"invalid","spec":{"password":"secret"}}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := redactResponses(s)(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodPatch, "/api/tenants/aeto/t1", nil))
+
+			if w.Code != tt.status {
+				t.Errorf("got status %d, expected %d", w.Code, tt.status)
+			}
+			if got, want := decode(t, w.Body.String()), decode(t, tt.want); !reflect.DeepEqual(got, want) {
+				t.Errorf("got %s, expected %s", w.Body.String(), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	RoleViewer   = "viewer"
+	RoleOperator = "operator"
+	RoleAdmin    = "admin"
+)
+
+// roles lists the roles from the least to the most permitted.
+var roles = []string{RoleViewer, RoleOperator, RoleAdmin}
+
+// roleRank returns the position of a role in roles, starting at 1, or 0 for unknown roles.
+func roleRank(role string) int {
+	for i, r := range roles {
+		if r == role {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// Permission is required by routes of the api. Every route declares the permission it requires using authorize.
+type Permission string
+
+const (
+	PermissionReadResources    Permission = "resources:read"
+	PermissionReadConfig       Permission = "config:read"
+	PermissionManageAPIKeys    Permission = "apikeys:manage"
+	PermissionReadAudit        Permission = "audit:read"
+	PermissionRevealSecrets    Permission = "secrets:reveal"
+	PermissionCreateTenants    Permission = "tenants:create"
+	PermissionDeleteTenants    Permission = "tenants:delete"
+	PermissionPatchResources   Permission = "resources:patch"
+	PermissionReconcileTenants Permission = "tenants:reconcile"
+	PermissionMigrateTenants   Permission = "tenants:migrate"
+	PermissionExportResources  Permission = "resources:export"
+	PermissionImportResources  Permission = "resources:import"
+	PermissionManageExpiry     Permission = "tenants:expiry"
+	PermissionManageSchedules  Permission = "schedules:manage"
+	PermissionOverrideSavings  Permission = "savingspolicies:override"
+)
+
+// rolePermissions lists the permissions of every role. Roles include the permissions of the roles before them.
+var rolePermissions = map[string][]Permission{
+	RoleViewer: {
+		PermissionReadResources,
+	},
+	RoleOperator: {
+		PermissionReadResources,
+		PermissionCreateTenants,
+		PermissionDeleteTenants,
+		PermissionPatchResources,
+		PermissionReconcileTenants,
+		PermissionMigrateTenants,
+		PermissionManageExpiry,
+		PermissionManageSchedules,
+		PermissionOverrideSavings,
+	},
+	RoleAdmin: {
+		PermissionReadResources,
+		PermissionCreateTenants,
+		PermissionDeleteTenants,
+		PermissionPatchResources,
+		PermissionReconcileTenants,
+		PermissionMigrateTenants,
+		PermissionManageExpiry,
+		PermissionManageSchedules,
+		PermissionOverrideSavings,
+		PermissionReadConfig,
+		PermissionManageAPIKeys,
+		PermissionReadAudit,
+		PermissionRevealSecrets,
+		PermissionExportResources,
+		PermissionImportResources,
+	},
+}
+
+// Me describes the identity of a request and what it is permitted to do.
+type Me struct {
+	Identity    *Identity    `json:"identity"`
+	Role        string       `json:"role,omitempty"`
+	Permissions []Permission `json:"permissions"`
+}
+
+// roleOf returns the role of an identity, or an empty string when the identity has no role.
+func (s *Server) roleOf(identity *Identity) string {
+	config := s.Config().Auth
+
+	switch identity.Method {
+	case AuthMethodAnonymous:
+		if config.Mode == AuthModeNone {
+			return config.AnonymousRole
+		}
+		return ""
+	case AuthMethodAPIKey:
+		return identity.Role
+	}
+
+	switch {
+	case len(config.Roles.Admin) > 0 && containsAny(identity.Groups, config.Roles.Admin):
+		return RoleAdmin
+	case len(config.Roles.Operator) > 0 && containsAny(identity.Groups, config.Roles.Operator):
+		return RoleOperator
+	case len(config.Roles.Viewer) > 0 && containsAny(identity.Groups, config.Roles.Viewer):
+		return RoleViewer
+	}
+	return config.DefaultRole
+}
+
+func (s *Server) permitted(identity *Identity, permission Permission) bool {
+	for _, p := range rolePermissions[s.roleOf(identity)] {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize only lets requests through when the identity of the request has the permission.
+func authorize(s *Server, permission Permission) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			identity := identityFrom(req)
+			if !s.permitted(identity, permission) {
+				writeError(w, 403, fmt.Sprintf("%s is not permitted to %s", identity.Username, permission))
+				return
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
+// addMeRoutes adds /me, available to every authenticated identity, for the UI to hide actions the user may not perform.
+func addMeRoutes(s *Server, router chi.Router) {
+	router.Get("/me", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		identity := identityFrom(req)
+		role := s.roleOf(identity)
+		me := Me{
+			Identity:    identity,
+			Role:        role,
+			Permissions: append([]Permission{}, rolePermissions[role]...),
+		}
+		sort.Slice(me.Permissions, func(i, j int) bool {
+			return me.Permissions[i] < me.Permissions[j]
+		})
+
+		data, err := json.Marshal(me)
+		if hasErr(w, err) {
+			return
+		}
+
+		w.Write(data)
+	})
+}
@@ -0,0 +1,396 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	sustainabilityv1alpha1 "github.com/kristofferahl/aeto/apis/sustainability/v1alpha1"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// suspendUntilAnnotation holds the RFC3339 time a savings policy is suspended until, keeping its resources awake.
+	// The operator removes it once passed.
+	suspendUntilAnnotation = "sustainability.aeto.net/suspend-until"
+	// suspendForAnnotation holds a duration the operator turns into suspendUntilAnnotation
+	suspendForAnnotation = "sustainability.aeto.net/suspend-for"
+	// resumeUntilAnnotation holds the RFC3339 time a savings policy is resumed until, ignoring its schedule
+	resumeUntilAnnotation = "web.aeto.net/resume-until"
+	// resumedScheduleAnnotation holds the schedule of a resumed savings policy, as json, to restore it with
+	resumedScheduleAnnotation = "web.aeto.net/resumed-schedule"
+
+	// resumedSchedule replaces the schedule of a resumed savings policy. The range ends before it starts so the
+	// operator never suspends the policy while at least one entry is kept, as the schedule requires.
+	resumedSchedule = "MON-MON 23:59-00:00 UTC"
+
+	// OverrideKeepAwake suspends the savings policy, keeping its resources awake while its schedule would put them to
+	// sleep. OverrideApplySavings resumes the savings policy, putting its resources to sleep while its schedule would
+	// keep them awake.
+	OverrideNone         = "none"
+	OverrideKeepAwake    = "keep-awake"
+	OverrideApplySavings = "apply-savings"
+
+	overrideCheckInterval = time.Minute
+)
+
+var savingsPolicyResource, _ = findResource("savingspolicies")
+
+// SavingsPolicyOverride describes a temporary override of the schedule of a savings policy. A policy kept awake leaves
+// its resources running until the override expires while a policy applying savings lets them sleep, even when its
+// schedule says otherwise. Schedule is the schedule the policy returns to once the override has expired. Suspended
+// reports whether the operator has suspended the savings, ie whether the resources are awake. Warning explains side
+// effects of the override a caller should be aware of.
+type SavingsPolicyOverride struct {
+	Namespace        string     `json:"namespace"`
+	Name             string     `json:"name"`
+	Override         string     `json:"override"`
+	Until            *time.Time `json:"until,omitempty"`
+	RemainingSeconds int64      `json:"remainingSeconds,omitempty"`
+	Schedule         []string   `json:"schedule"`
+	Suspended        bool       `json:"suspended"`
+	Warning          string     `json:"warning,omitempty"`
+	Error            string     `json:"error,omitempty"`
+}
+
+// SavingsOverride keeps the resources of a savings policy awake, or applies its savings, until a time or for a duration
+// from now.
+type SavingsOverride struct {
+	Action string     `json:"action"`
+	Until  *time.Time `json:"until,omitempty"`
+	For    *Duration  `json:"for,omitempty"`
+}
+
+// until returns when the override expires.
+func (o SavingsOverride) until(now time.Time) (time.Time, error) {
+	if o.Action != OverrideKeepAwake && o.Action != OverrideApplySavings {
+		return time.Time{}, fmt.Errorf("action: must be %s or %s, was %q", OverrideKeepAwake, OverrideApplySavings, o.Action)
+	}
+	var until time.Time
+	switch {
+	case o.Until != nil && o.For != nil:
+		return until, fmt.Errorf("only one of until and for may be set")
+	case o.Until != nil:
+		until = *o.Until
+	case o.For != nil:
+		until = now.Add(o.For.Duration)
+	default:
+		return until, fmt.Errorf("one of until or for must be set")
+	}
+	if !until.After(now) {
+		return until, fmt.Errorf("the override must expire in the future, was %s", until.UTC().Format(time.RFC3339))
+	}
+	return until.UTC(), nil
+}
+
+// savingsSchedule returns the schedule of a savings policy, as it was before savings were applied by an override.
+func savingsSchedule(policy sustainabilityv1alpha1.SavingsPolicy) ([]string, error) {
+	v, ok := policy.Annotations[resumedScheduleAnnotation]
+	if !ok {
+		return policy.Spec.Suspended, nil
+	}
+	schedule := make([]string, 0)
+	if err := json.Unmarshal([]byte(v), &schedule); err != nil || len(schedule) == 0 {
+		return policy.Spec.Suspended, fmt.Errorf("%s: %q is not a list of schedule entries", resumedScheduleAnnotation, v)
+	}
+	return schedule, nil
+}
+
+func savingsPolicyOverride(policy sustainabilityv1alpha1.SavingsPolicy, now time.Time) SavingsPolicyOverride {
+	o := SavingsPolicyOverride{
+		Namespace: policy.Namespace,
+		Name:      policy.Name,
+		Override:  OverrideNone,
+		Suspended: apimeta.IsStatusConditionTrue(policy.Status.Conditions, sustainabilityv1alpha1.ConditionTypeSuspended),
+	}
+	var err error
+	if o.Schedule, err = savingsSchedule(policy); err != nil {
+		o.Error = err.Error()
+	}
+
+	annotation := ""
+	switch {
+	case policy.Annotations[resumeUntilAnnotation] != "":
+		o.Override, annotation = OverrideApplySavings, resumeUntilAnnotation
+	case policy.Annotations[suspendUntilAnnotation] != "":
+		o.Override, annotation = OverrideKeepAwake, suspendUntilAnnotation
+	case policy.Annotations[suspendForAnnotation] != "":
+		// Until is known once the operator has turned the duration into a time
+		o.Override = OverrideKeepAwake
+		return o
+	default:
+		return o
+	}
+
+	until, err := time.Parse(time.RFC3339, policy.Annotations[annotation])
+	if err != nil {
+		o.Error = fmt.Sprintf("%s: %q is not an RFC3339 timestamp", annotation, policy.Annotations[annotation])
+		return o
+	}
+	o.Until = &until
+	if o.Override == OverrideApplySavings {
+		o.Warning = fmt.Sprintf("spec.suspended is replaced by %q until %s, the schedule is kept in the %s annotation and restored by the leading aeto-web replica once the override expires or right away when the override is removed", resumedSchedule, until.UTC().Format(time.RFC3339), resumedScheduleAnnotation)
+	}
+	if remaining := until.Sub(now); remaining > 0 {
+		o.RemainingSeconds = int64(remaining.Seconds())
+	} else if annotation == suspendUntilAnnotation {
+		// The operator has yet to remove the expired annotation
+		o.Override, o.Until = OverrideNone, nil
+	}
+	return o
+}
+
+// overridePatch returns the merge patch applying an override to a savings policy, or removing any override when the
+// action is none. The operator only knows how to suspend savings, so savings are applied by replacing the schedule,
+// which is restored unless it was changed in the meantime. The patch fails with a conflict when the policy has changed
+// since it was read.
+func overridePatch(policy sustainabilityv1alpha1.SavingsPolicy, action string, until time.Time) ([]byte, error) {
+	annotations := map[string]*string{
+		suspendUntilAnnotation:    nil,
+		suspendForAnnotation:      nil,
+		resumeUntilAnnotation:     nil,
+		resumedScheduleAnnotation: nil,
+	}
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"resourceVersion": policy.ResourceVersion,
+			"annotations":     annotations,
+		},
+	}
+
+	schedule, err := savingsSchedule(policy)
+	if err != nil {
+		return nil, err
+	}
+	_, resumed := policy.Annotations[resumedScheduleAnnotation]
+	if resumed && reflect.DeepEqual(policy.Spec.Suspended, []string{resumedSchedule}) {
+		patch["spec"] = map[string]interface{}{"suspended": schedule}
+	}
+
+	v := until.UTC().Format(time.RFC3339)
+	switch action {
+	case OverrideKeepAwake:
+		annotations[suspendUntilAnnotation] = &v
+	case OverrideApplySavings:
+		data, err := json.Marshal(schedule)
+		if err != nil {
+			return nil, err
+		}
+		saved := string(data)
+		annotations[resumeUntilAnnotation] = &v
+		annotations[resumedScheduleAnnotation] = &saved
+		patch["spec"] = map[string]interface{}{"suspended": []string{resumedSchedule}}
+	}
+	return json.Marshal(patch)
+}
+
+// overrideSavingsPolicy applies an override to a savings policy, answering with the override as it will be once the
+// operator has picked it up.
+func overrideSavingsPolicy(client *AetoClient, policy sustainabilityv1alpha1.SavingsPolicy, action string, until time.Time, dryRun bool) (SavingsPolicyOverride, error) {
+	patch, err := overridePatch(policy, action, until)
+	if err != nil {
+		return SavingsPolicyOverride{}, err
+	}
+
+	result, err := client.PatchRaw(sustainabilityv1alpha1.GroupVersion.WithResource(savingsPolicyResource.Name), policy.Namespace, policy.Name, types.MergePatchType, patch, dryRun)
+	if err != nil {
+		return SavingsPolicyOverride{}, err
+	}
+	patched := sustainabilityv1alpha1.SavingsPolicy{}
+	if err := json.Unmarshal(result, &patched); err != nil {
+		return SavingsPolicyOverride{}, err
+	}
+	return savingsPolicyOverride(patched, time.Now().UTC()), nil
+}
+
+// watchOverrides restores the schedule of savings policies applying savings once their override has expired, in every
+// cluster led by this replica. Policies kept awake are restored by the operator.
+func (s *Server) watchOverrides() {
+	for range time.Tick(overrideCheckInterval) {
+		for _, c := range s.clusters {
+			client := c.Client()
+			if client == nil || !client.Serves(savingsPolicyResource.GroupVersion) || !s.leads(c) {
+				continue
+			}
+			s.expireOverrides(c.Name, client)
+		}
+	}
+}
+
+func (s *Server) expireOverrides(cluster string, client *AetoClient) {
+	policies, err := client.SustainabilityV1Alpha1(s.Config().Namespaces.Operator).ListSavingsPolicies()
+	if err != nil {
+		log.Println("failed to list savings policies in cluster", cluster+",", err)
+		return
+	}
+
+	now := time.Now().UTC()
+	for _, policy := range policies.Items {
+		o := savingsPolicyOverride(policy, now)
+		if o.Override != OverrideApplySavings || o.Until == nil || o.Until.After(now) {
+			continue
+		}
+
+		id := policy.Namespace + "/" + policy.Name
+		_, err := overrideSavingsPolicy(client, policy, OverrideNone, now, false)
+		record := AuditRecord{
+			User:       systemUser,
+			AuthMethod: systemUser,
+			Action:     "override",
+			Mutation:   true,
+			Target: AuditTarget{
+				Cluster:   cluster,
+				Resource:  savingsPolicyResource.Name,
+				Namespace: policy.Namespace,
+				Name:      policy.Name,
+			},
+			Outcome: AuditOutcomeSuccess,
+			Details: map[string]string{
+				"override": OverrideNone,
+				"expired":  o.Until.Format(time.RFC3339),
+			},
+		}
+		if err != nil {
+			log.Println("failed to restore the schedule of savings policy", id, "in cluster", cluster+",", err)
+			record.Outcome = AuditOutcomeFailure
+			record.Details["error"] = err.Error()
+		} else {
+			log.Println("savings policy", id, "in cluster", cluster, "applying savings until", o.Until.Format(time.RFC3339), "is back on its schedule")
+		}
+		s.audit.Record(record)
+	}
+}
+
+func addSavingsRoutes(s *Server, r chi.Router, operatorNamespace string) {
+	r.With(authorize(s, PermissionReadResources), throttle(s, RateLimitBucketDirect)).Get("/overrides", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		client := clusterFrom(req).Client()
+		if notServed(w, client, savingsPolicyResource) {
+			return
+		}
+
+		reader, allowed, err := s.access(req, client, savingsPolicyResource)
+		if hasErr(w, err) {
+			return
+		}
+		policies, err := reader.SustainabilityV1Alpha1(operatorNamespace).ListSavingsPolicies()
+		if hasErr(w, err) {
+			return
+		}
+
+		now := time.Now().UTC()
+		overrides := make([]SavingsPolicyOverride, 0)
+		for _, p := range policies.Items {
+			if o := savingsPolicyOverride(p, now); o.Override != OverrideNone && allowed(p.Namespace, p.Name) {
+				overrides = append(overrides, o)
+			}
+		}
+		sort.Slice(overrides, func(i, j int) bool {
+			return overrides[i].Namespace+"/"+overrides[i].Name < overrides[j].Namespace+"/"+overrides[j].Name
+		})
+
+		data, err := json.Marshal(overrides)
+		if hasErr(w, err) {
+			return
+		}
+		w.Write(data)
+	})
+
+	// policy reads the savings policy named by the url, answering with 403 or 404 when it can not be read
+	policy := func(w http.ResponseWriter, req *http.Request) (*AetoClient, *sustainabilityv1alpha1.SavingsPolicy, bool) {
+		namespace := chi.URLParam(req, "namespace")
+		name := chi.URLParam(req, "name")
+
+		client := clusterFrom(req).Client()
+		if notServed(w, client, savingsPolicyResource) {
+			return nil, nil, false
+		}
+		reader, allowed, err := s.access(req, client, savingsPolicyResource)
+		if hasErr(w, err) {
+			return nil, nil, false
+		}
+		if !allowed(namespace, name) {
+			writeError(w, 403, fmt.Sprintf("%s is not allowed to get %s %s/%s", identityFrom(req).Username, savingsPolicyResource.Name, namespace, name))
+			return nil, nil, false
+		}
+		p, err := reader.SustainabilityV1Alpha1(namespace).GetSavingsPolicy(name)
+		if hasErr(w, err) {
+			return nil, nil, false
+		}
+		return client, p, true
+	}
+
+	r.With(authorize(s, PermissionReadResources), throttle(s, RateLimitBucketDirect)).Get("/savingspolicies/{namespace}/{name}/override", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		_, p, ok := policy(w, req)
+		if !ok {
+			return
+		}
+
+		data, err := json.Marshal(savingsPolicyOverride(*p, time.Now().UTC()))
+		if hasErr(w, err) {
+			return
+		}
+		w.Write(data)
+	})
+
+	changeOverride := func(remove bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+
+			o := SavingsOverride{Action: OverrideNone}
+			if !remove && !decodeJSON(w, req, &o) {
+				return
+			}
+			now := time.Now().UTC()
+			until := now
+			if !remove {
+				var err error
+				if until, err = o.until(now); err != nil {
+					writeError(w, 400, err.Error())
+					return
+				}
+				auditDetail(req, "until", until.Format(time.RFC3339))
+			}
+			auditDetail(req, "override", o.Action)
+
+			client, p, ok := policy(w, req)
+			if !ok {
+				return
+			}
+			writer, err := s.writer(req, client, savingsPolicyResource, p.Namespace)
+			if hasErr(w, err) {
+				return
+			}
+
+			override, err := overrideSavingsPolicy(writer, *p, o.Action, until, dryRun(req))
+			if hasErr(w, err) {
+				return
+			}
+
+			if dryRun(req) {
+				auditDetail(req, "dryRun", "true")
+			} else if remove {
+				log.Println("override of savings policy", p.Namespace+"/"+p.Name, "removed by", identityFrom(req).Username)
+			} else {
+				log.Println("override", o.Action, "of savings policy", p.Namespace+"/"+p.Name, "until", until.Format(time.RFC3339), "by", identityFrom(req).Username)
+			}
+
+			data, err := json.Marshal(override)
+			if hasErr(w, err) {
+				return
+			}
+			w.Write(data)
+		}
+	}
+	r.With(authorize(s, PermissionOverrideSavings), throttle(s, RateLimitBucketDirect)).Put("/savingspolicies/{namespace}/{name}/override", changeOverride(false))
+	r.With(authorize(s, PermissionOverrideSavings), throttle(s, RateLimitBucketDirect)).Delete("/savingspolicies/{namespace}/{name}/override", changeOverride(true))
+}
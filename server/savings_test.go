@@ -0,0 +1,82 @@
+package server
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	sustainabilityv1alpha1 "github.com/kristofferahl/aeto/apis/sustainability/v1alpha1"
+)
+
+func TestOverridePatch(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	until := now.Add(time.Hour)
+
+	policy := sustainabilityv1alpha1.SavingsPolicy{}
+	policy.Namespace, policy.Name, policy.ResourceVersion = "aeto", "p1", "41"
+	policy.Spec.Suspended = []string{"MON-FRI 08:00-18:00 UTC"}
+
+	tests := []struct {
+		name      string
+		action    string
+		override  string
+		suspended []string
+		warning   bool
+	}{
+		{name: "keep awake", action: OverrideKeepAwake, override: OverrideKeepAwake, suspended: policy.Spec.Suspended},
+		{name: "apply savings", action: OverrideApplySavings, override: OverrideApplySavings, suspended: []string{resumedSchedule}, warning: true},
+		{name: "none", action: OverrideNone, override: OverrideNone, suspended: policy.Spec.Suspended},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			patch, err := overridePatch(policy, tt.action, until)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := json.Marshal(policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			patched := sustainabilityv1alpha1.SavingsPolicy{}
+			if err := json.Unmarshal(mergePatch(t, data, patch), &patched); err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(patched.Spec.Suspended, tt.suspended) {
+				t.Errorf("got schedule %v, expected %v", patched.Spec.Suspended, tt.suspended)
+			}
+			o := savingsPolicyOverride(patched, now)
+			if o.Override != tt.override || !reflect.DeepEqual(o.Schedule, policy.Spec.Suspended) {
+				t.Errorf("got override %s with schedule %v, expected %s with %v", o.Override, o.Schedule, tt.override, policy.Spec.Suspended)
+			}
+			if warned := strings.Contains(o.Warning, resumedScheduleAnnotation); warned != tt.warning {
+				t.Errorf("got warning %q, expected a warning %t", o.Warning, tt.warning)
+			}
+
+			// Removing the override restores the schedule
+			restore, err := overridePatch(patched, OverrideNone, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			restored := sustainabilityv1alpha1.SavingsPolicy{}
+			if err := json.Unmarshal(mergePatch(t, mergePatch(t, data, patch), restore), &restored); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(restored.Spec.Suspended, policy.Spec.Suspended) || len(restored.Annotations) != 0 {
+				t.Errorf("got schedule %v and annotations %v after removing the override", restored.Spec.Suspended, restored.Annotations)
+			}
+		})
+	}
+}
+
+func mergePatch(t *testing.T, data, patch []byte) []byte {
+	merged, err := jsonpatch.MergePatch(data, patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return merged
+}
@@ -0,0 +1,497 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	corev1alpha1 "github.com/kristofferahl/aeto/apis/core/v1alpha1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	ScheduleSwitchBlueprint = "switch-blueprint"
+	ScheduleDelete          = "delete"
+	ScheduleKeepAwake       = OverrideKeepAwake
+	ScheduleApplySavings    = OverrideApplySavings
+
+	SchedulePending   = "pending"
+	ScheduleRunning   = "running"
+	ScheduleDone      = "done"
+	ScheduleFailed    = "failed"
+	ScheduleCancelled = "cancelled"
+
+	scheduleCheckInterval = 15 * time.Second
+	// scheduleRunningTimeout is how long a schedule may be running before it is considered interrupted
+	scheduleRunningTimeout = 5 * time.Minute
+)
+
+// Schedule is an action to run once at a later time by the leader of the cluster. Targets are identified by uid so that
+// a resource re-created with the same name is never changed by a schedule made for the one before it. The action is
+// run as RunAs when set, and as aeto-web otherwise.
+type Schedule struct {
+	ID         string         `json:"id"`
+	Action     string         `json:"action"`
+	At         time.Time      `json:"at"`
+	Target     ScheduleTarget `json:"target"`
+	Blueprint  string         `json:"blueprint,omitempty"`
+	Until      *time.Time     `json:"until,omitempty"`
+	Status     string         `json:"status"`
+	CreatedBy  string         `json:"createdBy"`
+	RunAs      *RunAs         `json:"runAs,omitempty"`
+	CreatedAt  time.Time      `json:"createdAt"`
+	UpdatedAt  time.Time      `json:"updatedAt"`
+	ExecutedAt *time.Time     `json:"executedAt,omitempty"`
+	Error      string         `json:"error,omitempty"`
+}
+
+type ScheduleTarget struct {
+	Resource  string    `json:"resource"`
+	Namespace string    `json:"namespace"`
+	Name      string    `json:"name"`
+	UID       types.UID `json:"uid,omitempty"`
+}
+
+// ScheduleRequest schedules switching the blueprint of a tenant, deleting a tenant or overriding a savings policy to keep
+// its resources awake or apply its savings until a time. The namespace defaults to the operator namespace for tenants.
+type ScheduleRequest struct {
+	Action    string     `json:"action"`
+	At        time.Time  `json:"at"`
+	Namespace string     `json:"namespace,omitempty"`
+	Name      string     `json:"name"`
+	Blueprint string     `json:"blueprint,omitempty"`
+	Until     *time.Time `json:"until,omitempty"`
+}
+
+func (sc Schedule) finished() bool {
+	return sc.Status == ScheduleDone || sc.Status == ScheduleFailed || sc.Status == ScheduleCancelled
+}
+
+// newScheduleStore returns the store of the schedules of a cluster, kept in a config map in the operator namespace.
+func newScheduleStore(client *AetoClient, config Config) configMapStore[Schedule] {
+	return configMapStore[Schedule]{
+		client:    client,
+		namespace: config.Namespaces.Operator,
+		name:      config.Scheduler.ConfigMap,
+	}
+}
+
+// scheduledBefore orders schedules by the time they run at.
+func scheduledBefore(a, b Schedule) bool {
+	if a.At.Equal(b.At) {
+		return a.ID < b.ID
+	}
+	return a.At.Before(b.At)
+}
+
+// validateSchedule checks the request and returns the schedule to create.
+func validateSchedule(client *AetoClient, operatorNamespace string, r ScheduleRequest, now time.Time) (Schedule, []string) {
+	problems := make([]string, 0)
+	sc := Schedule{
+		Action:    r.Action,
+		At:        r.At.UTC(),
+		Blueprint: r.Blueprint,
+		Status:    SchedulePending,
+		Target: ScheduleTarget{
+			Resource:  tenantResource.Name,
+			Namespace: r.Namespace,
+			Name:      r.Name,
+		},
+	}
+
+	if r.At.IsZero() {
+		problems = append(problems, "at: must be set")
+	} else if !r.At.After(now) {
+		problems = append(problems, fmt.Sprintf("at: must be in the future, was %s", r.At.Format(time.RFC3339)))
+	}
+	if r.Name == "" {
+		problems = append(problems, "name: must not be empty")
+	}
+
+	switch r.Action {
+	case ScheduleSwitchBlueprint, ScheduleDelete:
+		if sc.Target.Namespace == "" {
+			sc.Target.Namespace = operatorNamespace
+		}
+		if r.Until != nil {
+			problems = append(problems, fmt.Sprintf("until: only applies to %s and %s", ScheduleKeepAwake, ScheduleApplySavings))
+		}
+		if r.Action == ScheduleSwitchBlueprint {
+			blueprints, _ := client.CoreV1Alpha1(operatorNamespace).ListBlueprints(func(i corev1alpha1.Blueprint) bool {
+				return i.Name == r.Blueprint
+			})
+			if r.Blueprint == "" {
+				problems = append(problems, "blueprint: must not be empty")
+			} else if len(blueprints.Items) == 0 {
+				problems = append(problems, fmt.Sprintf("blueprint: blueprint %s/%s does not exist", operatorNamespace, r.Blueprint))
+			} else {
+				problems = append(problems, validateBlueprintTemplates(client, blueprints.Items[0])...)
+			}
+		} else if r.Blueprint != "" {
+			problems = append(problems, fmt.Sprintf("blueprint: only applies to %s", ScheduleSwitchBlueprint))
+		}
+		tenants, _ := client.CoreV1Alpha1(sc.Target.Namespace).ListTenants(func(i corev1alpha1.Tenant) bool {
+			return i.Name == r.Name
+		})
+		if r.Name != "" && len(tenants.Items) == 0 {
+			problems = append(problems, fmt.Sprintf("name: tenant %s/%s does not exist", sc.Target.Namespace, r.Name))
+		} else if len(tenants.Items) > 0 {
+			sc.Target.UID = tenants.Items[0].UID
+		}
+	case ScheduleKeepAwake, ScheduleApplySavings:
+		sc.Target.Resource = savingsPolicyResource.Name
+		if r.Namespace == "" {
+			problems = append(problems, "namespace: must not be empty")
+		}
+		if r.Blueprint != "" {
+			problems = append(problems, fmt.Sprintf("blueprint: only applies to %s", ScheduleSwitchBlueprint))
+		}
+		if r.Namespace != "" && r.Name != "" {
+			policy, err := client.SustainabilityV1Alpha1(r.Namespace).GetSavingsPolicy(r.Name)
+			if apierrors.IsNotFound(err) {
+				problems = append(problems, fmt.Sprintf("name: savings policy %s/%s does not exist", r.Namespace, r.Name))
+			} else if err != nil {
+				problems = append(problems, fmt.Sprintf("name: failed to read savings policy %s/%s, %s", r.Namespace, r.Name, err))
+			} else {
+				sc.Target.UID = policy.UID
+			}
+		}
+		if r.Until == nil {
+			problems = append(problems, "until: must be set")
+		} else if !r.Until.After(r.At) {
+			problems = append(problems, fmt.Sprintf("until: must be after at, was %s", r.Until.Format(time.RFC3339)))
+		} else {
+			until := r.Until.UTC()
+			sc.Until = &until
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("action: must be one of %s, %s, %s or %s, was %q", ScheduleSwitchBlueprint, ScheduleDelete, ScheduleKeepAwake, ScheduleApplySavings, r.Action))
+	}
+	return sc, problems
+}
+
+// runSchedule runs the action of a schedule, or with dryRun checks that it can be run.
+func runSchedule(client *AetoClient, sc Schedule, dryRun bool) error {
+	t := sc.Target
+	switch sc.Action {
+	case ScheduleSwitchBlueprint:
+		tenants, _ := client.CoreV1Alpha1(t.Namespace).ListTenants(func(i corev1alpha1.Tenant) bool {
+			return i.Name == t.Name
+		})
+		if len(tenants.Items) == 0 {
+			return fmt.Errorf("tenant %s/%s no longer exists", t.Namespace, t.Name)
+		}
+		if tenants.Items[0].UID != t.UID {
+			return fmt.Errorf("tenant %s/%s was re-created after the action was scheduled", t.Namespace, t.Name)
+		}
+		return setTenantBlueprint(client, tenants.Items[0], sc.Blueprint, dryRun)
+	case ScheduleDelete:
+		return client.CoreV1Alpha1(t.Namespace).DeleteTenant(t.Name, t.UID, "", dryRun)
+	case ScheduleKeepAwake, ScheduleApplySavings:
+		policy, err := client.SustainabilityV1Alpha1(t.Namespace).GetSavingsPolicy(t.Name)
+		if apierrors.IsNotFound(err) {
+			return fmt.Errorf("savings policy %s/%s no longer exists", t.Namespace, t.Name)
+		}
+		if err != nil {
+			return err
+		}
+		if policy.UID != t.UID {
+			return fmt.Errorf("savings policy %s/%s was re-created after the action was scheduled", t.Namespace, t.Name)
+		}
+		_, err = overrideSavingsPolicy(client, *policy, sc.Action, *sc.Until, dryRun)
+		return err
+	}
+	return fmt.Errorf("unknown action %q", sc.Action)
+}
+
+// watchSchedules runs the due schedules of every cluster led by this replica, when enabled.
+func (s *Server) watchSchedules() {
+	for range time.Tick(scheduleCheckInterval) {
+		config := s.Config()
+		if !config.Scheduler.Enabled {
+			continue
+		}
+		for _, c := range s.clusters {
+			client := c.Client()
+			if client == nil || !s.leads(c) {
+				continue
+			}
+			s.runSchedules(c.Name, client, config)
+		}
+	}
+}
+
+// runSchedules claims every due schedule by marking it running before running it, so that a schedule cancelled in the
+// meantime is never run. Schedules left running by a leader that went away are failed rather than run twice, and
+// finished schedules are removed once past the retention.
+func (s *Server) runSchedules(cluster string, client *AetoClient, config Config) {
+	store := newScheduleStore(client, config)
+	now := time.Now().UTC()
+
+	due := make([]Schedule, 0)
+	err := store.Update(func(schedules map[string]Schedule) error {
+		due = due[:0]
+		for id, sc := range schedules {
+			switch {
+			case sc.finished() && now.Sub(sc.UpdatedAt) > config.Scheduler.Retention.Duration:
+				delete(schedules, id)
+			case sc.Status == ScheduleRunning && (sc.ExecutedAt == nil || now.Sub(*sc.ExecutedAt) > scheduleRunningTimeout):
+				sc.Status, sc.Error, sc.UpdatedAt = ScheduleFailed, "interrupted before the action finished", now
+				schedules[id] = sc
+			case sc.Status == SchedulePending && !sc.At.After(now):
+				sc.Status, sc.ExecutedAt, sc.UpdatedAt = ScheduleRunning, &now, now
+				schedules[id] = sc
+				due = append(due, sc)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("failed to update schedules in cluster", cluster+",", err)
+		return
+	}
+
+	for _, sc := range due {
+		runner, err := client.RunAs(sc.RunAs)
+		if err == nil {
+			err = runSchedule(runner, sc, false)
+		}
+		record := AuditRecord{
+			User:       systemUser,
+			AuthMethod: systemUser,
+			Action:     "schedule",
+			Mutation:   true,
+			Target: AuditTarget{
+				Cluster:   cluster,
+				Resource:  sc.Target.Resource,
+				Namespace: sc.Target.Namespace,
+				Name:      sc.Target.Name,
+			},
+			Outcome: AuditOutcomeSuccess,
+			Details: map[string]string{
+				"id":        sc.ID,
+				"action":    sc.Action,
+				"createdBy": sc.CreatedBy,
+			},
+		}
+		if sc.RunAs != nil {
+			record.Details["runAs"] = sc.RunAs.Username
+		}
+		target := sc.Target.Namespace + "/" + sc.Target.Name
+		if err != nil {
+			log.Println("scheduled", sc.Action, "of", sc.Target.Resource, target, "in cluster", cluster, "failed,", err)
+			record.Outcome = AuditOutcomeFailure
+			record.Details["error"] = err.Error()
+		} else {
+			log.Println("scheduled", sc.Action, "of", sc.Target.Resource, target, "in cluster", cluster, "done")
+		}
+		s.audit.Record(record)
+
+		err = store.Update(func(schedules map[string]Schedule) error {
+			current, ok := schedules[sc.ID]
+			if !ok {
+				return nil
+			}
+			current.Status, current.UpdatedAt = ScheduleDone, time.Now().UTC()
+			if err != nil {
+				current.Status, current.Error = ScheduleFailed, err.Error()
+			}
+			schedules[sc.ID] = current
+			return nil
+		})
+		if err != nil {
+			log.Println("failed to update schedule", sc.ID, "in cluster", cluster+",", err)
+		}
+	}
+}
+
+func addScheduleRoutes(s *Server, r chi.Router, operatorNamespace string) {
+	// visible returns true when the identity of the request may see the target of a schedule
+	visible := func(req *http.Request, client *AetoClient) func(sc Schedule) bool {
+		allowed := map[string]allowFunc{
+			tenantResource.Name:        s.allowFunc(req, client, tenantResource.GroupVersion.WithResource(tenantResource.Name)),
+			savingsPolicyResource.Name: s.allowFunc(req, client, savingsPolicyResource.GroupVersion.WithResource(savingsPolicyResource.Name)),
+		}
+		return func(sc Schedule) bool {
+			allow, ok := allowed[sc.Target.Resource]
+			return ok && allow(sc.Target.Namespace, sc.Target.Name)
+		}
+	}
+
+	r.With(authorize(s, PermissionReadResources), throttle(s, RateLimitBucketDirect)).Get("/schedules", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		client := clusterFrom(req).Client()
+		list, err := newScheduleStore(client, s.Config()).List(scheduledBefore)
+		if hasErr(w, err) {
+			return
+		}
+
+		status := req.URL.Query().Get("status")
+		show := visible(req, client)
+		schedules := filter(list, func(sc Schedule) bool {
+			return (status == "" || sc.Status == status) && show(sc)
+		})
+
+		data, err := json.Marshal(schedules)
+		if hasErr(w, err) {
+			return
+		}
+		w.Write(data)
+	})
+
+	r.With(authorize(s, PermissionReadResources), throttle(s, RateLimitBucketDirect)).Get("/schedules/{id}", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		id := chi.URLParam(req, "id")
+
+		client := clusterFrom(req).Client()
+		_, schedules, err := newScheduleStore(client, s.Config()).get()
+		if hasErr(w, err) {
+			return
+		}
+		sc, ok := schedules[id]
+		if !ok || !visible(req, client)(sc) {
+			writeError(w, 404, fmt.Sprintf("schedule %s not found", id))
+			return
+		}
+
+		data, err := json.Marshal(sc)
+		if hasErr(w, err) {
+			return
+		}
+		w.Write(data)
+	})
+
+	// Schedules an action after checking, with a dry run made as the identity of the request, that it could be run
+	// now. ?dryRun=true returns the schedule without saving it.
+	r.With(authorize(s, PermissionManageSchedules), throttle(s, RateLimitBucketDirect)).Post("/schedules", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		request := ScheduleRequest{}
+		if !decodeJSON(w, req, &request) {
+			return
+		}
+
+		config := s.Config()
+		if !config.Scheduler.Enabled {
+			writeError(w, 409, "the scheduler is disabled")
+			return
+		}
+
+		client := clusterFrom(req).Client()
+		resource, permission := tenantResource, PermissionPatchResources
+		switch request.Action {
+		case ScheduleDelete:
+			permission = PermissionDeleteTenants
+		case ScheduleKeepAwake, ScheduleApplySavings:
+			resource, permission = savingsPolicyResource, PermissionOverrideSavings
+		}
+		if notServed(w, client, resource) {
+			return
+		}
+		identity := identityFrom(req)
+		if !s.permitted(identity, permission) {
+			writeError(w, 403, fmt.Sprintf("%s is not permitted to %s", identity.Username, permission))
+			return
+		}
+
+		now := time.Now().UTC()
+		sc, problems := validateSchedule(client, operatorNamespace, request, now)
+		if len(problems) > 0 {
+			writeErrors(w, 400, "invalid schedule", problems)
+			return
+		}
+		auditRecordFrom(req).Target.Namespace = sc.Target.Namespace
+		auditDetail(req, "action", sc.Action)
+		auditDetail(req, "at", sc.At.Format(time.RFC3339))
+
+		writer, err := s.writer(req, client, resource, sc.Target.Namespace)
+		if hasErr(w, err) {
+			return
+		}
+		if hasErr(w, runSchedule(writer, sc, true)) {
+			return
+		}
+
+		sc.CreatedBy, sc.RunAs = identity.Username, s.runAs(req)
+		sc.CreatedAt, sc.UpdatedAt = now, now
+		if dryRun(req) {
+			auditDetail(req, "dryRun", "true")
+			data, err := json.Marshal(sc)
+			if hasErr(w, err) {
+				return
+			}
+			w.Write(data)
+			return
+		}
+
+		sc.ID, err = randomHex(8)
+		if hasErr(w, err) {
+			return
+		}
+		err = newScheduleStore(client, config).Update(func(schedules map[string]Schedule) error {
+			schedules[sc.ID] = sc
+			return nil
+		})
+		if hasErr(w, err) {
+			return
+		}
+		auditRecordFrom(req).Target.Name = sc.ID
+		log.Println("scheduled", sc.Action, "of", sc.Target.Resource, sc.Target.Namespace+"/"+sc.Target.Name, "at", sc.At.Format(time.RFC3339), "by", sc.CreatedBy)
+
+		data, err := json.Marshal(sc)
+		if hasErr(w, err) {
+			return
+		}
+		w.WriteHeader(201)
+		w.Write(data)
+	})
+
+	// Cancels a pending schedule, the schedule is kept as cancelled until past the retention
+	r.With(authorize(s, PermissionManageSchedules)).Delete("/schedules/{id}", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		id := chi.URLParam(req, "id")
+		auditRecordFrom(req).Target.Name = id
+
+		client := clusterFrom(req).Client()
+		show := visible(req, client)
+		cancelled := Schedule{}
+		var notPending error
+		err := newScheduleStore(client, s.Config()).Update(func(schedules map[string]Schedule) error {
+			sc, ok := schedules[id]
+			if !ok || !show(sc) {
+				return errNotFound
+			}
+			if sc.Status != SchedulePending {
+				notPending = fmt.Errorf("schedule %s is %s and can no longer be cancelled", id, sc.Status)
+				return notPending
+			}
+			sc.Status, sc.UpdatedAt = ScheduleCancelled, time.Now().UTC()
+			schedules[id] = sc
+			cancelled = sc
+			return nil
+		})
+		switch {
+		case err == errNotFound:
+			writeError(w, 404, fmt.Sprintf("schedule %s not found", id))
+			return
+		case notPending != nil && err == notPending:
+			writeError(w, 409, err.Error())
+			return
+		}
+		if hasErr(w, err) {
+			return
+		}
+		log.Println("schedule", id, "cancelled by", identityFrom(req).Username)
+
+		data, err := json.Marshal(cancelled)
+		if hasErr(w, err) {
+			return
+		}
+		w.Write(data)
+	})
+}
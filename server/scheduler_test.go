@@ -0,0 +1,63 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestCancelSchedule(t *testing.T) {
+	config := DefaultConfig()
+	config.Auth.AnonymousRole = RoleOperator
+	s := &Server{}
+	s.config.Store(&config)
+
+	client := &AetoClient{kubernetes: fake.NewSimpleClientset()}
+	cluster := &Cluster{Name: "default"}
+	cluster.client.Store(client)
+
+	at := time.Date(2026, 10, 20, 12, 0, 0, 0, time.UTC)
+	target := ScheduleTarget{Resource: tenantResource.Name, Namespace: config.Namespaces.Operator, Name: "t1"}
+	err := newScheduleStore(client, config).Update(func(schedules map[string]Schedule) error {
+		schedules["pending"] = Schedule{ID: "pending", Action: ScheduleDelete, At: at, Target: target, Status: SchedulePending}
+		schedules["done"] = Schedule{ID: "done", Action: ScheduleDelete, At: at, Target: target, Status: ScheduleDone}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := chi.NewRouter()
+	r.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), clusterContextKey, cluster)))
+		})
+	})
+	addScheduleRoutes(s, r, config.Namespaces.Operator)
+
+	tests := []struct {
+		name   string
+		id     string
+		status int
+	}{
+		{name: "pending", id: "pending", status: 200},
+		{name: "cancelled", id: "pending", status: 409},
+		{name: "done", id: "done", status: 409},
+		{name: "missing", id: "missing", status: 404},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/schedules/"+tt.id, nil))
+			if w.Code != tt.status {
+				t.Errorf("got status %d, expected %d: %s", w.Code, tt.status, w.Body.String())
+			}
+		})
+	}
+}
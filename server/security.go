@@ -0,0 +1,92 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// securityHeaders adds headers protecting the UI and api against content injection, clickjacking and leaking urls.
+// Strict-Transport-Security is only sent when serving over TLS.
+func securityHeaders(s *Server) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			config := s.Config().Security.Headers
+			if config.Enabled {
+				h := w.Header()
+				h.Set("X-Content-Type-Options", "nosniff")
+				if config.ContentSecurityPolicy != "" {
+					h.Set("Content-Security-Policy", config.ContentSecurityPolicy)
+				}
+				if config.FrameOptions != "" {
+					h.Set("X-Frame-Options", config.FrameOptions)
+				}
+				if config.ReferrerPolicy != "" {
+					h.Set("Referrer-Policy", config.ReferrerPolicy)
+				}
+				if req.TLS != nil && config.HSTSMaxAge.Duration > 0 {
+					h.Set("Strict-Transport-Security", "max-age="+strconv.Itoa(int(config.HSTSMaxAge.Seconds()))+"; includeSubDomains")
+				}
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
+// csrfFormField is the form field carrying the CSRF token in forms posted by the UI.
+const csrfFormField = "csrf_token"
+
+// csrfProtection implements double-submit CSRF tokens. A random token is handed out in a cookie readable by the UI,
+// which must send it back in a header with every api request that is not a GET, HEAD or OPTIONS, or in the
+// csrfFormField of the logout form. Requests with a bearer token are not exposed to CSRF, as browsers never add that
+// header on their own, and are let through.
+func csrfProtection(s *Server) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			config := s.Config().Security.CSRF
+			if !config.Enabled {
+				next.ServeHTTP(w, req)
+				return
+			}
+
+			token := ""
+			if cookie, err := req.Cookie(config.CookieName); err == nil && cookie.Value != "" {
+				token = cookie.Value
+			} else {
+				t, err := randomString(32)
+				if hasErr(w, err) {
+					return
+				}
+				http.SetCookie(w, &http.Cookie{
+					Name:     config.CookieName,
+					Value:    t,
+					Path:     "/",
+					Secure:   s.Config().Auth.Session.Secure || secureRequest(req),
+					SameSite: http.SameSiteStrictMode,
+				})
+			}
+
+			safe := req.Method == http.MethodGet || req.Method == http.MethodHead || req.Method == http.MethodOptions
+			bearer := strings.HasPrefix(req.Header.Get("Authorization"), "Bearer ")
+			logout := req.URL.Path == oidcLogoutPath
+			if (strings.HasPrefix(req.URL.Path, "/api/") || logout) && !safe && !bearer {
+				header := req.Header.Get(config.HeaderName)
+				if header == "" && logout {
+					header = req.PostFormValue(csrfFormField)
+				}
+				if token == "" || subtle.ConstantTimeCompare([]byte(header), []byte(token)) != 1 {
+					writeError(w, 403, "missing or invalid CSRF token, send the value of the "+config.CookieName+" cookie in the "+config.HeaderName+" header")
+					return
+				}
+			}
+
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
+// secureRequest returns true when the request arrived over https, either directly or through a proxy terminating tls.
+func secureRequest(req *http.Request) bool {
+	return req.TLS != nil || strings.EqualFold(req.Header.Get("X-Forwarded-Proto"), "https")
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCSRFProtection(t *testing.T) {
+	config := DefaultConfig()
+	s := &Server{}
+	s.config.Store(&config)
+	csrf := config.Security.CSRF
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		cookie string
+		header string
+		form   string
+		bearer bool
+		status int
+	}{
+		{name: "safe api request", method: http.MethodGet, path: "/api/tenants", status: 200},
+		{name: "api request without token", method: http.MethodPost, path: "/api/tenants", cookie: "token", status: 403},
+		{name: "api request with token", method: http.MethodPost, path: "/api/tenants", cookie: "token", header: "token", status: 200},
+		{name: "api request with another token", method: http.MethodPost, path: "/api/tenants", cookie: "token", header: "other", status: 403},
+		{name: "api request with a bearer token", method: http.MethodPost, path: "/api/tenants", bearer: true, status: 200},
+		{name: "api request with the token in a form", method: http.MethodPost, path: "/api/tenants", cookie: "token", form: "token", status: 403},
+		{name: "logout form with token", method: http.MethodPost, path: oidcLogoutPath, cookie: "token", form: "token", status: 200},
+		{name: "logout form without token", method: http.MethodPost, path: oidcLogoutPath, cookie: "token", status: 403},
+		{name: "logout from another site", method: http.MethodPost, path: oidcLogoutPath, form: "token", status: 403},
+		{name: "other paths", method: http.MethodPost, path: "/auth/other", status: 200},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := csrfProtection(s)(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+
+			form := url.Values{}
+			if tt.form != "" {
+				form.Set(csrfFormField, tt.form)
+			}
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: csrf.CookieName, Value: tt.cookie})
+			}
+			if tt.header != "" {
+				req.Header.Set(csrf.HeaderName, tt.header)
+			}
+			if tt.bearer {
+				req.Header.Set("Authorization", "Bearer token")
+			}
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			if w.Code != tt.status {
+				t.Errorf("got status %d, expected %d", w.Code, tt.status)
+			}
+		})
+	}
+}
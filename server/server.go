@@ -5,36 +5,195 @@ import (
 	"io/fs"
 	"log"
 	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/go-chi/chi/middleware"
 	"github.com/go-chi/chi/v5"
 )
 
+const (
+	configReloadInterval = 10 * time.Second
+)
+
 type Server struct {
 	EmbeddedFiles     embed.FS
 	EmbeddedFilesPath string
-	ClusterConfig     bool
+	ConfigLoader      *ConfigLoader
+	config            atomic.Pointer[Config]
+	clusters          []*Cluster
+	sessions          *SessionStore
+	authenticators    []authenticator
+	apiKeys           *APIKeyStore
+	audit             *AuditLog
+	redactor          *Redactor
+	rateLimiter       *RateLimiter
 }
 
 func (s *Server) Run() {
+	config, err := s.ConfigLoader.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+	s.config.Store(&config)
+	s.sessions = NewSessionStore()
+	s.apiKeys = NewAPIKeyStore(config.Namespaces.Operator, config.Auth.APIKeys.Secret)
+	s.audit, err = NewAuditLog(config.Audit)
+	if err != nil {
+		log.Fatal("failed to open audit log, ", err)
+	}
+	s.redactor, err = NewRedactor(config.Redaction)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if config.RateLimit.Enabled {
+		s.rateLimiter = NewRateLimiter(config.RateLimit)
+	}
+
 	r := chi.NewRouter()
 
 	r.Use(middleware.RequestID)
+	r.Use(keepPeerAddr)
 	r.Use(middleware.RealIP)
-	r.Use(middleware.Logger)
+	r.Use(middleware.RequestLogger(&requestLogFormatter{}))
 	r.Use(middleware.Recoverer)
 	r.Use(middleware.Heartbeat("/health"))
+	r.Use(securityHeaders(s))
+	r.Use(csrfProtection(s))
+
+	if config.Auth.APIKeys.Enabled {
+		s.authenticators = append(s.authenticators, apiKeyAuthenticator(s))
+		go s.watchAPIKeyUsage()
+	}
+	if config.Auth.TokenReview.Enabled {
+		s.authenticators = append(s.authenticators, tokenAuthenticator(s))
+	}
+	addAuthRoutes(s, r)
+
+	r.Group(func(r chi.Router) {
+		r.Use(authenticate(s))
+
+		addMetricsRoutes(s, r)
+		addUiRoutes(s, r)
+		addApiRoutes(s, r)
+	})
 
-	addUiRoutes(s, r)
-	addApiRoutes(s, r)
+	go s.watchConfig()
+	go s.watchKubeconfig()
+	go s.watchCapabilities()
+	go s.watchExpiry()
+	go s.watchSchedules()
+	go s.watchMigrations()
+	go s.watchOverrides()
+	s.electLeaders()
 
-	log.Println("aeto server is listening on port 9000...")
-	err := http.ListenAndServe(":9000", r)
+	log.Printf("aeto server is listening on %s...", config.Listen)
+	if config.TLS.Enabled() {
+		err = http.ListenAndServeTLS(config.Listen, config.TLS.CertFile, config.TLS.KeyFile, r)
+	} else {
+		err = http.ListenAndServe(config.Listen, r)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
+// Config returns the current configuration of the server.
+func (s *Server) Config() Config {
+	return *s.config.Load()
+}
+
+func (s *Server) watchConfig() {
+	if s.ConfigLoader.Path == "" {
+		return
+	}
+
+	lastModified := modTime(s.ConfigLoader.Path)
+	for range time.Tick(configReloadInterval) {
+		modified := modTime(s.ConfigLoader.Path)
+		if modified.Equal(lastModified) {
+			continue
+		}
+		lastModified = modified
+		s.reloadConfig()
+	}
+}
+
+// reloadConfig applies changes to the parts of the configuration that are safe to change at runtime.
+// Changes to any other part of the configuration are logged and require a restart to take effect.
+func (s *Server) reloadConfig() {
+	next, err := s.ConfigLoader.Load()
+	if err != nil {
+		log.Println("configuration reload failed, keeping the current configuration,", err)
+		return
+	}
+
+	current := s.Config()
+	applied := current
+	applied.Retention = next.Retention
+	applied.Features = next.Features
+	applied.Security = next.Security
+	applied.Expiry = next.Expiry
+	applied.Scheduler = next.Scheduler
+
+	next.Retention = current.Retention
+	next.Features = current.Features
+	next.Security = current.Security
+	next.Expiry = current.Expiry
+	next.Scheduler = current.Scheduler
+	if changed := current.Changed(next); len(changed) > 0 {
+		log.Println("configuration changes to", strings.Join(changed, ", "), "require a restart to take effect")
+	}
+
+	s.config.Store(&applied)
+	for _, c := range s.clusters {
+		c.cache.changestream.Configure(applied)
+	}
+	log.Println("configuration reloaded from", s.ConfigLoader.Path)
+}
+
+// watchKubeconfig reconnects clusters using the local kubeconfig whenever the file changes, ie when switching context
+// or when credentials are refreshed.
+func (s *Server) watchKubeconfig() {
+	path := kubeconfigPath(s.Config().Kubernetes)
+	if path == "" {
+		return
+	}
+
+	lastModified := modTime(path)
+	for range time.Tick(configReloadInterval) {
+		modified := modTime(path)
+		if modified.Equal(lastModified) {
+			continue
+		}
+		lastModified = modified
+
+		config := s.Config()
+		for _, c := range s.clusters {
+			if !c.usesKubeconfig(config) || c.Client() == nil {
+				continue
+			}
+			log.Println("kubeconfig changed, reconnecting to cluster", c.Name)
+			if err := c.connect(config); err != nil {
+				log.Println("failed to reconnect to cluster", c.Name, "keeping the current connection,", err)
+			}
+		}
+	}
+}
+
+// watchCapabilities periodically re-checks which aeto api groups are served by each cluster.
+func (s *Server) watchCapabilities() {
+	for range time.Tick(capabilitiesInterval) {
+		config := s.Config()
+		for _, c := range s.clusters {
+			if client := c.Client(); client != nil {
+				c.discover(client, config)
+			}
+		}
+	}
+}
+
 func (s *Server) getAssets() fs.FS {
 	f, err := fs.Sub(s.EmbeddedFiles, s.EmbeddedFilesPath)
 
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Session is a server-side session of a user logged in through OIDC.
+type Session struct {
+	ID       string
+	Identity Identity
+	Expires  time.Time
+}
+
+// SessionStore keeps sessions in memory. Sessions are lost when the server restarts, requiring users to log in again,
+// and are only known to the replica that created them, running several replicas with auth mode oidc requires sticky
+// sessions.
+type SessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+func NewSessionStore() *SessionStore {
+	return &SessionStore{
+		sessions: make(map[string]*Session),
+	}
+}
+
+func (s *SessionStore) Create(identity Identity, ttl time.Duration) (*Session, error) {
+	id, err := randomString(32)
+	if err != nil {
+		return nil, err
+	}
+
+	session := &Session{
+		ID:       id,
+		Identity: identity,
+		Expires:  time.Now().Add(ttl),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[id] = session
+	s.removeExpired()
+
+	return session, nil
+}
+
+// Get returns the session with the given id or nil when there is no such session or it has expired.
+func (s *SessionStore) Get(id string) *Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[id]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(session.Expires) {
+		delete(s.sessions, id)
+		return nil
+	}
+	return session
+}
+
+func (s *SessionStore) Delete(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+}
+
+func (s *SessionStore) removeExpired() {
+	now := time.Now()
+	for id, session := range s.sessions {
+		if now.After(session.Expires) {
+			delete(s.sessions, id)
+		}
+	}
+}
+
+func sessionAuthenticator(s *Server) authenticator {
+	return func(req *http.Request) (*Identity, error) {
+		cookie, err := req.Cookie(s.Config().Auth.Session.CookieName)
+		if err != nil {
+			return nil, nil
+		}
+		session := s.sessions.Get(cookie.Value)
+		if session == nil {
+			return nil, nil
+		}
+		identity := session.Identity
+		return &identity, nil
+	}
+}
+
+func setSessionCookie(w http.ResponseWriter, req *http.Request, config SessionConfig, session *Session) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     config.CookieName,
+		Value:    session.ID,
+		Path:     "/",
+		Expires:  session.Expires,
+		HttpOnly: true,
+		Secure:   config.Secure || secureRequest(req),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func clearSessionCookie(w http.ResponseWriter, req *http.Request, config SessionConfig) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     config.CookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   config.Secure || secureRequest(req),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// loginCookieName is the name of the cookie keeping a pending OIDC login until the callback.
+func loginCookieName(config SessionConfig) string {
+	return config.CookieName + "-login"
+}
+
+func setLoginCookie(w http.ResponseWriter, req *http.Request, config SessionConfig, login pendingLogin) {
+	data, _ := json.Marshal(login)
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginCookieName(config),
+		Value:    base64.RawURLEncoding.EncodeToString(data),
+		Path:     oidcCallbackPath,
+		MaxAge:   int(oidcLoginTimeout.Seconds()),
+		HttpOnly: true,
+		Secure:   config.Secure || secureRequest(req),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// loginCookie returns the pending login of the browser, if any.
+func loginCookie(req *http.Request, config SessionConfig) (pendingLogin, bool) {
+	login := pendingLogin{}
+	cookie, err := req.Cookie(loginCookieName(config))
+	if err != nil {
+		return login, false
+	}
+	data, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil || json.Unmarshal(data, &login) != nil {
+		return login, false
+	}
+	return login, true
+}
+
+func clearLoginCookie(w http.ResponseWriter, req *http.Request, config SessionConfig) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginCookieName(config),
+		Value:    "",
+		Path:     oidcCallbackPath,
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   config.Secure || secureRequest(req),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+// configMapStore persists values as json in the data of a config map, keyed by id, so that every replica sees the same
+// values and they survive a restart.
+type configMapStore[T any] struct {
+	client    *AetoClient
+	namespace string
+	name      string
+}
+
+func (st configMapStore[T]) get() (*corev1.ConfigMap, map[string]T, error) {
+	values := make(map[string]T)
+	cm, err := st.client.kubernetes.CoreV1().ConfigMaps(st.namespace).Get(context.Background(), st.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, values, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	for id, data := range cm.Data {
+		var v T
+		if err := json.Unmarshal([]byte(data), &v); err != nil {
+			log.Println("ignoring invalid value", id, "in config map", st.namespace+"/"+st.name+",", err)
+			continue
+		}
+		values[id] = v
+	}
+	return cm, values, nil
+}
+
+// List returns the values ordered by less.
+func (st configMapStore[T]) List(less func(a, b T) bool) ([]T, error) {
+	_, values, err := st.get()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]T, 0, len(values))
+	for _, v := range values {
+		list = append(list, v)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return less(list[i], list[j])
+	})
+	return list, nil
+}
+
+// Update changes the values with fn and writes them back, starting over when the config map was changed by someone
+// else in the meantime. The config map is created on the first write.
+func (st configMapStore[T]) Update(fn func(values map[string]T) error) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, values, err := st.get()
+		if err != nil {
+			return err
+		}
+		if err := fn(values); err != nil {
+			return err
+		}
+
+		data := make(map[string]string, len(values))
+		for id, v := range values {
+			d, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			data[id] = string(d)
+		}
+
+		configMaps := st.client.kubernetes.CoreV1().ConfigMaps(st.namespace)
+		if cm == nil {
+			cm = &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      st.name,
+					Namespace: st.namespace,
+					Labels: map[string]string{
+						"app.kubernetes.io/managed-by": systemUser,
+					},
+				},
+				Data: data,
+			}
+			_, err = configMaps.Create(context.Background(), cm, metav1.CreateOptions{})
+			if apierrors.IsAlreadyExists(err) {
+				return apierrors.NewConflict(corev1.Resource("configmaps"), st.name, err)
+			}
+			return err
+		}
+		cm.Data = data
+		_, err = configMaps.Update(context.Background(), cm, metav1.UpdateOptions{})
+		return err
+	})
+}
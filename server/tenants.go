@@ -0,0 +1,419 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	corev1alpha1 "github.com/kristofferahl/aeto/apis/core/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+var tenantResource, _ = findResource("tenants")
+
+const (
+	tenantLabel = "aeto.net/tenant"
+)
+
+// TenantDeletion describes the progress of deleting a tenant, as seen by the informer cache.
+type TenantDeletion struct {
+	Namespace          string                `json:"namespace"`
+	Name               string                `json:"name"`
+	Deleted            bool                  `json:"deleted"`
+	Terminating        bool                  `json:"terminating"`
+	Status             string                `json:"status,omitempty"`
+	DeletionTimestamp  *metav1.Time          `json:"deletionTimestamp,omitempty"`
+	TerminatingSeconds int64                 `json:"terminatingSeconds,omitempty"`
+	Finalizers         []string              `json:"finalizers"`
+	ResourceSets       []ResourceSetDeletion `json:"resourceSets"`
+}
+
+type ResourceSetDeletion struct {
+	Namespace         string       `json:"namespace"`
+	Name              string       `json:"name"`
+	Status            string       `json:"status,omitempty"`
+	Terminating       bool         `json:"terminating"`
+	DeletionTimestamp *metav1.Time `json:"deletionTimestamp,omitempty"`
+	Finalizers        []string     `json:"finalizers"`
+}
+
+// TenantClone names the tenant to create from a source tenant. The spec of the source is copied along with the labels
+// and annotations listed, * copies all of them. Clones never inherit the expiry of their source.
+type TenantClone struct {
+	Name        string   `json:"name"`
+	SpecName    string   `json:"specName"`
+	Blueprint   string   `json:"blueprint,omitempty"`
+	Labels      []string `json:"labels,omitempty"`
+	Annotations []string `json:"annotations,omitempty"`
+}
+
+// cloneExcludedAnnotations are never copied to clones, on top of the annotations populated by the server.
+var cloneExcludedAnnotations = append([]string{expiresAtAnnotation, expiryNotifiedAnnotation}, serverAnnotations...)
+
+// newTenant returns the tenant to create from a requested tenant, keeping only its name, namespace, labels, annotations
+// and spec so that fields set by the api server, the operator or other controllers are never passed through.
+func newTenant(requested *corev1alpha1.Tenant) *corev1alpha1.Tenant {
+	tenant := &corev1alpha1.Tenant{}
+	tenant.Name = requested.Name
+	tenant.Namespace = requested.Namespace
+	tenant.Labels = requested.Labels
+	tenant.Annotations = requested.Annotations
+	tenant.Spec = requested.Spec
+	return tenant
+}
+
+// cloneTenant returns the manifest of a new tenant copied from the source.
+func cloneTenant(source corev1alpha1.Tenant, c TenantClone) *corev1alpha1.Tenant {
+	tenant := &corev1alpha1.Tenant{}
+	tenant.Name = c.Name
+	tenant.Namespace = source.Namespace
+	tenant.Spec = *source.Spec.DeepCopy()
+	tenant.Spec.Name = c.SpecName
+	if c.Blueprint != "" {
+		tenant.Spec.Blueprint = c.Blueprint
+	}
+	tenant.Labels = copyKeys(source.Labels, c.Labels, nil)
+	tenant.Annotations = copyKeys(source.Annotations, c.Annotations, cloneExcludedAnnotations)
+	return tenant
+}
+
+// copyKeys returns the entries of m with the given keys, or every entry for *, leaving out the excluded keys.
+func copyKeys(m map[string]string, keys []string, exclude []string) map[string]string {
+	result := make(map[string]string)
+	for k, v := range m {
+		if containsAny(exclude, []string{k}) {
+			continue
+		}
+		if containsAny(keys, []string{k, "*"}) {
+			result[k] = v
+		}
+	}
+	if len(result) == 0 {
+		return nil
+	}
+	return result
+}
+
+// tenantDeletion returns the deletion progress of a tenant. A tenant missing from the cache is reported as deleted,
+// along with any of its resource sets still remaining.
+func tenantDeletion(client *AetoClient, namespace, name string) TenantDeletion {
+	progress := TenantDeletion{
+		Namespace:    namespace,
+		Name:         name,
+		Finalizers:   make([]string, 0),
+		ResourceSets: make([]ResourceSetDeletion, 0),
+	}
+
+	core := client.CoreV1Alpha1(namespace)
+	tenants, _ := core.ListTenants(func(i corev1alpha1.Tenant) bool {
+		return i.Name == name
+	})
+
+	resourceSet := ""
+	if len(tenants.Items) == 0 {
+		progress.Deleted = true
+	} else {
+		tenant := tenants.Items[0]
+		progress.Status = tenant.Status.Status
+		progress.Finalizers = append(progress.Finalizers, tenant.Finalizers...)
+		if tenant.DeletionTimestamp != nil {
+			progress.Terminating = true
+			progress.DeletionTimestamp = tenant.DeletionTimestamp
+			progress.TerminatingSeconds = int64(time.Since(tenant.DeletionTimestamp.Time).Seconds())
+		}
+		resourceSet = tenant.Status.ResourceSet
+	}
+
+	resourceSets, _ := core.ListResourceSets(func(i corev1alpha1.ResourceSet) bool {
+		return i.Labels[tenantLabel] == name || (resourceSet != "" && i.NamespacedName().String() == resourceSet)
+	})
+	for _, rs := range resourceSets.Items {
+		progress.ResourceSets = append(progress.ResourceSets, ResourceSetDeletion{
+			Namespace:         rs.Namespace,
+			Name:              rs.Name,
+			Status:            string(rs.Status.Status),
+			Terminating:       rs.DeletionTimestamp != nil,
+			DeletionTimestamp: rs.DeletionTimestamp,
+			Finalizers:        append(make([]string, 0), rs.Finalizers...),
+		})
+	}
+
+	return progress
+}
+
+// validateTenant checks a tenant about to be created against the cache. Problems with the tenant itself are returned
+// as problems while conflicts with existing tenants are returned as conflicts.
+func validateTenant(client *AetoClient, namespace string, tenant *corev1alpha1.Tenant) (problems []string, conflicts []string) {
+	for _, msg := range validation.IsDNS1123Label(tenant.Name) {
+		problems = append(problems, fmt.Sprintf("metadata.name: %q %s", tenant.Name, msg))
+	}
+	if tenant.Namespace != "" && tenant.Namespace != namespace {
+		problems = append(problems, fmt.Sprintf("metadata.namespace: tenants must be created in %s", namespace))
+	}
+	if strings.TrimSpace(tenant.Spec.Name) == "" {
+		problems = append(problems, "spec.name: must not be empty")
+	}
+
+	core := client.CoreV1Alpha1(namespace)
+	blueprints, _ := core.ListBlueprints(func(i corev1alpha1.Blueprint) bool {
+		return i.Name == tenant.Blueprint()
+	})
+	if len(blueprints.Items) == 0 {
+		problems = append(problems, fmt.Sprintf("spec.blueprint: blueprint %s/%s does not exist", namespace, tenant.Blueprint()))
+	} else {
+		problems = append(problems, validateBlueprintTemplates(client, blueprints.Items[0])...)
+	}
+
+	tenants, _ := core.ListTenants()
+	for _, t := range tenants.Items {
+		if t.Name == tenant.Name {
+			conflicts = append(conflicts, fmt.Sprintf("metadata.name: tenant %s/%s already exists", namespace, tenant.Name))
+		}
+		if strings.EqualFold(t.Spec.Name, tenant.Spec.Name) && tenant.Spec.Name != "" {
+			conflicts = append(conflicts, fmt.Sprintf("spec.name: %q is already used by tenant %s/%s", tenant.Spec.Name, namespace, t.Name))
+		}
+	}
+
+	return problems, conflicts
+}
+
+// validateBlueprintTemplates checks that every resource template referenced by the blueprint exists.
+func validateBlueprintTemplates(client *AetoClient, blueprint corev1alpha1.Blueprint) []string {
+	problems := make([]string, 0)
+	for _, group := range blueprint.Spec.Resources {
+		namespace, name := blueprint.Namespace, group.Template
+		if parts := strings.SplitN(group.Template, "/", 2); len(parts) == 2 {
+			namespace, name = parts[0], parts[1]
+		}
+		templates, _ := client.CoreV1Alpha1(namespace).ListResourceTemplates(func(i corev1alpha1.ResourceTemplate) bool {
+			return i.Name == name
+		})
+		if len(templates.Items) == 0 {
+			problems = append(problems, fmt.Sprintf("spec.blueprint: resource template %s/%s used by blueprint %s for %s does not exist", namespace, name, blueprint.Name, group.Name))
+		}
+	}
+	return problems
+}
+
+// writeValidationError answers with 400 for problems and 409 for conflicts, or returns false when there are none.
+func writeValidationError(w http.ResponseWriter, problems []string, conflicts []string) bool {
+	if len(problems) > 0 {
+		writeErrors(w, 400, "invalid tenant", problems)
+		return true
+	}
+	if len(conflicts) > 0 {
+		writeErrors(w, 409, "conflicting tenant", conflicts)
+		return true
+	}
+	return false
+}
+
+func writeErrors(w http.ResponseWriter, status int, message string, problems []string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	data, _ := json.Marshal(struct {
+		Error    string   `json:"error"`
+		Problems []string `json:"problems"`
+	}{
+		Error:    message,
+		Problems: problems,
+	})
+	w.Write(data)
+}
+
+// dryRun returns true when the request asks for a server-side dry-run with ?dryRun=true.
+func dryRun(req *http.Request) bool {
+	v, _ := strconv.ParseBool(req.URL.Query().Get("dryRun"))
+	return v
+}
+
+func addTenantRoutes(s *Server, r chi.Router, operatorNamespace string) {
+	r.With(authorize(s, PermissionCreateTenants), throttle(s, RateLimitBucketDirect)).Post("/tenants", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		requested := &corev1alpha1.Tenant{}
+		if !decodeJSON(w, req, requested) {
+			return
+		}
+		tenant := newTenant(requested)
+		auditRecordFrom(req).Target.Name = tenant.Name
+		auditRecordFrom(req).Target.Namespace = operatorNamespace
+
+		client := clusterFrom(req).Client()
+		if notServed(w, client, tenantResource) {
+			return
+		}
+
+		writer, err := s.creator(req, client, tenantResource, operatorNamespace)
+		if hasErr(w, err) {
+			return
+		}
+
+		problems, conflicts := validateTenant(client, operatorNamespace, tenant)
+		if writeValidationError(w, problems, conflicts) {
+			return
+		}
+		tenant.Namespace = operatorNamespace
+
+		created, err := writer.CoreV1Alpha1(operatorNamespace).CreateTenant(tenant, dryRun(req))
+		if hasErr(w, err) {
+			return
+		}
+
+		data, err := json.Marshal(created)
+		if hasErr(w, err) {
+			return
+		}
+
+		if dryRun(req) {
+			auditDetail(req, "dryRun", "true")
+			w.Write(data)
+			return
+		}
+		log.Println("tenant", created.Namespace+"/"+created.Name, "created by", identityFrom(req).Username)
+		w.WriteHeader(201)
+		w.Write(data)
+	})
+
+	// Clones a tenant, ?dryRun=true previews the manifest of the tenant that would be created
+	r.With(authorize(s, PermissionCreateTenants), throttle(s, RateLimitBucketDirect)).Post("/tenants/{namespace}/{name}/clone", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		namespace := chi.URLParam(req, "namespace")
+		name := chi.URLParam(req, "name")
+
+		c := TenantClone{}
+		if !decodeJSON(w, req, &c) {
+			return
+		}
+
+		client := clusterFrom(req).Client()
+		if notServed(w, client, tenantResource) {
+			return
+		}
+
+		allowed := s.allowFunc(req, client, corev1alpha1.GroupVersion.WithResource(tenantResource.Name))
+		if !allowed(namespace, name) {
+			writeError(w, 403, fmt.Sprintf("%s is not allowed to get %s %s/%s", identityFrom(req).Username, tenantResource.Name, namespace, name))
+			return
+		}
+		tenants, _ := client.CoreV1Alpha1(namespace).ListTenants(func(i corev1alpha1.Tenant) bool {
+			return i.Name == name
+		})
+		if len(tenants.Items) == 0 {
+			writeError(w, 404, fmt.Sprintf("tenant %s/%s not found", namespace, name))
+			return
+		}
+
+		tenant := cloneTenant(tenants.Items[0], c)
+		auditRecordFrom(req).Target.Name = tenant.Name
+		auditDetail(req, "source", namespace+"/"+name)
+
+		writer, err := s.creator(req, client, tenantResource, namespace)
+		if hasErr(w, err) {
+			return
+		}
+
+		problems, conflicts := validateTenant(client, namespace, tenant)
+		if writeValidationError(w, problems, conflicts) {
+			return
+		}
+
+		created, err := writer.CoreV1Alpha1(namespace).CreateTenant(tenant, dryRun(req))
+		if hasErr(w, err) {
+			return
+		}
+
+		data, err := json.Marshal(created)
+		if hasErr(w, err) {
+			return
+		}
+
+		if dryRun(req) {
+			auditDetail(req, "dryRun", "true")
+			w.Write(data)
+			return
+		}
+		log.Println("tenant", created.Namespace+"/"+created.Name, "cloned from", name, "by", identityFrom(req).Username)
+		w.WriteHeader(201)
+		w.Write(data)
+	})
+
+	// Deleting a tenant requires its name to be typed again, passed as ?confirm=<name>
+	r.With(authorize(s, PermissionDeleteTenants), throttle(s, RateLimitBucketDirect)).Delete("/tenants/{namespace}/{name}", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		namespace := chi.URLParam(req, "namespace")
+		name := chi.URLParam(req, "name")
+
+		if req.URL.Query().Get("confirm") != name {
+			writeError(w, 400, fmt.Sprintf("confirm the deletion by passing the name of the tenant, ?confirm=%s", name))
+			return
+		}
+
+		client := clusterFrom(req).Client()
+		if notServed(w, client, tenantResource) {
+			return
+		}
+
+		tenants, _ := client.CoreV1Alpha1(namespace).ListTenants(func(i corev1alpha1.Tenant) bool {
+			return i.Name == name
+		})
+		if len(tenants.Items) == 0 {
+			writeError(w, 404, fmt.Sprintf("tenant %s/%s not found", namespace, name))
+			return
+		}
+		tenant := tenants.Items[0]
+
+		client, err := s.writer(req, client, tenantResource, namespace)
+		if hasErr(w, err) {
+			return
+		}
+
+		if hasErr(w, client.CoreV1Alpha1(namespace).DeleteTenant(name, tenant.UID, "", dryRun(req))) {
+			return
+		}
+
+		data, err := json.Marshal(tenantDeletion(client, namespace, name))
+		if hasErr(w, err) {
+			return
+		}
+
+		if dryRun(req) {
+			auditDetail(req, "dryRun", "true")
+			w.Write(data)
+			return
+		}
+		log.Println("tenant", namespace+"/"+name, "deleted by", identityFrom(req).Username)
+		w.WriteHeader(202)
+		w.Write(data)
+	})
+
+	r.With(authorize(s, PermissionReadResources)).Get("/tenants/{namespace}/{name}/deletion", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		namespace := chi.URLParam(req, "namespace")
+		name := chi.URLParam(req, "name")
+
+		client := clusterFrom(req).Client()
+		if notServed(w, client, tenantResource) {
+			return
+		}
+
+		allowed := s.allowFunc(req, client, corev1alpha1.GroupVersion.WithResource(tenantResource.Name))
+		if !allowed(namespace, name) {
+			writeError(w, 403, fmt.Sprintf("%s is not allowed to get %s %s/%s", identityFrom(req).Username, tenantResource.Name, namespace, name))
+			return
+		}
+
+		data, err := json.Marshal(tenantDeletion(client, namespace, name))
+		if hasErr(w, err) {
+			return
+		}
+
+		w.Write(data)
+	})
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	corev1alpha1 "github.com/kristofferahl/aeto/apis/core/v1alpha1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestNewTenant(t *testing.T) {
+	now := metav1.Now()
+	requested := &corev1alpha1.Tenant{}
+	requested.Name, requested.Namespace = "t1", "aeto"
+	requested.Labels = map[string]string{"team": "a"}
+	requested.Annotations = map[string]string{"owner": "jane"}
+	requested.Spec.Name, requested.Spec.Blueprint = "Tenant 1", "default"
+	requested.ResourceVersion = "41"
+	requested.UID = "1234"
+	requested.Generation = 3
+	requested.Finalizers = []string{"core.aeto.net/finalizer"}
+	requested.OwnerReferences = []metav1.OwnerReference{{Name: "owner"}}
+	requested.ManagedFields = []metav1.ManagedFieldsEntry{{Manager: "kubectl"}}
+	requested.DeletionTimestamp = &now
+	requested.Status.Status = "Reconciling"
+
+	want := &corev1alpha1.Tenant{}
+	want.Name, want.Namespace = "t1", "aeto"
+	want.Labels = map[string]string{"team": "a"}
+	want.Annotations = map[string]string{"owner": "jane"}
+	want.Spec.Name, want.Spec.Blueprint = "Tenant 1", "default"
+
+	if got := newTenant(requested); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, expected %+v", got, want)
+	}
+}
+
+func TestCreator(t *testing.T) {
+	kubernetes := fake.NewSimpleClientset()
+	kubernetes.PrependReactor("create", "subjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+		review.Status.Allowed = review.Spec.User == "jane" && review.Spec.ResourceAttributes.Verb == "create"
+		return true, review, nil
+	})
+	client := &AetoClient{
+		restConfig: &rest.Config{Host: "https://kubernetes.example.com"},
+		kubernetes: kubernetes,
+		reviewer:   NewAccessReviewer(kubernetes),
+	}
+
+	tests := []struct {
+		name         string
+		impersonate  bool
+		identity     *Identity
+		impersonated bool
+		forbidden    bool
+	}{
+		{name: "without impersonation", identity: &Identity{Username: "joe", Method: AuthMethodSession}},
+		{name: "anonymous", impersonate: true, identity: anonymous},
+		{name: "allowed", impersonate: true, identity: &Identity{Username: "jane", Method: AuthMethodSession}, impersonated: true},
+		{name: "not allowed", impersonate: true, identity: &Identity{Username: "joe", Method: AuthMethodSession}, forbidden: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DefaultConfig()
+			config.Auth.Impersonate = tt.impersonate
+			s := &Server{}
+			s.config.Store(&config)
+			req := withIdentity(httptest.NewRequest(http.MethodPost, "/api/tenants", nil), tt.identity)
+
+			writer, err := s.creator(req, client, tenantResource, "aeto")
+			if tt.forbidden {
+				if !apierrors.IsForbidden(err) {
+					t.Errorf("got error %v, expected forbidden", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if impersonated := writer != client; impersonated != tt.impersonated {
+				t.Errorf("got impersonated %t, expected %t", impersonated, tt.impersonated)
+			}
+		})
+	}
+}
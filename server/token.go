@@ -0,0 +1,122 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	tokenReviewTTL        = 1 * time.Minute
+	tokenReviewFailureTTL = 10 * time.Second
+)
+
+type tokenReview struct {
+	identity *Identity
+	err      error
+	expires  time.Time
+}
+
+// TokenReviewer validates bearer tokens using TokenReviews. Results are cached briefly, keyed by a hash of the token,
+// so that automation making many requests does not cause a review for each of them.
+type TokenReviewer struct {
+	mu      sync.Mutex
+	reviews map[string]tokenReview
+}
+
+func NewTokenReviewer() *TokenReviewer {
+	return &TokenReviewer{
+		reviews: make(map[string]tokenReview),
+	}
+}
+
+// Review returns the identity the token belongs to, or an error when the token is not valid for the cluster.
+func (r *TokenReviewer) Review(req *http.Request, cluster *Cluster, token string, config TokenReviewConfig) (*Identity, error) {
+	sum := sha256.Sum256([]byte(token))
+	key := hex.EncodeToString(sum[:])
+
+	r.mu.Lock()
+	if review, ok := r.reviews[key]; ok && time.Now().Before(review.expires) {
+		r.mu.Unlock()
+		return review.identity, review.err
+	}
+	r.mu.Unlock()
+
+	client := cluster.Client()
+	if client == nil {
+		return nil, fmt.Errorf("unable to review token, not yet connected to cluster %s", cluster.Name)
+	}
+
+	result, err := client.kubernetes.AuthenticationV1().TokenReviews().Create(req.Context(), &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{
+			Token:     token,
+			Audiences: config.Audiences,
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		log.Println("failed to review token using cluster", cluster.Name, err)
+		return nil, fmt.Errorf("unable to review token")
+	}
+
+	review := tokenReview{
+		expires: time.Now().Add(tokenReviewTTL),
+	}
+	if result.Status.Authenticated {
+		review.identity = &Identity{
+			Username: result.Status.User.Username,
+			Groups:   result.Status.User.Groups,
+			Method:   AuthMethodToken,
+		}
+	} else {
+		review.err = fmt.Errorf("invalid token")
+		review.expires = time.Now().Add(tokenReviewFailureTTL)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	for k, rv := range r.reviews {
+		if now.After(rv.expires) {
+			delete(r.reviews, k)
+		}
+	}
+	r.reviews[key] = review
+
+	return review.identity, review.err
+}
+
+// tokenAuthenticator authenticates requests carrying a bearer token in the Authorization header. Tokens are reviewed by
+// the configured cluster, or the first cluster when none is configured.
+func tokenAuthenticator(s *Server) authenticator {
+	reviewer := NewTokenReviewer()
+
+	return func(req *http.Request) (*Identity, error) {
+		header := req.Header.Get("Authorization")
+		if !strings.HasPrefix(header, "Bearer ") {
+			return nil, nil
+		}
+		token := strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+		if token == "" {
+			return nil, fmt.Errorf("invalid token")
+		}
+
+		config := s.Config().Auth.TokenReview
+		cluster := s.clusters[0]
+		if config.Cluster != "" {
+			cluster = findCluster(s.clusters, config.Cluster)
+		}
+		if cluster == nil {
+			return nil, fmt.Errorf("unable to review token, unknown cluster %s", config.Cluster)
+		}
+
+		return reviewer.Review(req, cluster, token, config)
+	}
+}
@@ -9,7 +9,7 @@ import (
 	"github.com/go-chi/chi/v5"
 )
 
-func addUiRoutes(s *Server, router *chi.Mux) {
+func addUiRoutes(s *Server, router chi.Router) {
 	router.Handle("/*", handleUI(s))
 }
 
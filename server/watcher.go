@@ -13,7 +13,7 @@ import (
 	k8scache "k8s.io/client-go/tools/cache"
 )
 
-func Watch[T CacheableEntry](resource schema.GroupVersionResource, client dynamic.Interface, resourceFactory func() T, resourceCache ResourceCache[T]) error {
+func Watch[T CacheableEntry](resource schema.GroupVersionResource, client dynamic.Interface, resourceFactory func() T, resourceCache ResourceCache[T], stopCh <-chan struct{}) error {
 	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(client, time.Minute*5, "", nil)
 
 	informer := factory.ForResource(resource).Informer()
@@ -47,25 +47,19 @@ func Watch[T CacheableEntry](resource schema.GroupVersionResource, client dynami
 	})
 
 	log.Println("Watching", resource.Resource)
-	// TODO: Stop the informer before exiting program
-	// ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
-	// defer cancel()
-	go informer.Run(make(<-chan struct{}))
+	go informer.Run(stopCh)
 
 	return nil
 }
 
-func NewWatcher(resource schema.GroupVersionResource, client dynamic.Interface, resourceEventHandler k8scache.ResourceEventHandlerFuncs) error {
+func NewWatcher(resource schema.GroupVersionResource, client dynamic.Interface, resourceEventHandler k8scache.ResourceEventHandlerFuncs, stopCh <-chan struct{}) error {
 	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(client, time.Minute*5, "", nil)
 
 	informer := factory.ForResource(resource).Informer()
 	informer.AddEventHandler(resourceEventHandler)
 
 	log.Println("Watching", resource.Resource)
-	// TODO: Stop the informer before exiting program
-	// ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
-	// defer cancel()
-	go informer.Run(make(<-chan struct{}))
+	go informer.Run(stopCh)
 
 	return nil
 }